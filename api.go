@@ -21,43 +21,702 @@ package api
 // (exception: cast testing file which uses 'testify')
 
 import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 )
 
-// apiData is a structure mapping to the "root" API settings (currently the
+// Response is a structure mapping to the "root" API settings (currently the
 // API is dumped in JSON format).  If fields aren't provided then they will
-// not be shown but one must have APIVersion defined (and ID will come back
+// not be shown but one must have APIVersion defined, unless missing versions
+// are allowed (see AllowMissingAPIVersion), (and ID will come back
 // as 0 if not later set, ie: 0 means "success" as it maps to the exit value
 // of the tool essentially)
-type apiData struct {
-	APIVersion string      `json:"apiVersion"`
-	Context    string      `json:"context,omitempty"`
-	ID         int         `json:"id"`
-	Note       interface{} `json:"note,omitempty"`
-	Warning    interface{} `json:"warning,omitempty"`
-	Error      interface{} `json:"error,omitempty"`
-	Data       interface{} `json:"data,omitempty"`
-	Metadata   interface{} `json:"metadata,omitempty"`
+type Response struct {
+	APIVersion   string            `json:"apiVersion,omitempty"`
+	Context      string            `json:"context,omitempty"`
+	ID           int               `json:"id"`
+	Note         interface{}       `json:"note,omitempty"`
+	Warning      interface{}       `json:"warning,omitempty"`
+	Error        interface{}       `json:"error,omitempty"`
+	Diagnostics  []Diagnostic      `json:"diagnostics,omitempty"`
+	Counts       map[string]int    `json:"counts,omitempty"`
+	Data         interface{}       `json:"data,omitempty"`
+	DataChecksum string            `json:"dataChecksum,omitempty"`
+	Metadata     interface{}       `json:"metadata,omitempty"`
+	Links        map[string]string `json:"links,omitempty"`
 }
 
 // Msg is used typically to store an API error or warning message, set up
 // the basic data and use SetStoredFatalError(), SetStoredNonFatalWarning()
-// and SetStoredNote() routines to stash these.
+// and SetStoredNote() routines to stash these.  Along with the numeric code
+// a symbolic CodeString (eg: "api.marshal.failed") may be given, both are
+// included in the JSON when set.
 type Msg struct {
-	Message string `json:"message"`
-	Code    int    `json:"code,omitempty"`
-	Level   string `json:"level,omitempty"`
+	Message    string                 `json:"message"`
+	Code       int                    `json:"code,omitempty"`
+	CodeString string                 `json:"codeString,omitempty"`
+	Level      string                 `json:"level,omitempty"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+	Causes     []Msg                  `json:"causes,omitempty"`
+	Count      int                    `json:"count,omitempty"`
+}
+
+// Level is the level (severity) of a message, Msg levels are plain strings
+// so any level can be used but these are the standard ones
+type Level string
+
+// Standard message levels
+const (
+	LevelNote    Level = "NOTE"
+	LevelIssue   Level = "ISSUE"
+	LevelWarning Level = "WARNING"
+	LevelFatal   Level = "FATAL"
+)
+
+// UnknownLevelSeverity is the severity LevelSeverity() gives unknown levels
+// (it is below all the standard levels)
+const UnknownLevelSeverity = 0
+
+// levelSeverities maps the standard levels to their severity, higher is
+// more severe
+var levelSeverities = map[string]int{
+	string(LevelNote):    1,
+	string(LevelIssue):   2,
+	string(LevelWarning): 3,
+	string(LevelFatal):   4,
+}
+
+// LevelSeverity returns the severity of the given level (case insensitive),
+// higher is more severe: NOTE is 1, ISSUE 2, WARNING 3 and FATAL 4,
+// any other level is UnknownLevelSeverity (0).  This is the single source of
+// truth for level precedence.
+func LevelSeverity(level string) int {
+	if severity, ok := levelSeverities[strings.ToUpper(level)]; ok {
+		return severity
+	}
+	return UnknownLevelSeverity
+}
+
+// MoreSevere returns true if level a is more severe than level b
+func MoreSevere(a, b string) bool {
+	return LevelSeverity(a) > LevelSeverity(b)
+}
+
+// Diagnostic is a message with a level and (optional) location info, these
+// are stored via AddDiagnostic() and end up in the "diagnostics" array of
+// the JSON output, mixing severities for richer client tooling
+type Diagnostic struct {
+	Level    Level  `json:"level"`
+	Message  string `json:"message"`
+	Location string `json:"location,omitempty"`
 }
 
 var (
 	mu                                                  sync.RWMutex
 	storedFatalError, storedNonFatalWarning, storedNote Msg
+
+	// maxMessageLength caps the length of Msg messages at render time, if
+	// 0 then there is no limit (the default), msgDetailsOnTruncate indicates
+	// if the full message should be moved into the Msg details when cut
+	maxMessageLength     = 0
+	msgDetailsOnTruncate = false
+
+	// stripANSIFromMessages indicates if ANSI escape sequences are removed
+	// from Msg messages at render time (see SetStripANSIFromMessages)
+	stripANSIFromMessages = false
+
+	// fatalOverwritePolicy controls what SetStoredFatalError does when a
+	// fatal error has already been stored (see SetFatalOverwritePolicy)
+	fatalOverwritePolicy = FatalLastWins
+
+	// messageSeparator goes between messages that are combined into one Msg
+	// (eg: by SetStoredNote) if the first doesn't end in a newline
+	messageSeparator = DefaultMessageSeparator
+
+	// maxStoredWarnings and maxStoredNotes cap how many different msgs are
+	// combined into the stored warning and note, 0 means unlimited (the
+	// default), beyond the cap msgs are only counted as dropped (see
+	// SetMaxStoredWarnings), the counts are reset along with the stored msg
+	maxStoredWarnings, maxStoredNotes     = 0, 0
+	droppedWarningCount, droppedNoteCount = 0, 0
+
+	// storedWarningParts and storedNoteParts are the different msgs combined
+	// into the stored warning and note (oldest first) along with how many
+	// times each was stored, they are reset along with the stored msg
+	storedWarningParts, storedNoteParts []storedPart
+
+	// dedupAcrossSeverities indicates if a note that repeats the warning is
+	// left out of the JSON output (see SetDedupAcrossSeverities)
+	dedupAcrossSeverities = false
+
+	// maxItemDepth is the max nesting depth allowed within any item passed
+	// to SetAPIItems (and the like), 0 means unlimited (the default)
+	maxItemDepth = 0
+
+	// defaultNotes and defaultWarnings are added to every JSON response
+	// in addition to any stored note or warning (see RegisterDefaultNote)
+	defaultNotes, defaultWarnings []Msg
+
+	// itemTransformer, if set, is run on each item by SetAPIItems (and the
+	// like) before it is placed in the data block (see SetItemTransformer)
+	itemTransformer func(interface{}) interface{}
+
+	// codesAsStrings indicates if Msg codes are rendered as JSON strings
+	// rather than numbers (see SetCodesAsStrings)
+	codesAsStrings = false
+
+	// msgSchemaVersion is the shape Msgs are rendered in, eg: the legacy
+	// shape with only the message, code and level (see SetMsgSchemaVersion)
+	msgSchemaVersion = MsgSchemaCurrent
+
+	// codeOffset is added to every (non-zero) Msg code when rendered (see
+	// SetCodeOffset)
+	codeOffset = 0
+
+	// structuredLevels indicates if Msg levels are rendered as an object with
+	// the level name and severity value (see SetStructuredLevels)
+	structuredLevels = false
+
+	// validateFields indicates if SetAPIItems checks that each of the fields
+	// given actually appear in the (map based) items (see SetValidateFields)
+	validateFields = false
+
+	// flattenSingleItem indicates if a lone item given to SetAPIItems is
+	// placed in the data block as is, not in an array (see
+	// SetFlattenSingleItem)
+	flattenSingleItem = false
+
+	// dropNilItemsActive indicates if nil items given to SetAPIItems (and the
+	// like) are dropped rather than rendered as null (see SetDropNilItems)
+	dropNilItemsActive = false
+
+	// storedDiagnostics are added to the JSON output "diagnostics" array
+	storedDiagnostics []Diagnostic
+
+	// storedLinks are added to the JSON output root "links" object
+	storedLinks map[string]string
+
+	// storedID is the "id" (exit value) used in the JSON output when there
+	// is no fatal error (see SetStoredID), 0 means success
+	storedID = 0
+
+	// includeRuntimeMeta indicates if the Go version, OS and arch are put in
+	// the JSON output metadata (see SetIncludeRuntimeMeta)
+	includeRuntimeMeta = false
+
+	// alwaysEmitContext indicates if the response "context" is included in
+	// the JSON even when empty (see SetAlwaysEmitContext)
+	alwaysEmitContext = false
+
+	// sortField and sortAscending are the sort info put in the data block
+	// by SetAPIItems (see SetSortInfo), autoSort indicates if SetAPIItems
+	// also sorts the items that way (see SetAutoSort)
+	sortField     = ""
+	sortAscending = true
+	autoSort      = false
+
+	// kindFields are the fields used by SetAPIItems (and the like) for a
+	// kind of item when no fields are given (see RegisterKindFields)
+	kindFields map[string][]string
+)
+
+// AlwaysEmitContext returns true if an empty context is still included
+func AlwaysEmitContext() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	always := alwaysEmitContext
+	return always
+}
+
+// SetAlwaysEmitContext can be used to have the response "context" always
+// included in the JSON output, even as "" when there is no context, for
+// clients that require the key.  Defaults to false (an empty context is
+// left out).
+func SetAlwaysEmitContext(b bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	alwaysEmitContext = b
+}
+
+// IncludeRuntimeMeta returns true if runtime details are put in the metadata
+func IncludeRuntimeMeta() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	include := includeRuntimeMeta
+	return include
+}
+
+// SetIncludeRuntimeMeta can be used to have the "goVersion", "os" and "arch"
+// the tool is running with (see the runtime package) put in the "metadata"
+// of the JSON output from GetJSONOutput (and the like), handy when triaging
+// responses sent in by users (eg: in debug builds).  Any other metadata map
+// entries are kept.  Defaults to false (to keep the output lean).
+func SetIncludeRuntimeMeta(b bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	includeRuntimeMeta = b
+}
+
+// addRuntimeMeta adds the runtime details to the response metadata if it
+// is empty or a map (other metadata types are left alone)
+func addRuntimeMeta(r *Response) {
+	meta := make(map[string]interface{}, 3)
+	switch existing := r.Metadata.(type) {
+	case nil:
+	case map[string]interface{}:
+		for k, v := range existing {
+			meta[k] = v
+		}
+	default:
+		return
+	}
+	meta["goVersion"] = runtime.Version()
+	meta["os"] = runtime.GOOS
+	meta["arch"] = runtime.GOARCH
+	r.Metadata = meta
+}
+
+// DefaultMessageSeparator is the default separator between combined messages
+const DefaultMessageSeparator = "; "
+
+// MessageSeparator returns the separator used between combined messages
+func MessageSeparator() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	sep := messageSeparator
+	return sep
+}
+
+// SetMessageSeparator can be used to change the separator put between
+// messages that are combined into a single Msg (eg: when SetStoredNote or
+// SetStoredNonFatalWarning are used more than once) so the combined message
+// is readable.  Messages that already end in a newline (the norm, eg:
+// "Disk full\n") are delimited by it so no separator is added after them.
+// Defaults to DefaultMessageSeparator ("; ").
+func SetMessageSeparator(sep string) {
+	mu.Lock()
+	defer mu.Unlock()
+	messageSeparator = sep
+}
+
+// joinMessages returns the two messages combined with the given separator
+// between them, unless the first is empty or already ends in a newline
+func joinMessages(first string, second string, sep string) string {
+	if first == "" || second == "" || strings.HasSuffix(first, "\n") {
+		return first + second
+	}
+	return first + sep + second
+}
+
+// hasMessage returns true if the given message matches the combined message
+// or one of the messages that were combined into it (see joinMessages), the
+// messages are compared exactly apart from leading and trailing white space
+// so a message that is only part of another one does not match
+func hasMessage(combined string, message string, sep string) bool {
+	want := strings.TrimSpace(message)
+	if want == strings.TrimSpace(combined) {
+		return true
+	}
+	for _, line := range strings.Split(combined, "\n") {
+		if strings.TrimSpace(line) == want {
+			return true
+		}
+		if sep == "" {
+			continue
+		}
+		for _, part := range strings.Split(line, sep) {
+			if strings.TrimSpace(part) == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Policies available for SetFatalOverwritePolicy() which is used to decide
+// what happens when a stored fatal error is set more than once
+const (
+	FatalFirstWins  = "first-wins"
+	FatalLastWins   = "last-wins"
+	FatalAccumulate = "accumulate"
 )
 
 // NewMsg creates a Msg struct for use in errors and warnings such
-// that they can be stored in JSON format when it is finally dumped
+// that they can be stored in JSON format when it is finally dumped, the
+// level is normalized to upper case (eg: "fatal" becomes "FATAL")
 func NewMsg(msg string, code int, level string) Msg {
-	return Msg{Message: msg, Code: code, Level: level}
+	return Msg{Message: msg, Code: code, Level: normalizeLevel(level)}
+}
+
+// normalizeLevel returns the canonical (upper case) form of the given level
+// so the JSON output is consistent however callers cased it, any level not
+// known (see LevelSeverity) is kept but upper cased as well
+func normalizeLevel(level string) string {
+	return strings.ToUpper(level)
+}
+
+// MsgOption sets an optional field of a Msg being created via NewMessage
+type MsgOption func(*Msg)
+
+// WithCode sets the code of a Msg created via NewMessage
+func WithCode(code int) MsgOption {
+	return func(m *Msg) {
+		m.Code = code
+	}
+}
+
+// WithCodeString sets the symbolic code of a Msg created via NewMessage
+func WithCodeString(code string) MsgOption {
+	return func(m *Msg) {
+		m.CodeString = code
+	}
+}
+
+// WithLevel sets the level of a Msg created via NewMessage
+func WithLevel(level Level) MsgOption {
+	return func(m *Msg) {
+		m.Level = normalizeLevel(string(level))
+	}
+}
+
+// WithDetails sets the details of a Msg created via NewMessage
+func WithDetails(details map[string]interface{}) MsgOption {
+	return func(m *Msg) {
+		m.Details = details
+	}
+}
+
+// NewMessage creates a Msg with the given text, any other fields are set via
+// the given options (eg: WithCode, WithLevel, WithDetails) so call sites are
+// clearer than with the positional NewMsg, eg:
+//
+//	api.NewMessage("Disk full\n", api.WithCode(3001), api.WithLevel(api.LevelFatal))
+func NewMessage(text string, opts ...MsgOption) Msg {
+	msg := Msg{Message: text}
+	for _, opt := range opts {
+		opt(&msg)
+	}
+	return msg
+}
+
+// CodesAsStrings returns true if Msg codes are being rendered as strings
+func CodesAsStrings() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	asStrings := codesAsStrings
+	return asStrings
+}
+
+// SetCodesAsStrings can be used to have the Msg "code" field rendered as a
+// JSON string (eg: "1001") instead of a number (eg: 1001, the default), this
+// is for strictly typed consumers or JSON environments that lose precision
+func SetCodesAsStrings(b bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	codesAsStrings = b
+}
+
+// CodeOffset returns the offset added to Msg codes when they are rendered
+func CodeOffset() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	offset := codeOffset
+	return offset
+}
+
+// SetCodeOffset can be used to shift every (non-zero) Msg code by the given
+// offset when it is rendered (in the JSON output, logs and so on), eg: with
+// an offset of 2000 the "No valid JSON API version" code 1001 is emitted as
+// 3001, so that when embedded alongside other tools that emit codes the
+// ranges don't overlap.  The codes stored in Msgs are unchanged.  Defaults
+// to 0 (codes are emitted as is).
+func SetCodeOffset(offset int) {
+	mu.Lock()
+	defer mu.Unlock()
+	codeOffset = offset
+}
+
+// renderedCode returns the given Msg code as it is rendered, ie: with the
+// code offset added (see SetCodeOffset), a code of 0 (no code) is left as is
+func renderedCode(code int) int {
+	if code == 0 {
+		return 0
+	}
+	return code + CodeOffset()
+}
+
+// StructuredLevels returns true if Msg levels are rendered as objects
+func StructuredLevels() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	structured := structuredLevels
+	return structured
+}
+
+// SetStructuredLevels can be used to have the Msg "level" field rendered as
+// an object with both the level name and its severity value (see
+// LevelSeverity), eg: {"name": "FATAL", "value": 4}, for strongly typed
+// clients wanting a machine value as well as a display string.  Defaults to
+// false (the level is a plain string).  Either form is accepted when a Msg
+// is decoded.
+func SetStructuredLevels(b bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	structuredLevels = b
+}
+
+// structuredLevel is how a Msg level is rendered if StructuredLevels() is on
+type structuredLevel struct {
+	Name  string `json:"name"`
+	Value int    `json:"value"`
+}
+
+// msgJSON is the structure a Msg is mapped to when it is rendered as JSON
+// (one can't just marshal the Msg itself as the code may be a number or a
+// string depending upon settings, see SetCodesAsStrings, and likewise the
+// level may be a string or an object, see SetStructuredLevels)
+type msgJSON struct {
+	Message    string                 `json:"message"`
+	Code       interface{}            `json:"code,omitempty"`
+	CodeString string                 `json:"codeString,omitempty"`
+	Level      interface{}            `json:"level,omitempty"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+	Causes     []Msg                  `json:"causes,omitempty"`
+	Count      int                    `json:"count,omitempty"`
+}
+
+// Msg schema versions available for SetMsgSchemaVersion(), ie: the shape
+// Msgs are rendered in
+const (
+	MsgSchemaLegacy  = 1 // only the message, code and level
+	MsgSchemaCurrent = 2 // all Msg fields (the default)
+)
+
+// MsgSchemaVersion returns the schema version (shape) Msgs are rendered in
+func MsgSchemaVersion() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	version := msgSchemaVersion
+	return version
+}
+
+// SetMsgSchemaVersion can be used to have Msgs (the note, warning, error and
+// so on) rendered in an older shape for strict consumers that choke on Msg
+// fields added since, MsgSchemaLegacy renders only the message, code and
+// level (always a plain string) and any repeat count is folded into the
+// message (eg: "Disk slow (repeated 3 times)"), newer fields such as the
+// code string, details and causes are dropped.  Defaults to MsgSchemaCurrent.
+func SetMsgSchemaVersion(version int) {
+	mu.Lock()
+	defer mu.Unlock()
+	msgSchemaVersion = version
+}
+
+// legacyMsg returns the Msg as it is rendered in the legacy schema (see
+// SetMsgSchemaVersion), ie: only the message, code and level
+func legacyMsg(m Msg) Msg {
+	m = foldMsgCount(m)
+	return Msg{Message: m.Message, Code: m.Code, Level: m.Level}
+}
+
+// MarshalJSON renders the Msg as JSON, the code is rendered as a string if
+// CodesAsStrings() is true (otherwise it is a number) and the level as an
+// object if StructuredLevels() is true (otherwise it is a string), in the
+// legacy schema only the message, code and level are rendered (see
+// SetMsgSchemaVersion)
+func (m Msg) MarshalJSON() ([]byte, error) {
+	legacy := MsgSchemaVersion() == MsgSchemaLegacy
+	if legacy {
+		m = legacyMsg(m)
+	}
+	out := msgJSON{Message: m.Message, CodeString: m.CodeString, Details: m.Details, Causes: m.Causes, Count: m.Count}
+	if m.Level != "" {
+		out.Level = m.Level
+		if StructuredLevels() && !legacy {
+			out.Level = structuredLevel{Name: m.Level, Value: LevelSeverity(m.Level)}
+		}
+	}
+	if m.Code != 0 {
+		code := renderedCode(m.Code)
+		out.Code = code
+		if CodesAsStrings() {
+			out.Code = strconv.Itoa(code)
+		}
+	}
+	return marshalJSON(out)
+}
+
+// UnmarshalJSON decodes a JSON Msg, the code may be a number or a string
+// and the level may be a string or a structured level object
+func (m *Msg) UnmarshalJSON(b []byte) error {
+	type msgAlias Msg
+	strMsg := struct {
+		*msgAlias
+		Code  json.Number     `json:"code,omitempty"`
+		Level json.RawMessage `json:"level,omitempty"`
+	}{msgAlias: (*msgAlias)(m)}
+	if err := json.Unmarshal(b, &strMsg); err != nil {
+		return err
+	}
+	m.Level = ""
+	if len(strMsg.Level) != 0 && string(strMsg.Level) != "null" {
+		var level structuredLevel
+		if strMsg.Level[0] == '{' {
+			if err := json.Unmarshal(strMsg.Level, &level); err != nil {
+				return fmt.Errorf("invalid Msg level %s: %s", strMsg.Level, err)
+			}
+		} else if err := json.Unmarshal(strMsg.Level, &level.Name); err != nil {
+			return fmt.Errorf("invalid Msg level %s: %s", strMsg.Level, err)
+		}
+		m.Level = level.Name
+	}
+	m.Code = 0
+	if strMsg.Code != "" {
+		code, err := strconv.Atoi(string(strMsg.Code))
+		if err != nil {
+			return fmt.Errorf("invalid Msg code %q: %s", strMsg.Code, err)
+		}
+		m.Code = code
+	}
+	return nil
+}
+
+// WrapMsg adds the given cause to the outer Msg's chain of causes and returns
+// the resulting Msg, clients can then drill down from the top level message
+// to the root cause (the outer Msg given is not modified)
+func WrapMsg(outer Msg, cause Msg) Msg {
+	causes := make([]Msg, 0, len(outer.Causes)+1)
+	causes = append(causes, outer.Causes...)
+	outer.Causes = append(causes, cause)
+	return outer
+}
+
+// MaxMessageLength returns the current max length (in characters) allowed
+// for a Msg message when it is rendered, 0 means unlimited (the default)
+func MaxMessageLength() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	length := maxMessageLength
+	return length
+}
+
+// SetMaxMessageLength can be used to cap the length (in characters) of any
+// Msg message as it is rendered into JSON.  Longer messages are truncated
+// and end with an ellipsis ("...").  If the optional details bool is given
+// as true then the full message will be moved into the Msg details under
+// the "fullMessage" key.  Use 0 for unlimited length (the default).
+func SetMaxMessageLength(length int, details ...bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	maxMessageLength = length
+	msgDetailsOnTruncate = false
+	if details != nil {
+		msgDetailsOnTruncate = details[0]
+	}
+}
+
+// ansiEscapes matches ANSI escape sequences: CSI sequences (eg: colors and
+// cursor movement), OSC sequences (eg: window titles, hyperlinks) and the
+// single character escapes
+var ansiEscapes = regexp.MustCompile(`\x1b(?:\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(?:\x07|\x1b\\)|[@-Z\\-_])`)
+
+// StripANSI returns the given string with any ANSI escape sequences (eg:
+// terminal color codes) removed
+func StripANSI(s string) string {
+	if !strings.Contains(s, "\x1b") {
+		return s
+	}
+	return ansiEscapes.ReplaceAllString(s, "")
+}
+
+// StripANSIFromMessages returns true if ANSI escapes are removed from messages
+func StripANSIFromMessages() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	strip := stripANSIFromMessages
+	return strip
+}
+
+// SetStripANSIFromMessages can be used to have ANSI escape sequences (see
+// StripANSI) removed from Msg messages as they are rendered into JSON, handy
+// when wrapping colorized subprocess output which otherwise shows up as
+// garbage in clients.  Defaults to false (messages are rendered as is).
+func SetStripANSIFromMessages(b bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	stripANSIFromMessages = b
+}
+
+// truncateMsg returns a copy of the given Msg with any ANSI escapes removed
+// (if desired, see SetStripANSIFromMessages) and the message truncated to
+// the max message length (if one is set, see SetMaxMessageLength)
+func truncateMsg(msg Msg) Msg {
+	mu.RLock()
+	length := maxMessageLength
+	details := msgDetailsOnTruncate
+	strip := stripANSIFromMessages
+	mu.RUnlock()
+	if strip {
+		msg.Message = StripANSI(msg.Message)
+	}
+	if (length > 0 || strip) && msg.Causes != nil {
+		causes := make([]Msg, len(msg.Causes))
+		for i, cause := range msg.Causes {
+			causes[i] = truncateMsg(cause)
+		}
+		msg.Causes = causes
+	}
+	runes := []rune(msg.Message)
+	if length <= 0 || len(runes) <= length {
+		return msg
+	}
+	fullMsg := msg.Message
+	ellipsis := "..."
+	if length <= len(ellipsis) {
+		msg.Message = ellipsis[:length]
+	} else {
+		msg.Message = string(runes[:length-len(ellipsis)]) + ellipsis
+	}
+	if details {
+		// copy the details so the callers map isn't modified
+		newDetails := make(map[string]interface{}, len(msg.Details)+1)
+		for k, v := range msg.Details {
+			newDetails[k] = v
+		}
+		newDetails["fullMessage"] = fullMsg
+		msg.Details = newDetails
+	}
+	return msg
+}
+
+// FatalOverwritePolicy returns the current policy used when a stored fatal
+// error is set and one already exists (defaults to FatalLastWins)
+func FatalOverwritePolicy() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	policy := fatalOverwritePolicy
+	return policy
+}
+
+// SetFatalOverwritePolicy can be used to change what SetStoredFatalError()
+// does if a fatal error was already stored.  With FatalLastWins (default)
+// the new error replaces the old one, with FatalFirstWins the original error
+// is kept (the root cause) and with FatalAccumulate the new message is added
+// after the original one (keeping the original code and level).  Any other
+// policy value is treated as FatalLastWins.
+func SetFatalOverwritePolicy(policy string) {
+	mu.Lock()
+	defer mu.Unlock()
+	fatalOverwritePolicy = policy
 }
 
 // SetStoredFatalError allows one to store a fatal error which
@@ -65,10 +724,22 @@ func NewMsg(msg string, code int, level string) Msg {
 // a JSON message... if this is set the message field must NOT
 // be empty (at least) and it will result in a non-zero exit
 // and a -1 'id' field setting in the JSON output along with
-// the "error" JSON field being set
+// the "error" JSON field being set (see SetFatalOverwritePolicy
+// for what happens if one was already stored).  As with all stored
+// msgs the level is normalized to upper case (see NewMsg).
 func SetStoredFatalError(msg Msg) {
+	msg.Level = normalizeLevel(msg.Level)
 	mu.Lock()
 	defer mu.Unlock()
+	if storedFatalError.Message != "" {
+		switch fatalOverwritePolicy {
+		case FatalFirstWins:
+			return
+		case FatalAccumulate:
+			storedFatalError.Message = joinMessages(storedFatalError.Message, msg.Message, messageSeparator)
+			return
+		}
+	}
 	storedFatalError = msg
 }
 
@@ -78,6 +749,9 @@ func SetStoredFatalError(msg Msg) {
 // all other results and items in the JSON structure but at least the
 // client can see something of interest might need some follow up with
 // the server hosting side before it becomes a fatal class error perhaps.
+// Storing the identical warning again (same message, code and level as one
+// already stored, even if other warnings were stored in between) just bumps
+// its count rather than repeating it (see SetStoredNote).
 func SetStoredNonFatalWarning(msg Msg, defCode ...int) {
 	defaultCode := 0
 	if defCode != nil {
@@ -85,15 +759,96 @@ func SetStoredNonFatalWarning(msg Msg, defCode ...int) {
 	}
 	mu.Lock()
 	defer mu.Unlock()
-	if storedNonFatalWarning.Message != "" {
-		msg.Message = msg.Message + storedNonFatalWarning.Message
-		if msg.Code == 0 || msg.Code == defaultCode {
-			if !(storedNonFatalWarning.Code == 0 || storedNonFatalWarning.Code == defaultCode) {
-				msg.Code = storedNonFatalWarning.Code
+	storeMsg(&storedNonFatalWarning, &storedWarningParts, &droppedWarningCount, maxStoredWarnings, msg, defaultCode)
+}
+
+// storedPart is one of the different msgs combined into a stored warning or
+// note along with how many times it was stored
+type storedPart struct {
+	msg   Msg
+	count int
+}
+
+// storeMsg combines the given msg into the stored msg with the given parts
+// (the different msgs already combined into it) and dropped count, a msg with
+// the same message, code and level as one of the parts just bumps the count
+// of that part (so retries that interleave msgs aren't repeated), beyond the
+// max different msgs (0 means unlimited) a msg is only counted as dropped.
+// The caller must hold the lock.
+func storeMsg(stored *Msg, parts *[]storedPart, dropped *int, max int, msg Msg, defaultCode int) {
+	msg.Level = normalizeLevel(msg.Level)
+	if stored.Message == "" {
+		*parts, *dropped = nil, 0
+	} else if *parts == nil {
+		*parts = []storedPart{{msg: *stored, count: msgCount(*stored)}}
+	}
+	for i, part := range *parts {
+		if part.msg.Message == msg.Message && part.msg.Code == msg.Code && part.msg.Level == msg.Level {
+			(*parts)[i].count++
+			if len(*parts) == 1 {
+				stored.Count = (*parts)[i].count
+			} else {
+				stored.Message = combinedMessage(*parts)
 			}
+			return
 		}
 	}
-	storedNonFatalWarning = msg
+	if max > 0 && len(*parts) >= max {
+		*dropped++
+		return
+	}
+	*parts = append(*parts, storedPart{msg: msg, count: msgCount(msg)})
+	if len(*parts) == 1 {
+		*stored = msg
+		return
+	}
+	if msg.Code == 0 || msg.Code == defaultCode {
+		if !(stored.Code == 0 || stored.Code == defaultCode) {
+			msg.Code = stored.Code
+		}
+	}
+	msg.Message = combinedMessage(*parts)
+	msg.Count = 0
+	*stored = msg
+}
+
+// combinedMessage returns the message combining the given parts, newest
+// first, with the repeat count of each part folded into its message (see
+// foldMsgCount)
+func combinedMessage(parts []storedPart) string {
+	message := ""
+	for i := len(parts) - 1; i >= 0; i-- {
+		part := parts[i].msg
+		part.Count = parts[i].count
+		message = joinMessages(message, foldMsgCount(part).Message, messageSeparator)
+	}
+	return message
+}
+
+// msgCount returns how many times the given Msg occurred (at least once)
+func msgCount(msg Msg) int {
+	if msg.Count < 1 {
+		return 1
+	}
+	return msg.Count
+}
+
+// foldMsgCount returns the Msg with any repeat count folded into the message
+// (eg: "Disk slow\n" seen 3 times becomes "Disk slow (repeated 3 times)\n"),
+// used when a different message is combined with it and the count would no
+// longer apply to the combined message as a whole
+func foldMsgCount(msg Msg) Msg {
+	if msg.Count <= 1 {
+		return msg
+	}
+	trimmed := strings.TrimSuffix(msg.Message, "\n")
+	suffix := ""
+	if len(trimmed) != len(msg.Message) {
+		suffix = "\n"
+	}
+	msg.Message = fmt.Sprintf("%s (repeated %d times)%s", trimmed, msg.Count, suffix)
+	msg.Count = 0
+	return msg
 }
 
 // SetStoredNote allows one to store a "note" message which
@@ -103,7 +858,10 @@ func SetStoredNonFatalWarning(msg Msg, defCode ...int) {
 // and a note is being attached as to where that log file is.
 // Use api.NewMsg to create a Msg and note that the defCode
 // for dvln should probably be out.DefaultErrCode() (although
-// for notes the code isn't really an error, but it's ok)
+// for notes the code isn't really an error, but it's ok).  As with
+// warnings a note identical to one already stored bumps its count, once
+// different notes are combined each count is folded into its message (eg:
+// "Retrying (repeated 3 times)\n").
 func SetStoredNote(msg Msg, defCode ...int) {
 	defaultCode := 0
 	if defCode != nil {
@@ -111,51 +869,1053 @@ func SetStoredNote(msg Msg, defCode ...int) {
 	}
 	mu.Lock()
 	defer mu.Unlock()
-	if storedNote.Message != "" {
-		msg.Message = msg.Message + storedNote.Message
-		if msg.Code == 0 || msg.Code == defaultCode {
-			if !(storedNote.Code == 0 || storedNote.Code == defaultCode) {
-				msg.Code = storedNote.Code
-			}
+	storeMsg(&storedNote, &storedNoteParts, &droppedNoteCount, maxStoredNotes, msg, defaultCode)
+}
+
+// MaxStoredWarnings returns the max number of different warnings combined
+// into the stored warning, 0 is unlimited
+func MaxStoredWarnings() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	max := maxStoredWarnings
+	return max
+}
+
+// SetMaxStoredWarnings can be used to cap how many different warnings
+// SetStoredNonFatalWarning combines into the stored warning (eg: to bound
+// memory use when a buggy loop stores a warning on every pass), once at the
+// cap any more warnings are only counted and the JSON output warning ends
+// with a summary of them (eg: "...and 12 more warnings").  Use 0 for no cap
+// (the default).
+func SetMaxStoredWarnings(max int) {
+	mu.Lock()
+	defer mu.Unlock()
+	maxStoredWarnings = max
+}
+
+// MaxStoredNotes returns the max number of different notes combined into
+// the stored note, 0 is unlimited
+func MaxStoredNotes() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	max := maxStoredNotes
+	return max
+}
+
+// SetMaxStoredNotes is like SetMaxStoredWarnings but for the notes combined
+// by SetStoredNote (eg: "...and 3 more notes").  Use 0 for no cap (the
+// default).
+func SetMaxStoredNotes(max int) {
+	mu.Lock()
+	defer mu.Unlock()
+	maxStoredNotes = max
+}
+
+// DedupAcrossSeverities returns true if a note repeating the warning is dropped
+func DedupAcrossSeverities() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	dedup := dedupAcrossSeverities
+	return dedup
+}
+
+// SetDedupAcrossSeverities can be used to have the JSON output keep only
+// the most severe occurrence of a message stored as both a note and a
+// warning (common when reporting code paths overlap), ie: if the note
+// message is the same as the warning message (or as one of the messages in
+// it, when warnings were combined) the note is dropped.  Messages are compared
+// exactly apart from leading and trailing white space.  Defaults to false.
+func SetDedupAcrossSeverities(b bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	dedupAcrossSeverities = b
+}
+
+// summarizeDropped returns the given stored msg with a summary of how many
+// more msgs were dropped once the cap was hit (see SetMaxStoredWarnings)
+// added to it, the mutex must be held
+func summarizeDropped(msg Msg, dropped int, what string) Msg {
+	if msg.Message == "" || dropped == 0 {
+		return msg
+	}
+	msg = foldMsgCount(msg)
+	msg.Message = joinMessages(msg.Message, fmt.Sprintf("...and %d more %s\n", dropped, what), messageSeparator)
+	return msg
+}
+
+// RegisterDefaultNote registers a note that will be added to every JSON
+// response generated (eg: an environment banner like "running against
+// staging"), it is combined with any stored note (see SetStoredNote)
+// unless the stored note already contains the identical message.
+func RegisterDefaultNote(msg Msg) {
+	mu.Lock()
+	defer mu.Unlock()
+	defaultNotes = append(defaultNotes, msg)
+}
+
+// RegisterDefaultWarning registers a warning that will be added to every
+// JSON response generated, it is combined with any stored warning (see
+// SetStoredNonFatalWarning) unless the stored warning already contains
+// the identical message.
+func RegisterDefaultWarning(msg Msg) {
+	mu.Lock()
+	defer mu.Unlock()
+	defaultWarnings = append(defaultWarnings, msg)
+}
+
+// ClearDefaultMsgs removes all registered default notes and warnings
+func ClearDefaultMsgs() {
+	mu.Lock()
+	defer mu.Unlock()
+	defaultNotes = nil
+	defaultWarnings = nil
+}
+
+// mergeDefaultMsgs combines the given msg with the default msgs given, any
+// default msg whose message is already one of the messages combined in the
+// msg is skipped (de-duplicated), the code and level of the msg are only
+// filled in from defaults if not set
+func mergeDefaultMsgs(msg Msg, defaults []Msg) Msg {
+	for _, defMsg := range defaults {
+		if defMsg.Message == "" || hasMessage(msg.Message, defMsg.Message, messageSeparator) {
+			continue
+		}
+		msg.Message = joinMessages(msg.Message, defMsg.Message, messageSeparator)
+		if msg.Code == 0 {
+			msg.Code = defMsg.Code
+		}
+		if msg.Level == "" {
+			msg.Level = defMsg.Level
 		}
 	}
-	storedNote = msg
+	return msg
+}
+
+// SetStoredID allows one to store the "id" that will be used in any JSON
+// generated via the 'api' package when there is no fatal error.  The id maps
+// to the exit value of the tool so this can be used to convey a non-error
+// status (eg: 2 for "nothing to do"), it defaults to 0 (success).  A fatal
+// error always results in an id of -1.
+func SetStoredID(id int) {
+	mu.Lock()
+	defer mu.Unlock()
+	storedID = id
+}
+
+// StoredID returns the stored "id" used when there is no fatal error
+func StoredID() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	id := storedID
+	return id
+}
+
+// ExitCode returns the "id" (ie: exit value) that JSON generated via the
+// 'api' package would currently have given the stored state: -1 if a fatal
+// error is stored (see SetStoredFatalError), otherwise the stored id (see
+// SetStoredID, 0 for success).  A CLI can print its JSON output and then
+// os.Exit() with this (note an API version problem only found when the JSON
+// is generated isn't known here, the id in the output is the final word).
+func ExitCode() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	if storedFatalError.Message != "" {
+		return -1
+	}
+	id := storedID
+	return id
+}
+
+// AddDiagnostic stores a diagnostic message with the given level and an
+// optional location (eg: "file.go:12", use "" to skip) that will be added
+// to the "diagnostics" array of any JSON generated via the 'api' package,
+// this complements the simpler note/warning/error model.
+func AddDiagnostic(level Level, msg string, location string) {
+	mu.Lock()
+	defer mu.Unlock()
+	storedDiagnostics = append(storedDiagnostics, Diagnostic{Level: level, Message: msg, Location: location})
+}
+
+// Diagnostics returns a copy of the currently stored diagnostics
+func Diagnostics() []Diagnostic {
+	mu.RLock()
+	defer mu.RUnlock()
+	if storedDiagnostics == nil {
+		return nil
+	}
+	diags := make([]Diagnostic, len(storedDiagnostics))
+	copy(diags, storedDiagnostics)
+	return diags
+}
+
+// ClearDiagnostics removes all stored diagnostics
+func ClearDiagnostics() {
+	mu.Lock()
+	defer mu.Unlock()
+	storedDiagnostics = nil
+}
+
+// AddLink stores a hypermedia link (eg: rel "self", "docs" or "related")
+// that will be added to the root "links" object of any JSON generated via
+// the 'api' package, the links apply to the response as a whole.  Adding a
+// link with the same rel as an existing link replaces it.
+func AddLink(rel string, href string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if storedLinks == nil {
+		storedLinks = make(map[string]string)
+	}
+	storedLinks[rel] = href
+}
+
+// Links returns a copy of the currently stored links
+func Links() map[string]string {
+	mu.RLock()
+	defer mu.RUnlock()
+	if storedLinks == nil {
+		return nil
+	}
+	links := make(map[string]string, len(storedLinks))
+	for rel, href := range storedLinks {
+		links[rel] = href
+	}
+	return links
+}
+
+// ClearLinks removes all stored links
+func ClearLinks() {
+	mu.Lock()
+	defer mu.Unlock()
+	storedLinks = nil
 }
 
 // newAPIData basically sets up a new API "root" structure which contains the
 // API version, a given context (eg: "dvlnGlobs", "dvlnGet") and a default
 // ID of 0... along with empty pointers to Data and Error to be fleshed out
 // by the caller (data: items: [..] or error: {errdata})
-func newAPIData(apiVersion string, context string) *apiData {
-	var rootData apiData
+func newAPIData(apiVersion string, context string) *Response {
+	var rootData Response
 	rootData.APIVersion = apiVersion
 	rootData.Context = context
 	return &rootData
 }
 
+// SetID sets the "id" (exit value) of the Response, use this to convey a
+// specific non-error status (0 is success, -1 is used for fatal errors)
+func (r *Response) SetID(id int) *Response {
+	r.ID = id
+	return r
+}
+
+// NewResponse creates a new API "root" Response for the given API version
+// and context, use SetAPIItems (or the like) to add the items to it
+func NewResponse(apiVersion string, context string) *Response {
+	return newAPIData(apiVersion, context)
+}
+
+// AbsorbStoredMessages copies the stored fatal error, warning and note (see
+// SetStoredFatalError, SetStoredNonFatalWarning and SetStoredNote) into the
+// Response so code using the stored msgs can be moved over to building a
+// Response bit by bit.  A stored msg is added after any Msg already in the
+// Response (as SetStoredNote would combine them), a stored fatal error also
+// sets the id to -1.  If clear is given as true then the stored msgs are
+// cleared once absorbed (so they aren't reported twice).
+func (r *Response) AbsorbStoredMessages(clear ...bool) *Response {
+	mu.Lock()
+	errMsg := storedFatalError
+	warnMsg := summarizeDropped(storedNonFatalWarning, droppedWarningCount, "warnings")
+	noteMsg := summarizeDropped(storedNote, droppedNoteCount, "notes")
+	if clear != nil && clear[0] {
+		storedFatalError = Msg{}
+		storedNonFatalWarning = Msg{}
+		storedNote = Msg{}
+	}
+	mu.Unlock()
+	r.Note = absorbMsg(r.Note, noteMsg)
+	r.Warning = absorbMsg(r.Warning, warnMsg)
+	r.Error = absorbMsg(r.Error, errMsg)
+	if errMsg.Message != "" {
+		r.ID = -1
+	}
+	return r
+}
+
+// absorbMsg returns the given Response msg with the stored msg added after
+// it, a Response msg that isn't a Msg is left as is
+func absorbMsg(existing interface{}, stored Msg) interface{} {
+	if stored.Message == "" {
+		return existing
+	}
+	switch msg := existing.(type) {
+	case nil:
+		return stored
+	case Msg:
+		return combineMsgs(msg, stored)
+	}
+	return existing
+}
+
+// MaxDepth returns the max nesting depth allowed for items, 0 is unlimited
+func MaxDepth() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	depth := maxItemDepth
+	return depth
+}
+
+// SetMaxDepth can be used to limit how deeply nested (maps, slices, structs)
+// any item given to SetAPIItems (and the like) can be.  Items are checked
+// before they are marshaled and any item nested deeper than the limit will
+// be dropped and a warning stored.  Use 0 for unlimited depth (the default).
+func SetMaxDepth(depth int) {
+	mu.Lock()
+	defer mu.Unlock()
+	maxItemDepth = depth
+}
+
+// SetItemTransformer can be used to set a function that is run on every item
+// given to SetAPIItems (and the like) before it is placed in the data block,
+// what it returns is used in place of the item.  Handy for cross-cutting item
+// changes (eg: converting internal enum ints to strings).  Use nil (the
+// default) to have items passed through unchanged.
+func SetItemTransformer(transformer func(interface{}) interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	itemTransformer = transformer
+}
+
+// transformItems returns the items after running the item transformer on
+// each (see SetItemTransformer), the given items slice is not modified
+func transformItems(items []interface{}) []interface{} {
+	mu.RLock()
+	transformer := itemTransformer
+	mu.RUnlock()
+	if transformer == nil || items == nil {
+		return items
+	}
+	newItems := make([]interface{}, len(items))
+	for i, item := range items {
+		newItems[i] = transformer(item)
+	}
+	return newItems
+}
+
+// DropNilItems returns true if nil items are dropped rather than rendered
+func DropNilItems() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	drop := dropNilItemsActive
+	return drop
+}
+
+// SetDropNilItems can be used to have nil items (including nil pointers,
+// maps and slices) given to SetAPIItems (and the like) dropped rather than
+// rendered as null in the items array, which some strict clients reject.
+// The item counts only include the items kept and a warning is stored noting
+// how many were dropped.  Defaults to false (nil items are rendered as null).
+func SetDropNilItems(b bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	dropNilItemsActive = b
+}
+
+// dropNilItems returns the items that are not nil if nil items are to be
+// dropped (see SetDropNilItems), if any are dropped a warning is stored
+func dropNilItems(items []interface{}) []interface{} {
+	if !DropNilItems() {
+		return items
+	}
+	var okItems []interface{}
+	dropped := 0
+	for _, item := range items {
+		if isNilItem(item) {
+			dropped++
+			continue
+		}
+		okItems = append(okItems, item)
+	}
+	if dropped == 0 {
+		return items
+	}
+	msg := fmt.Sprintf("Nil items were dropped (%d dropped)\n", dropped)
+	SetStoredNonFatalWarning(NewMsg(msg, 1010, "ISSUE"))
+	return okItems
+}
+
+// isNilItem returns true if the item is nil or is a nil pointer, map, slice
+// or the like (anything that would be rendered as a JSON null)
+func isNilItem(item interface{}) bool {
+	if item == nil {
+		return true
+	}
+	v := reflect.ValueOf(item)
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface, reflect.Func, reflect.Chan:
+		return v.IsNil()
+	}
+	return false
+}
+
+// checkItemDepths returns the items that are within the max depth setting
+// (see SetMaxDepth), if any are dropped due to depth a warning is stored
+func checkItemDepths(items []interface{}) []interface{} {
+	maxDepth := MaxDepth()
+	if maxDepth <= 0 {
+		return items
+	}
+	var dropped []string
+	var okItems []interface{}
+	for i, item := range items {
+		if exceedsDepth(reflect.ValueOf(item), 0, maxDepth) {
+			dropped = append(dropped, fmt.Sprintf("%d", i+1))
+			continue
+		}
+		okItems = append(okItems, item)
+	}
+	if dropped == nil {
+		return items
+	}
+	msg := fmt.Sprintf("Items nested deeper than %d levels were dropped (item indexes: %s)\n", maxDepth, strings.Join(dropped, ", "))
+	SetStoredNonFatalWarning(NewMsg(msg, 1006, "ISSUE"))
+	return okItems
+}
+
+// exceedsDepth walks the given value and returns true if it has maps, slices,
+// arrays or structs nested deeper than maxDepth (the walk stops at maxDepth
+// so cyclic or very deep structures are not walked endlessly)
+func exceedsDepth(v reflect.Value, depth int, maxDepth int) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return false
+		}
+		return exceedsDepth(v.Elem(), depth, maxDepth)
+	case reflect.Map:
+		if depth++; depth > maxDepth {
+			return true
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			if exceedsDepth(iter.Value(), depth, maxDepth) {
+				return true
+			}
+		}
+	case reflect.Struct:
+		if depth++; depth > maxDepth {
+			return true
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if exceedsDepth(v.Field(i), depth, maxDepth) {
+				return true
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			// []byte values are marshaled as a base64 string
+			return false
+		}
+		if depth++; depth > maxDepth {
+			return true
+		}
+		for i := 0; i < v.Len(); i++ {
+			if exceedsDepth(v.Index(i), depth, maxDepth) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ValidateFields returns true if SetAPIItems validates fields against items
+func ValidateFields() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	validate := validateFields
+	return validate
+}
+
+// SetValidateFields can be used to have SetAPIItems check that each of the
+// fields given is found in at least one of the items, a warning is stored
+// listing any fields that never appear (catches stale fields metadata).
+// Only map based items (map[string]interface{}) are checked.
+func SetValidateFields(b bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	validateFields = b
+}
+
+// FlattenSingleItem returns true if a lone item is not placed in an array
+func FlattenSingleItem() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	flatten := flattenSingleItem
+	return flatten
+}
+
+// SetFlattenSingleItem can be used to have SetAPIItems (and GetJSONOutput
+// and the like) place the item directly in the data "items" field when there
+// is exactly one item, rather than in a one element array, for clients that
+// fetch by unique key and always expect one object.  Defaults to false (the
+// items are always an array).
+func SetFlattenSingleItem(b bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	flattenSingleItem = b
+}
+
+// checkFields stores a warning if field validation is active and any of
+// the given fields are not found in any of the map based items
+func checkFields(fields []string, items []interface{}) {
+	if !ValidateFields() || fields == nil {
+		return
+	}
+	found := make(map[string]bool, len(fields))
+	mapItems := false
+	for _, item := range items {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		mapItems = true
+		for _, field := range fields {
+			if _, exists := m[field]; exists {
+				found[field] = true
+			}
+		}
+	}
+	if !mapItems {
+		return
+	}
+	var missing []string
+	for _, field := range fields {
+		if !found[field] {
+			missing = append(missing, field)
+		}
+	}
+	if missing != nil {
+		msg := fmt.Sprintf("Fields not found in any item: %s\n", strings.Join(missing, ", "))
+		SetStoredNonFatalWarning(NewMsg(msg, 1007, "ISSUE"))
+	}
+}
+
+// checkPrimitiveItems stores a warning if fields are given but some of the
+// items are not keyed objects (maps or structs) that fields can apply to
+func checkPrimitiveItems(fields []string, items []interface{}) {
+	if len(fields) == 0 {
+		return
+	}
+	var primitives []string
+	for i, item := range items {
+		if !isKeyedItem(item) {
+			primitives = append(primitives, fmt.Sprintf("%d", i+1))
+		}
+	}
+	if primitives != nil {
+		msg := fmt.Sprintf("Fields do not apply to items that are not objects (item indexes: %s)\n", strings.Join(primitives, ", "))
+		SetStoredNonFatalWarning(NewMsg(msg, 1009, "ISSUE"))
+	}
+}
+
+// rawIsObject returns true if the given raw JSON is an object
+func rawIsObject(raw []byte) bool {
+	trimmed := bytes.TrimSpace(raw)
+	return len(trimmed) > 0 && trimmed[0] == '{'
+}
+
+// isKeyedItem returns true if the item is rendered as a JSON object, ie: it
+// is a map or struct (or a pointer to one) or raw JSON holding an object
+func isKeyedItem(item interface{}) bool {
+	switch raw := item.(type) {
+	case RawItem:
+		return rawIsObject(raw)
+	case json.RawMessage:
+		return rawIsObject(raw)
+	}
+	v := reflect.ValueOf(item)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return false
+		}
+		v = v.Elem()
+	}
+	return v.Kind() == reflect.Map || v.Kind() == reflect.Struct
+}
+
+// MergeFields returns the union of the two given fields lists with any
+// duplicates removed, the order is preserved (fields from a first and then
+// any new fields from b), AddAPIItemsGroup uses it to combine the fields of
+// the groups and it's handy when building other composite responses
+func MergeFields(a, b []string) []string {
+	var merged []string
+	seen := make(map[string]bool, len(a)+len(b))
+	for _, fields := range [][]string{a, b} {
+		for _, field := range fields {
+			if seen[field] {
+				continue
+			}
+			seen[field] = true
+			merged = append(merged, field)
+		}
+	}
+	return merged
+}
+
+// RawItem is an item that is already serialized JSON, it is embedded in the
+// items as is (no decoding and re-encoding of the item), eg:
+// SetAPIItems("cfg", "", nil, []interface{}{api.RawItem(cfgJSON)}).  Raw
+// items that are not valid JSON are dropped (with a warning) and the max
+// depth setting is not applied to them (see SetMaxDepth).
+type RawItem json.RawMessage
+
+// MarshalJSON returns the raw item JSON (a nil raw item is null)
+func (r RawItem) MarshalJSON() ([]byte, error) {
+	if r == nil {
+		return []byte("null"), nil
+	}
+	return r, nil
+}
+
+// checkRawItems returns the items with any raw items that are not valid JSON
+// removed (see RawItem), if any are dropped a warning is stored
+func checkRawItems(items []interface{}) []interface{} {
+	var dropped []string
+	var okItems []interface{}
+	for i, item := range items {
+		if raw, ok := item.(RawItem); ok && raw != nil && !json.Valid(raw) {
+			dropped = append(dropped, fmt.Sprintf("%d", i+1))
+			continue
+		}
+		okItems = append(okItems, item)
+	}
+	if dropped == nil {
+		return items
+	}
+	msg := fmt.Sprintf("Raw JSON items that are not valid JSON were dropped (item indexes: %s)\n", strings.Join(dropped, ", "))
+	SetStoredNonFatalWarning(NewMsg(msg, 1011, "ISSUE"))
+	return okItems
+}
+
+// itemsData is the "data" block of the API root structure, it describes the
+// items being returned (Items is typically an array of items but may also be
+// an object keyed by some item field, see SetAPIItemsKeyed), Items is left
+// nil if there are no items so the "items" key is omitted
+type itemsData struct {
+	Kind             string      `json:"kind,omitempty"`
+	Verbosity        string      `json:"verbosity,omitempty"`
+	Fields           []string    `json:"fields,omitempty"`
+	Sort             *sortInfo   `json:"sort,omitempty"`
+	TotalItems       int         `json:"totalItems,omitempty"`
+	StartIndex       int         `json:"startIndex,omitempty"`
+	CurrentItemCount int         `json:"currentItemCount,omitempty"`
+	Items            interface{} `json:"items,omitempty"`
+
+	// source, if set, supplies the items on demand (see SetAPIItemsSource)
+	source ItemSource
+}
+
 // SetAPIItems will take a more detailed "kind" of items (eg: 'env' or 'cfg'
 // for Globs data), an optional verbosity (use "" to skip), the fields maps to
 // the fields available within each item included and the items themselves
-// which must be an array of interface{} for this to fly.
-func (r *apiData) SetAPIItems(kind string, verbosity string, fields []string, items []interface{}) *apiData {
-	type jsonData struct {
-		Kind             string        `json:"kind,omitempty"`
-		Verbosity        string        `json:"verbosity,omitempty"`
-		Fields           []string      `json:"fields,omitempty"`
-		TotalItems       int           `json:"totalItems,omitempty"`
-		StartIndex       int           `json:"startIndex,omitempty"`
-		CurrentItemCount int           `json:"currentItemCount,omitempty"`
-		Items            []interface{} `json:"items,omitempty"`
-	}
-	var data jsonData
+// which must be an array of interface{} for this to fly (a lone item may be
+// placed in the data block as is, see SetFlattenSingleItem).  Any sort info
+// is recorded in the data block (and the items may be sorted, see
+// SetSortInfo).  The fields are copied so later changes to the callers
+// slice don't change the response (any duplicate fields are dropped and a
+// warning stored), the items are not copied though.  Items are run
+// through any item transformer (see SetItemTransformer), nil items may be
+// dropped (see SetDropNilItems) as are those nested too deeply (see
+// SetMaxDepth), any durations are rendered as desired (see
+// SetDurationFormat).  The fields may be validated against the items if
+// desired (see SetValidateFields).  Items that are not
+// keyed objects (eg: numbers or strings) are passed through as is, fields
+// do not apply to them so if fields are given with any such items a warning
+// is stored noting the item indexes.
+func (r *Response) SetAPIItems(kind string, verbosity string, fields []string, items []interface{}) *Response {
+	return r.setPreparedItems(kind, verbosity, fields, prepareItems(items))
+}
+
+// prepareItems runs the given items through the item transformer and drops
+// any nil, invalid raw or too deeply nested items (see SetAPIItems), it is
+// to be done once per set of items (see setPreparedItems)
+func prepareItems(items []interface{}) []interface{} {
+	return convertItemDurations(checkItemDepths(checkRawItems(dropNilItems(transformItems(items)))))
+}
+
+// setPreparedItems is SetAPIItems for items already run through prepareItems
+func (r *Response) setPreparedItems(kind string, verbosity string, fields []string, items []interface{}) *Response {
+	var data itemsData
+	fields = dedupeFields(fieldsForKind(kind, fields))
+	checkPrimitiveItems(fields, items)
+	checkFields(fields, items)
 	data.Kind = kind
 	data.Verbosity = verbosity
-	data.Fields = fields
+	data.Fields = copyFields(fields)
+	if info := currentSortInfo(); info != nil {
+		data.Sort = info
+		if AutoSort() {
+			items = sortItems(items, info.Field, info.Order == SortAscending)
+		}
+	}
 	length := len(items)
 	data.TotalItems = length
 	data.StartIndex = 1
 	data.CurrentItemCount = length
-	data.Items = items
+	if length == 1 && FlattenSingleItem() {
+		data.Items = items[0]
+	} else if length > 0 {
+		// no items leaves the "items" key out (rather than null or [])
+		data.Items = items
+	}
 	r.Data = &data
 	return r
 }
+
+// copyFields returns a copy of the given fields (nil if there are none)
+func copyFields(fields []string) []string {
+	if fields == nil {
+		return nil
+	}
+	return append(make([]string, 0, len(fields)), fields...)
+}
+
+// dedupeFields returns a copy of the given fields with any duplicates
+// dropped (the first of each is kept, in order), a warning is stored listing
+// any duplicates found
+func dedupeFields(fields []string) []string {
+	if fields == nil {
+		return nil
+	}
+	seen := make(map[string]bool, len(fields))
+	deduped := make([]string, 0, len(fields))
+	var dups []string
+	for _, field := range fields {
+		if seen[field] {
+			if !keepField(dups, field) {
+				dups = append(dups, field)
+			}
+			continue
+		}
+		seen[field] = true
+		deduped = append(deduped, field)
+	}
+	if dups != nil {
+		msg := fmt.Sprintf("Duplicate fields dropped: %s\n", strings.Join(dups, ", "))
+		SetStoredNonFatalWarning(NewMsg(msg, 1013, "ISSUE"))
+	}
+	return deduped
+}
+
+// RegisterKindFields registers the fields used for the given kind of item
+// when SetAPIItems (and GetJSONOutput and the like) is given no fields, the
+// field names are the JSON names of the given sample struct (or pointer to
+// one) as encoding/json would marshal it (json tags are honored, fields
+// tagged "-" and unexported fields are skipped and untagged embedded structs
+// are flattened) so the fields metadata stays in sync with the item type.
+// Registering a nil (or non-struct) sample removes the kind's fields.
+func RegisterKindFields(kind string, sample interface{}) {
+	fields := structFields(reflect.TypeOf(sample))
+	mu.Lock()
+	defer mu.Unlock()
+	if fields == nil {
+		delete(kindFields, kind)
+		return
+	}
+	if kindFields == nil {
+		kindFields = make(map[string][]string)
+	}
+	kindFields[kind] = fields
+}
+
+// fieldsForKind returns the given fields or, if there are none, the fields
+// registered for the given kind (see RegisterKindFields)
+func fieldsForKind(kind string, fields []string) []string {
+	if fields != nil {
+		return fields
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	return copyFields(kindFields[kind])
+}
+
+// structFields returns the JSON field names of the given struct type (or
+// pointer to one) in order, nil if it isn't a struct
+func structFields(t reflect.Type) []string {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	fields := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" {
+			if embedded := structFields(f.Type); embedded != nil {
+				fields = append(fields, embedded...)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, name)
+	}
+	return fields
+}
+
+// SetAPIItemsKeyed is like SetAPIItems but the items are placed into a JSON
+// object keyed by the value of the given keyField within each item (instead
+// of in an array).  If an item has no such field (or it is null) or the key
+// was already used by an earlier item then that item is skipped and a warning
+// is stored.
+func (r *Response) SetAPIItemsKeyed(kind string, keyField string, items []interface{}) *Response {
+	var data itemsData
+	var dupKeys, missingKeys []string
+	items = prepareItems(items)
+	keyedItems := make(map[string]interface{}, len(items))
+	for i, item := range items {
+		val, _ := itemField(item, keyField)
+		key, ok := itemKey(val)
+		if !ok {
+			missingKeys = append(missingKeys, fmt.Sprintf("%d", i+1))
+			continue
+		}
+		if _, exists := keyedItems[key]; exists {
+			dupKeys = append(dupKeys, key)
+			continue
+		}
+		keyedItems[key] = item
+	}
+	if missingKeys != nil {
+		msg := fmt.Sprintf("Items missing key field \"%s\" were skipped (item indexes: %s)\n", keyField, strings.Join(missingKeys, ", "))
+		SetStoredNonFatalWarning(NewMsg(msg, 1004, "ISSUE"))
+	}
+	if dupKeys != nil {
+		msg := fmt.Sprintf("Items with duplicate key field \"%s\" values were skipped (keys: %s)\n", keyField, strings.Join(dupKeys, ", "))
+		SetStoredNonFatalWarning(NewMsg(msg, 1005, "ISSUE"))
+	}
+	length := len(keyedItems)
+	data.Kind = kind
+	data.TotalItems = length
+	data.StartIndex = 1
+	data.CurrentItemCount = length
+	if length > 0 {
+		data.Items = keyedItems
+	}
+	r.Data = &data
+	return r
+}
+
+// groupsData is the data section used once a response holds more than one
+// group of items (see AddAPIItemsGroup)
+type groupsData struct {
+	Groups []*itemsData `json:"groups"`
+	Fields []string     `json:"fields,omitempty"`
+}
+
+// AddAPIItemsGroup adds a group of items of the given kind to the response
+// data, the items are handled just as SetAPIItems handles them.  The first
+// group is set just as SetAPIItems would set it, once there is more than one
+// group the data section holds a "groups" array (one entry per group) and
+// the response "counts" maps each kind to its item count (summed if a kind
+// is used more than once) so clients get a quick overview of mixed results.
+// The groups are followed by the combined "fields" of all groups (see
+// MergeFields) so clients know every field any of the items may have.
+func (r *Response) AddAPIItemsGroup(kind string, verbosity string, fields []string, items []interface{}) *Response {
+	var group Response
+	added := group.SetAPIItems(kind, verbosity, fields, items).Data.(*itemsData)
+	switch data := r.Data.(type) {
+	case *itemsData:
+		r.Data = &groupsData{Groups: []*itemsData{data, added}}
+	case *groupsData:
+		data.Groups = append(data.Groups, added)
+	default:
+		r.Data = added
+		return r
+	}
+	grouped := r.Data.(*groupsData)
+	r.Counts = make(map[string]int, len(grouped.Groups))
+	grouped.Fields = nil
+	for _, g := range grouped.Groups {
+		r.Counts[g.Kind] += g.CurrentItemCount
+		grouped.Fields = MergeFields(grouped.Fields, g.Fields)
+	}
+	return r
+}
+
+// Sort orders used in the data block "sort" info (see SetSortInfo)
+const (
+	SortAscending  = "asc"
+	SortDescending = "desc"
+)
+
+// sortInfo is the "sort" info in the data block, the field the items are
+// sorted by and the order (SortAscending or SortDescending)
+type sortInfo struct {
+	Field string `json:"field"`
+	Order string `json:"order"`
+}
+
+// SetSortInfo can be used to record the field the items given to SetAPIItems
+// (and the like) are sorted by and the direction in the data block, eg:
+// "sort": {"field": "name", "order": "asc"}, so clients know the ordering.
+// The items are assumed to already be sorted that way unless auto sorting
+// is on (see SetAutoSort).  Use an empty field to clear the sort info.
+func SetSortInfo(field string, ascending bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	sortField = field
+	sortAscending = ascending
+}
+
+// currentSortInfo returns the sort info to record in the data block, nil if
+// there is none (see SetSortInfo)
+func currentSortInfo() *sortInfo {
+	mu.RLock()
+	defer mu.RUnlock()
+	if sortField == "" {
+		return nil
+	}
+	info := &sortInfo{Field: sortField, Order: SortAscending}
+	if !sortAscending {
+		info.Order = SortDescending
+	}
+	return info
+}
+
+// AutoSort returns true if SetAPIItems sorts the items as per the sort info
+func AutoSort() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	auto := autoSort
+	return auto
+}
+
+// SetAutoSort can be used to have SetAPIItems (and the like) actually sort
+// the items by the sort info field and order (see SetSortInfo) rather than
+// just recording it, numbers are compared numerically and other values as
+// strings, items without the field go last.  The sort is stable and the
+// callers items slice is not modified.  Defaults to false.
+func SetAutoSort(b bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	autoSort = b
+}
+
+// sortItems returns a sorted copy of the items by the given field in the
+// given order (see SetAutoSort)
+func sortItems(items []interface{}, field string, ascending bool) []interface{} {
+	type sortItem struct {
+		item  interface{}
+		val   interface{}
+		found bool
+	}
+	sorted := make([]sortItem, len(items))
+	for i, item := range items {
+		val, found := itemField(item, field)
+		sorted[i] = sortItem{item: item, val: val, found: found}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if !a.found || !b.found {
+			return a.found && !b.found
+		}
+		cmp := compareItemValues(a.val, b.val)
+		if ascending {
+			return cmp < 0
+		}
+		return cmp > 0
+	})
+	newItems := make([]interface{}, len(items))
+	for i, s := range sorted {
+		newItems[i] = s.item
+	}
+	return newItems
+}
+
+// compareItemValues compares two item field values, numbers are compared
+// numerically and anything else as strings, it returns -1, 0 or 1
+func compareItemValues(a, b interface{}) int {
+	aNum, aOk := itemNumber(a)
+	bNum, bOk := itemNumber(b)
+	if aOk && bOk {
+		switch {
+		case aNum < bNum:
+			return -1
+		case aNum > bNum:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+}
+
+// itemNumber returns the given item field value as a float64 if it is a
+// number (including json.Number values)
+func itemNumber(val interface{}) (float64, bool) {
+	if num, ok := val.(json.Number); ok {
+		f, err := num.Float64()
+		return f, err == nil
+	}
+	v := reflect.ValueOf(val)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+// SecureFieldEqual compares two sensitive field values (eg: tokens found in
+// items when deciding whether a field may be shown) in constant time, so
+// that how long the comparison takes doesn't leak how much of the values
+// match (only whether the lengths match can be told)
+func SecureFieldEqual(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// itemField returns the value of the given field within an item along with
+// a boolean indicating if the field was found.  Items that are not maps are
+// run through JSON encoding so struct items are checked via their JSON names.
+func itemField(item interface{}, field string) (interface{}, bool) {
+	if m, ok := item.(map[string]interface{}); ok {
+		val, found := m[field]
+		return val, found
+	}
+	m, err := itemMap(item)
+	if err != nil {
+		return nil, false
+	}
+	val, found := m[field]
+	return val, found
+}
+
+// itemKey returns the given key field value as a key for SetAPIItemsKeyed,
+// numbers are formatted as in JSON (eg: 1234567, not 1.234567e+06), false
+// is returned for a null value
+func itemKey(val interface{}) (string, bool) {
+	switch v := val.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), true
+	}
+	return fmt.Sprintf("%v", val), true
+}
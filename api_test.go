@@ -0,0 +1,1078 @@
+// Copyright © 2015 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// resetStoredMsgs clears any stored fatal error, warning or note so tests
+// can start from a clean slate
+func resetStoredMsgs() {
+	mu.Lock()
+	defer mu.Unlock()
+	storedFatalError = Msg{}
+	storedNonFatalWarning = Msg{}
+	storedNote = Msg{}
+	storedWarningParts, droppedWarningCount = nil, 0
+	storedNoteParts, droppedNoteCount = nil, 0
+	storedDiagnostics = nil
+	storedLinks = nil
+	storedID = 0
+}
+
+// TestMaxMessageLength to see if long messages are truncated when rendered
+func TestMaxMessageLength(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	if length := MaxMessageLength(); length != 0 {
+		t.Errorf("Max message length default was not 0 as expected, found: %d\n", length)
+	}
+	SetMaxMessageLength(10)
+	defer SetMaxMessageLength(0)
+	msg := truncateMsg(NewMsg("This is a long message", 100, "ISSUE"))
+	if msg.Message != "This is..." {
+		t.Errorf("Message was not truncated to 10 chars as expected, found: \"%s\"\n", msg.Message)
+	}
+	if msg.Details != nil {
+		t.Errorf("Message details should not be set unless requested, found: %v\n", msg.Details)
+	}
+	msg = truncateMsg(NewMsg("Short", 100, "ISSUE"))
+	if msg.Message != "Short" {
+		t.Errorf("Short message should not be truncated, found: \"%s\"\n", msg.Message)
+	}
+
+	SetMaxMessageLength(10, true)
+	SetStoredNote(NewMsg("This is a long note message", 0, "INFO"))
+	output, fatal := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	if fatal {
+		t.Fatalf("GetJSONOutput on note indicated fatal, shouldn't have.  Output:\n%s", output)
+	}
+	checkResultContains(t, output, `    "message": "This is...",`)
+	checkResultContains(t, output, `      "fullMessage": "This is a long note message"`)
+
+	// the hand built fatal JSON keeps the full message as well
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	output = FatalJSONMsg("0.1", NewMsg("This is a long fatal message", 2121, "FATAL"))
+	checkResultContains(t, output, `"message": "This is...", "code": 2121, "level": "FATAL", "details": {"fullMessage":"This is a long fatal message"}}`)
+	var result interface{}
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		t.Errorf("FatalJSONMsg with details produced invalid JSON, error: %s\n%s", err, output)
+	}
+}
+
+// TestSetAPIItemsKeyed to see if items are keyed by a field and bad keys warned
+func TestSetAPIItemsKeyed(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	type item struct {
+		Name  string `json:"name"`
+		Value int    `json:"value"`
+	}
+	items := []interface{}{
+		map[string]interface{}{"name": "one", "value": 1},
+		item{Name: "two", Value: 2},
+		item{Name: "one", Value: 3},
+		map[string]interface{}{"value": 4},
+	}
+	output, fatal := GetKeyedJSONOutput("0.1", "dvlnTest", "test", "name", items)
+	if fatal {
+		t.Fatalf("GetKeyedJSONOutput indicated fatal, shouldn't have.  Output:\n%s", output)
+	}
+	checkResultContains(t, output, `    "items": {`)
+	checkResultContains(t, output, `      "one": {`)
+	checkResultContains(t, output, `        "value": 1`)
+	checkResultContains(t, output, `      "two": {`)
+	checkResultContains(t, output, `    "currentItemCount": 2,`)
+	checkResultContains(t, output, `  "warning": {`)
+	checkResultContains(t, output, `duplicate key field \"name\" values were skipped (keys: one)`)
+	checkResultContains(t, output, `missing key field \"name\" were skipped (item indexes: 4)`)
+	checkResultOmits(t, output, `"value": 3`)
+}
+
+// TestSetAPIItemsKeyedNumbers to see if numeric keys are formatted the same
+// for struct and map items and if null keys are skipped (and reported)
+func TestSetAPIItemsKeyedNumbers(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	type item struct {
+		ID    interface{} `json:"id"`
+		Value int         `json:"value"`
+	}
+	items := []interface{}{
+		item{ID: int64(1234567), Value: 1},
+		map[string]interface{}{"id": 1234567, "value": 2},
+		item{ID: int64(12345678901234567), Value: 3},
+		item{ID: nil, Value: 4},
+		map[string]interface{}{"id": nil, "value": 5},
+	}
+	output, fatal := GetKeyedJSONOutput("0.1", "dvlnTest", "test", "id", items)
+	if fatal {
+		t.Fatalf("GetKeyedJSONOutput indicated fatal, shouldn't have.  Output:\n%s", output)
+	}
+	checkResultContains(t, output, `      "1234567": {`)
+	checkResultContains(t, output, `      "12345678901234567": {`)
+	checkResultContains(t, output, `    "currentItemCount": 2,`)
+	checkResultContains(t, output, `duplicate key field \"id\" values were skipped (keys: 1234567)`)
+	checkResultContains(t, output, `missing key field \"id\" were skipped (item indexes: 4, 5)`)
+	checkResultOmits(t, output, `e+`)
+	checkResultOmits(t, output, `<nil>`)
+}
+
+// TestFatalOverwritePolicy to see if repeated fatal errors honor the policy
+func TestFatalOverwritePolicy(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	defer SetFatalOverwritePolicy(FatalLastWins)
+	if policy := FatalOverwritePolicy(); policy != FatalLastWins {
+		t.Errorf("Fatal overwrite policy default was not %s, found: %s\n", FatalLastWins, policy)
+	}
+	first := NewMsg("First fatal\n", 2001, "FATAL")
+	second := NewMsg("Second fatal\n", 2002, "FATAL")
+	tests := []struct {
+		policy  string
+		message string
+		code    int
+	}{
+		{FatalLastWins, "Second fatal\n", 2002},
+		{FatalFirstWins, "First fatal\n", 2001},
+		{FatalAccumulate, "First fatal\nSecond fatal\n", 2001},
+	}
+	for _, test := range tests {
+		resetStoredMsgs()
+		SetFatalOverwritePolicy(test.policy)
+		SetStoredFatalError(first)
+		SetStoredFatalError(second)
+		if storedFatalError.Message != test.message || storedFatalError.Code != test.code {
+			t.Errorf("Policy %s: expected message %q code %d, found: %q code %d\n", test.policy, test.message, test.code, storedFatalError.Message, storedFatalError.Code)
+		}
+	}
+}
+
+// TestSetMaxDepth to see if items nested too deeply are dropped with a warning
+func TestSetMaxDepth(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	if depth := MaxDepth(); depth != 0 {
+		t.Errorf("Max depth default was not 0 as expected, found: %d\n", depth)
+	}
+	SetMaxDepth(2)
+	defer SetMaxDepth(0)
+	type node struct {
+		Name string `json:"name"`
+		Next *node  `json:"next,omitempty"`
+	}
+	cyclic := &node{Name: "loop"}
+	cyclic.Next = cyclic
+	items := []interface{}{
+		"scalar",
+		map[string]interface{}{"a": []interface{}{1, 2}},
+		map[string]interface{}{"a": map[string]interface{}{"b": []interface{}{1}}},
+		cyclic,
+	}
+	output, fatal := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, items)
+	if fatal {
+		t.Fatalf("GetJSONOutput indicated fatal, shouldn't have.  Output:\n%s", output)
+	}
+	checkResultContains(t, output, `    "currentItemCount": 2,`)
+	checkResultContains(t, output, `deeper than 2 levels were dropped (item indexes: 3, 4)`)
+}
+
+// TestRegisterDefaultNote to see if default notes/warnings are added and de-duped
+func TestRegisterDefaultNote(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	defer ClearDefaultMsgs()
+	RegisterDefaultNote(NewMsg("Running against staging\n", 0, "INFO"))
+	RegisterDefaultWarning(NewMsg("Deprecated server\n", 3001, "ISSUE"))
+	output, fatal := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	if fatal {
+		t.Fatalf("GetJSONOutput indicated fatal, shouldn't have.  Output:\n%s", output)
+	}
+	checkResultContains(t, output, `    "message": "Running against staging\n",`)
+	checkResultContains(t, output, `    "message": "Deprecated server\n",`)
+	checkResultContains(t, output, `    "code": 3001,`)
+
+	SetStoredNote(NewMsg("Running against staging\n", 0, "INFO"))
+	SetStoredNonFatalWarning(NewMsg("Disk is almost full\n", 3002, "ISSUE"))
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	checkResultContains(t, output, `    "message": "Running against staging\n",`)
+	checkResultContains(t, output, `    "message": "Disk is almost full\nDeprecated server\n",`)
+	checkResultContains(t, output, `    "code": 3002,`)
+
+	resetStoredMsgs()
+	ClearDefaultMsgs()
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	RegisterDefaultNote(NewMsg("staging\n", 0, "INFO"))
+	SetStoredNote(NewMsg("Not running against staging, using prod\n", 0, "INFO"))
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	checkResultContains(t, output, `"message":"Not running against staging, using prod\nstaging\n"`)
+}
+
+// TestSetItemTransformer to see if items are transformed before being added
+func TestSetItemTransformer(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetItemTransformer(func(item interface{}) interface{} {
+		if i, ok := item.(int); ok {
+			return fmt.Sprintf("enum%d", i)
+		}
+		return item
+	})
+	defer SetItemTransformer(nil)
+	items := []interface{}{1, "two", 3}
+	output, _ := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, items)
+	checkResultContains(t, output, `      "enum1",`)
+	checkResultContains(t, output, `      "two",`)
+	checkResultContains(t, output, `      "enum3"`)
+	if items[0] != 1 {
+		t.Errorf("Item transformer should not modify the callers items, found: %v\n", items[0])
+	}
+}
+
+// TestNewMessage to see if the options given set the Msg fields
+func TestNewMessage(t *testing.T) {
+	if msg := NewMessage("Just text\n"); !reflect.DeepEqual(msg, Msg{Message: "Just text\n"}) {
+		t.Errorf("NewMessage with no options should only set the message, found: %v\n", msg)
+	}
+	details := map[string]interface{}{"path": "/tmp"}
+	msg := NewMessage("Disk full\n", WithLevel(LevelFatal), WithCode(3001), WithDetails(details))
+	expected := NewMsg("Disk full\n", 3001, "FATAL")
+	expected.Details = details
+	if !reflect.DeepEqual(msg, expected) {
+		t.Errorf("NewMessage with options gave %v, expected %v\n", msg, expected)
+	}
+}
+
+// TestNormalizeLevel to see if levels are upper cased however they're given
+func TestNormalizeLevel(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	for _, level := range []string{"fatal", "Fatal", "FATAL"} {
+		if msg := NewMsg("This is a fatal error\n", 2121, level); msg.Level != "FATAL" {
+			t.Errorf("NewMsg level %q should be normalized to FATAL, found: %q\n", level, msg.Level)
+		}
+	}
+	if msg := NewMessage("custom", WithLevel("debug")); msg.Level != "DEBUG" {
+		t.Errorf("Unknown levels should be kept but upper cased, found: %q\n", msg.Level)
+	}
+	SetStoredFatalError(Msg{Message: "This is a fatal error\n", Level: "Fatal"})
+	SetStoredNonFatalWarning(Msg{Message: "This is a warning\n", Level: "issue"})
+	SetStoredNote(Msg{Message: "This is a note\n", Level: "info"})
+	if storedFatalError.Level != "FATAL" || storedNonFatalWarning.Level != "ISSUE" || storedNote.Level != "INFO" {
+		t.Errorf("Stored msg levels should be normalized, found: %q, %q, %q\n", storedFatalError.Level, storedNonFatalWarning.Level, storedNote.Level)
+	}
+}
+
+// TestSetMsgSchemaVersion to see if the legacy schema renders only the
+// message, code and level
+func TestSetMsgSchemaVersion(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	if version := MsgSchemaVersion(); version != MsgSchemaCurrent {
+		t.Errorf("Msg schema version default was not current, found: %d\n", version)
+	}
+	msg := NewMessage("Unable to save\n", WithCode(2121), WithCodeString("pkg.save"), WithLevel(LevelFatal),
+		WithDetails(map[string]interface{}{"path": "/tmp/x"}))
+	msg = WrapMsg(msg, NewMsg("Disk full\n", 28, "FATAL"))
+	msg.Count = 3
+	SetMsgSchemaVersion(MsgSchemaLegacy)
+	defer SetMsgSchemaVersion(MsgSchemaCurrent)
+	SetStructuredLevels(true)
+	defer SetStructuredLevels(false)
+	j, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Marshal of legacy Msg failed, error: %s\n", err)
+	}
+	expected := `{"message":"Unable to save (repeated 3 times)\n","code":2121,"level":"FATAL"}`
+	if string(j) != expected {
+		t.Errorf("Legacy Msg JSON mismatch, expected:\n%s\nfound:\n%s", expected, j)
+	}
+	raw := encodeMsgObjInRawJSON(msg)
+	if raw != `{ "message": "Unable to save (repeated 3 times)\u000a", "code": 2121, "level": "FATAL"}` {
+		t.Errorf("Legacy raw Msg JSON not as expected, found:\n%s", raw)
+	}
+	SetStoredFatalError(msg)
+	output, _ := GetJSONOutput("0.1", "", "", "", nil, nil)
+	checkResultContains(t, output, `"error":`+expected)
+	SetMsgSchemaVersion(MsgSchemaCurrent)
+	j, _ = json.Marshal(msg)
+	for _, key := range []string{`"codeString"`, `"details"`, `"causes"`, `"count":3`} {
+		checkResultContains(t, string(j), key)
+	}
+}
+
+// TestSetCodeOffset to see if rendered codes are shifted by the offset
+func TestSetCodeOffset(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	if offset := CodeOffset(); offset != 0 {
+		t.Errorf("Code offset default was not 0, found: %d\n", offset)
+	}
+	SetCodeOffset(2000)
+	defer SetCodeOffset(0)
+	SetStoredNote(NewMsg("Using cached index\n", 0, "INFO"))
+	msg := NewMsg("This is a warning\n", 3, "ISSUE")
+	SetStoredNonFatalWarning(msg)
+	output, _ := GetJSONOutput("0.1", "", "", "", nil, nil)
+	checkResultContains(t, output, `"note":{"message":"Using cached index\n","level":"INFO"}`)
+	checkResultContains(t, output, `"code":2003,`)
+	if msg.Code != 3 {
+		t.Errorf("The stored code should not change, found: %d\n", msg.Code)
+	}
+	SetCodesAsStrings(true)
+	defer SetCodesAsStrings(false)
+	j, _ := json.Marshal(msg)
+	checkResultContains(t, string(j), `"code":"2003"`)
+	checkResultContains(t, encodeMsgObjInRawJSON(msg), `"code": "2003"`)
+	checkResultContains(t, encodeMsgObjInRawJSON(NewMsg("no code", 0, "INFO")), `"code": "0"`)
+}
+
+// TestSetCodesAsStrings to see if Msg codes can be rendered as strings
+func TestSetCodesAsStrings(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	if CodesAsStrings() {
+		t.Errorf("Codes as strings default was not false as expected")
+	}
+	SetCodesAsStrings(true)
+	defer SetCodesAsStrings(false)
+	SetStoredNonFatalWarning(NewMsg("This is a warning\n", 2122, "ISSUE"))
+	output, _ := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	checkResultContains(t, output, `    "code": "2122",`)
+	output = FatalJSONMsg("0.1", NewMsg("This is fatal\n", 2121, "FATAL"))
+	checkResultContains(t, output, `    "code": "2121",`)
+
+	var msg Msg
+	if err := json.Unmarshal([]byte(`{"message": "hi", "code": "2122"}`), &msg); err != nil || msg.Code != 2122 {
+		t.Errorf("Unable to unmarshal Msg with string code, code: %d, err: %v\n", msg.Code, err)
+	}
+	if err := json.Unmarshal([]byte(`{"message": "hi", "code": 2123}`), &msg); err != nil || msg.Code != 2123 {
+		t.Errorf("Unable to unmarshal Msg with numeric code, code: %d, err: %v\n", msg.Code, err)
+	}
+}
+
+// TestSetStructuredLevels to see if levels are rendered with their severity
+// and that both level forms decode back into a Msg
+func TestSetStructuredLevels(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	if StructuredLevels() {
+		t.Errorf("Structured levels default was not false as expected")
+	}
+	warning := NewMsg("This is a warning\n", 2122, "ISSUE")
+	j, _ := json.Marshal(warning)
+	checkResultContains(t, string(j), `"level":"ISSUE"`)
+	SetStructuredLevels(true)
+	defer SetStructuredLevels(false)
+	j, _ = json.Marshal(warning)
+	checkResultContains(t, string(j), `"level":{"name":"ISSUE","value":2}`)
+	j, _ = json.Marshal(NewMsg("No level", 2122, ""))
+	checkResultOmits(t, string(j), `"level"`)
+	output := FatalJSONMsg("0.1", NewMsg("This is fatal\n", 2121, "FATAL"))
+	checkResultContains(t, output, `      "name": "FATAL",`)
+	checkResultContains(t, output, `      "value": 4`)
+
+	var msg Msg
+	if err := json.Unmarshal([]byte(`{"message": "hi", "level": {"name": "FATAL", "value": 4}}`), &msg); err != nil || msg.Level != "FATAL" {
+		t.Errorf("Unable to unmarshal Msg with structured level, level: %q, err: %v\n", msg.Level, err)
+	}
+	if err := json.Unmarshal([]byte(`{"message": "hi", "level": "NOTE"}`), &msg); err != nil || msg.Level != "NOTE" {
+		t.Errorf("Unable to unmarshal Msg with string level, level: %q, err: %v\n", msg.Level, err)
+	}
+	if err := json.Unmarshal([]byte(`{"message": "hi", "level": 3}`), &msg); err == nil {
+		t.Errorf("Unmarshal of Msg with a numeric level should fail\n")
+	}
+}
+
+// TestStripANSI to see if ANSI escapes are removed from (only) messages
+func TestStripANSI(t *testing.T) {
+	tests := []struct {
+		in, expected string
+	}{
+		{"plain text", "plain text"},
+		{"\x1b[31mred\x1b[0m and \x1b[1;32mbold green\x1b[m", "red and bold green"},
+		{"\x1b]0;title\x07after", "after"},
+		{"\x1b]8;;http://dvln.org\x1b\\link\x1b]8;;\x1b\\", "link"},
+		{"\x1b[2Kcleared\x1bM", "cleared"},
+	}
+	for _, test := range tests {
+		if result := StripANSI(test.in); result != test.expected {
+			t.Errorf("StripANSI(%q) should be %q, found %q\n", test.in, test.expected, result)
+		}
+	}
+
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	inner := NewMsg("\x1b[33mdisk\x1b[0m full\n", 3001, "FATAL")
+	SetStoredFatalError(WrapMsg(NewMsg("\x1b[31mbuild failed\x1b[0m\n", 3002, "FATAL"), inner))
+	output, _ := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	checkResultContains(t, output, `\u001b[31m`)
+	SetStripANSIFromMessages(true)
+	defer SetStripANSIFromMessages(false)
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	checkResultOmits(t, output, `\u001b`)
+	checkResultContains(t, output, `"message": "build failed\n",`)
+	checkResultContains(t, output, `"message": "disk full\n",`)
+}
+
+// TestMsgCodeString to see if a symbolic code is emitted with the numeric one
+func TestMsgCodeString(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	msg := NewMessage("Unable to marshal\n", WithCode(1002), WithCodeString("api.marshal.failed"), WithLevel(LevelFatal))
+	j, _ := json.Marshal(msg)
+	checkResultContains(t, string(j), `"code":1002,"codeString":"api.marshal.failed","level":"FATAL"`)
+	j, _ = json.Marshal(NewMsg("No symbolic code\n", 1002, "FATAL"))
+	checkResultOmits(t, string(j), `"codeString"`)
+	output := FatalJSONMsg("0.1", msg)
+	checkResultContains(t, output, `    "code": 1002,`+"\n"+`    "codeString": "api.marshal.failed",`)
+	if err := ValidateAgainstSchema([]byte(output)); err != nil {
+		t.Errorf("Output with a code string should validate, error: %s\n", err)
+	}
+	var decoded Msg
+	if err := json.Unmarshal(j, &decoded); err != nil || decoded.CodeString != "" {
+		t.Errorf("Unable to unmarshal Msg without a code string, found: %v, error: %v\n", decoded, err)
+	}
+	j, _ = json.Marshal(msg)
+	if err := json.Unmarshal(j, &decoded); err != nil || decoded.CodeString != "api.marshal.failed" {
+		t.Errorf("Unable to unmarshal Msg code string, found: %v, error: %v\n", decoded, err)
+	}
+}
+
+// TestWrapMsg to see if a chain of causes is built and rendered
+func TestWrapMsg(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	root := NewMsg("Disk full\n", 3001, "FATAL")
+	mid := WrapMsg(NewMsg("Unable to write file\n", 3002, "FATAL"), root)
+	outer := WrapMsg(NewMsg("Unable to save workspace\n", 3003, "FATAL"), mid)
+	if len(outer.Causes) != 1 || len(outer.Causes[0].Causes) != 1 {
+		t.Fatalf("WrapMsg did not build the expected cause chain, found: %v\n", outer)
+	}
+	output := FatalJSONMsg("0.1", outer)
+	checkResultContains(t, output, `    "causes": [`)
+	checkResultContains(t, output, `            "message": "Disk full\u000a",`)
+	var result interface{}
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		t.Fatalf("Unable to unmarshal JSON generated by FatalJSONMsg(), error: %s\n", err)
+	}
+	SetStoredFatalError(outer)
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	checkResultContains(t, output, `    "causes": [`)
+	checkResultContains(t, output, `            "message": "Disk full\n",`)
+	checkResultContains(t, output, `            "code": 3001,`)
+}
+
+// TestSetValidateFields to see if fields missing from all items are warned about
+func TestSetValidateFields(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	items := []interface{}{
+		map[string]interface{}{"name": "one", "value": 1},
+		map[string]interface{}{"name": "two", "other": 2},
+	}
+	fields := []string{"name", "value", "other", "stale", "gone"}
+	output, _ := GetJSONOutput("0.1", "dvlnTest", "test", "", fields, items)
+	checkResultOmits(t, output, `"warning"`)
+	SetValidateFields(true)
+	defer SetValidateFields(false)
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", fields, items)
+	checkResultContains(t, output, `    "message": "Fields not found in any item: stale, gone\n",`)
+	checkResultContains(t, output, `    "code": 1007,`)
+}
+
+// TestPrimitiveItemsWithFields to see if fields given with items that are
+// not objects are warned about while the items still pass through as is
+func TestPrimitiveItemsWithFields(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	type thing struct {
+		Name string `json:"name"`
+	}
+	items := []interface{}{1, map[string]interface{}{"name": "one"}, "two", &thing{"three"}, json.RawMessage(` {"name":"four"}`)}
+	output, _ := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, items)
+	checkResultOmits(t, output, `"warning"`)
+	output, fatal := GetJSONOutput("0.1", "dvlnTest", "test", "", []string{"name"}, items)
+	if fatal {
+		t.Fatalf("Primitive items with fields should not be fatal, output:\n%s", output)
+	}
+	checkResultContains(t, output, `    "message": "Fields do not apply to items that are not objects (item indexes: 1, 3)\n",`)
+	checkResultContains(t, output, `    "code": 1009,`)
+	checkResultContains(t, output, `      1,`)
+	checkResultContains(t, output, `      "two",`)
+}
+
+// TestAddAPIItemsGroup to see if multiple item groups are held in the data
+// section with per kind counts and the combined fields in the response
+func TestAddAPIItemsGroup(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	resp := NewResponse("0.1", "dvlnTest").AddAPIItemsGroup("env", "", nil, []interface{}{"a", "b"})
+	if resp.Counts != nil {
+		t.Fatalf("A single items group should have no counts, found: %v\n", resp.Counts)
+	}
+	if _, ok := resp.Data.(*itemsData); !ok {
+		t.Fatalf("A single items group should be set as with SetAPIItems, found: %T\n", resp.Data)
+	}
+	resp.AddAPIItemsGroup("cfg", "", []string{"name", "value"}, []interface{}{"c"})
+	resp.AddAPIItemsGroup("env", "", []string{"value", "scope"}, []interface{}{"d"})
+	j, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatalf("Marshal of grouped response failed, error: %s\n", err)
+	}
+	output := string(j)
+	checkResultContains(t, output, `"counts":{"cfg":1,"env":3}`)
+	checkResultContains(t, output, `"data":{"groups":[{"kind":"env",`)
+	checkResultContains(t, output, `{"kind":"cfg","fields":["name","value"],"totalItems":1,"startIndex":1,"currentItemCount":1,"items":["c"]}`)
+	checkResultContains(t, output, `],"fields":["name","value","scope"]}`)
+}
+
+// TestSetFlattenSingleItem to see if a lone item replaces the items array
+func TestSetFlattenSingleItem(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	item := []interface{}{map[string]interface{}{"name": "one"}}
+	output, _ := GetJSONOutput("0.1", "", "test", "", nil, item)
+	checkResultContains(t, output, `"items":[{"name":"one"}]`)
+	SetFlattenSingleItem(true)
+	defer SetFlattenSingleItem(false)
+	output, _ = GetJSONOutput("0.1", "", "test", "", nil, item)
+	checkResultContains(t, output, `"currentItemCount":1,"items":{"name":"one"}}`)
+	output, _ = GetJSONOutput("0.1", "", "test", "", nil, []interface{}{"one", "two"})
+	checkResultContains(t, output, `"items":["one","two"]`)
+}
+
+// TestSetDropNilItems to see if nil items are dropped and counted correctly
+func TestSetDropNilItems(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	var nilMap map[string]interface{}
+	items := []interface{}{nil, "one", nilMap, (*int)(nil), 0, ""}
+	output, _ := GetJSONOutput("0.1", "", "test", "", nil, items)
+	checkResultContains(t, output, `"items":[null,"one",null,null,0,""]`)
+	SetDropNilItems(true)
+	defer SetDropNilItems(false)
+	output, _ = GetJSONOutput("0.1", "", "test", "", nil, items)
+	checkResultContains(t, output, `"totalItems":3,"startIndex":1,"currentItemCount":3,"items":["one",0,""]`)
+	checkResultContains(t, output, `"message":"Nil items were dropped (3 dropped)\n","code":1010`)
+}
+
+// TestSetIncludeRuntimeMeta to see if the Go runtime details are in metadata
+func TestSetIncludeRuntimeMeta(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	output, _ := GetJSONOutput("0.1", "dvlnTest", "", "", nil, nil)
+	checkResultOmits(t, output, `"metadata"`)
+	SetIncludeRuntimeMeta(true)
+	defer SetIncludeRuntimeMeta(false)
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "", "", nil, nil)
+	checkResultContains(t, output, fmt.Sprintf(`    "goVersion": "%s",`, runtime.Version()))
+	checkResultContains(t, output, fmt.Sprintf(`    "os": "%s"`, runtime.GOOS))
+	checkResultContains(t, output, fmt.Sprintf(`    "arch": "%s",`, runtime.GOARCH))
+
+	resp := &Response{Metadata: map[string]interface{}{"build": "debug"}}
+	addRuntimeMeta(resp)
+	if meta := resp.Metadata.(map[string]interface{}); meta["build"] != "debug" || meta["os"] != runtime.GOOS {
+		t.Errorf("Runtime metadata should be added to existing metadata, found: %v\n", meta)
+	}
+	resp.Metadata = "custom"
+	addRuntimeMeta(resp)
+	if resp.Metadata != "custom" {
+		t.Errorf("Non-map metadata should be left alone, found: %v\n", resp.Metadata)
+	}
+}
+
+// TestRawItem to see if pre-serialized items are embedded and bad ones dropped
+func TestRawItem(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	items := []interface{}{RawItem(`{"name":"one","n":1}`), RawItem(`{"name":`), "two", RawItem(nil)}
+	output, fatal := GetJSONOutput("0.1", "", "test", "", []string{"name"}, items)
+	if fatal {
+		t.Fatalf("Raw items should not be fatal, output:\n%s", output)
+	}
+	checkResultContains(t, output, `"totalItems":3,"startIndex":1,"currentItemCount":3,"items":[{"name":"one","n":1},"two",null]`)
+	checkResultContains(t, output, `Raw JSON items that are not valid JSON were dropped (item indexes: 2)\n`)
+	checkResultContains(t, output, `Fields do not apply to items that are not objects (item indexes: 2, 3)\n`)
+	resetStoredMsgs()
+	output, _ = GetKeyedJSONOutput("0.1", "", "test", "name", []interface{}{RawItem(`{"name":"one"}`)})
+	checkResultContains(t, output, `"items":{"one":{"name":"one"}}`)
+}
+
+// TestStoredMsgCount to see if repeated notes and warnings are counted
+// rather than repeated
+func TestStoredMsgCount(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	for i := 0; i < 3; i++ {
+		SetStoredNonFatalWarning(NewMsg("Disk is slow\n", 2122, "ISSUE"))
+		SetStoredNote(NewMsg("Retrying\n", 0, "NOTE"))
+	}
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	output, _ := GetJSONOutput("0.1", "", "", "", nil, nil)
+	checkResultContains(t, output, `"note":{"message":"Retrying\n","level":"NOTE","count":3}`)
+	checkResultContains(t, output, `"warning":{"message":"Disk is slow\n","code":2122,"level":"ISSUE","count":3}`)
+	if err := ValidateAgainstSchema([]byte(output)); err != nil {
+		t.Errorf("Output with counts should validate, error: %s\n", err)
+	}
+
+	// a different code is a different message, the count is folded in
+	SetStoredNonFatalWarning(NewMsg("Disk is slow\n", 2123, "ISSUE"))
+	output, _ = GetJSONOutput("0.1", "", "", "", nil, nil)
+	checkResultContains(t, output, `"warning":{"message":"Disk is slow\nDisk is slow (repeated 3 times)\n","code":2123,"level":"ISSUE"}`)
+	output = FatalJSONMsg("0.1", NewMsg("Fatal\n", 2121, "FATAL"))
+	checkResultContains(t, output, `"level": "NOTE", "count": 3}`)
+}
+
+// TestStoredMsgCountInterleaved to see if msgs repeated with other msgs
+// stored in between are counted rather than repeated
+func TestStoredMsgCountInterleaved(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	for i := 0; i < 3; i++ {
+		SetStoredNonFatalWarning(NewMsg("A\n", 2122, "ISSUE"))
+		SetStoredNonFatalWarning(NewMsg("B\n", 2122, "ISSUE"))
+		SetStoredNote(NewMsg("Retrying\n", 0, "NOTE"))
+		SetStoredNote(NewMsg("Waiting\n", 0, "NOTE"))
+	}
+	output, _ := GetJSONOutput("0.1", "", "", "", nil, nil)
+	checkResultContains(t, output, `"warning":{"message":"B (repeated 3 times)\nA (repeated 3 times)\n","code":2122,"level":"ISSUE"}`)
+	checkResultContains(t, output, `"note":{"message":"Waiting (repeated 3 times)\nRetrying (repeated 3 times)\n","level":"NOTE"}`)
+
+	// the same message with a different code or level is a different msg
+	SetStoredNonFatalWarning(NewMsg("A\n", 2123, "ISSUE"))
+	SetStoredNonFatalWarning(NewMsg("A\n", 2122, "WARNING"))
+	output, _ = GetJSONOutput("0.1", "", "", "", nil, nil)
+	checkResultContains(t, output, `"warning":{"message":"A\nA\nB (repeated 3 times)\nA (repeated 3 times)\n"`)
+
+	// the cap counts the different msgs, repeats of kept msgs are counted
+	resetStoredMsgs()
+	SetMaxStoredWarnings(2)
+	defer SetMaxStoredWarnings(0)
+	for _, message := range []string{"A\n", "B\n", "C\n", "A\n"} {
+		SetStoredNonFatalWarning(NewMsg(message, 2122, "ISSUE"))
+	}
+	output, _ = GetJSONOutput("0.1", "", "", "", nil, nil)
+	checkResultContains(t, output, `B\nA (repeated 2 times)\n`)
+	checkResultContains(t, output, `...and 1 more warnings`)
+}
+
+// TestSetSortInfo to see if sort info is recorded and items optionally sorted
+func TestSetSortInfo(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	type named struct {
+		Name string `json:"name"`
+	}
+	items := []interface{}{
+		map[string]interface{}{"name": "b", "size": 10},
+		map[string]interface{}{"other": true},
+		named{"c"},
+		map[string]interface{}{"name": "a", "size": 9},
+	}
+	output, _ := GetJSONOutput("0.1", "", "test", "", nil, items)
+	checkResultOmits(t, output, `"sort"`)
+	SetSortInfo("name", false)
+	defer SetSortInfo("", true)
+	output, _ = GetJSONOutput("0.1", "", "test", "", nil, items)
+	checkResultContains(t, output, `"kind":"test","sort":{"field":"name","order":"desc"},"totalItems":4,`)
+	checkResultContains(t, output, `"items":[{"name":"b","size":10},{"other":true},{"name":"c"},{"name":"a","size":9}]`)
+	if err := ValidateAgainstSchema([]byte(output)); err != nil {
+		t.Errorf("Output with sort info should validate, error: %s\n", err)
+	}
+	SetAutoSort(true)
+	defer SetAutoSort(false)
+	output, _ = GetJSONOutput("0.1", "", "test", "", nil, items)
+	checkResultContains(t, output, `"items":[{"name":"c"},{"name":"b","size":10},{"name":"a","size":9},{"other":true}]`)
+	SetSortInfo("size", true)
+	output, _ = GetJSONOutput("0.1", "", "test", "", nil, items)
+	checkResultContains(t, output, `"items":[{"name":"a","size":9},{"name":"b","size":10},{"other":true},{"name":"c"}]`)
+	if items[0].(map[string]interface{})["name"] != "b" {
+		t.Errorf("Auto sorting should not modify the callers items\n")
+	}
+}
+
+// TestSetAPIItemsNoItems to see if the "items" key is left out when there are
+// no items (rather than being null or an empty array)
+func TestSetAPIItemsNoItems(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetDropNilItems(true)
+	defer SetDropNilItems(false)
+	responses := map[string]*Response{
+		"nil":     NewResponse("0.1", "").SetAPIItems("test", "", nil, nil),
+		"empty":   NewResponse("0.1", "").SetAPIItems("test", "", nil, []interface{}{}),
+		"all nil": NewResponse("0.1", "").SetAPIItems("test", "", nil, []interface{}{nil, nil}),
+		"keyed":   NewResponse("0.1", "").SetAPIItemsKeyed("test", "id", nil),
+		"sourced": NewResponse("0.1", "").SetAPIItemsSource("test", "", nil, &sliceItemSource{}),
+		"grouped": NewResponse("0.1", "").AddAPIItemsGroup("test", "", nil, nil),
+	}
+	for name, resp := range responses {
+		j, err := json.Marshal(resp)
+		if err != nil {
+			t.Fatalf("Marshal of %s items response failed, error: %s\n", name, err)
+		}
+		checkResultOmits(t, string(j), `"items"`)
+	}
+	checkResultContains(t, storedNonFatalWarning.Message, "Nil items were dropped")
+}
+
+// TestSetAPIItemsFieldsCopy to see if changing the callers fields slice after
+// the items are set doesn't change the response
+func TestSetAPIItemsFieldsCopy(t *testing.T) {
+	fields := []string{"name", "value"}
+	resp := NewResponse("0.1", "dvlnTest").SetAPIItems("test", "", fields, nil)
+	fields[0] = "changed"
+	fields = append(fields[:1], "appended")
+	j, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatalf("Marshal of response failed, error: %s\n", err)
+	}
+	checkResultContains(t, string(j), `"fields":["name","value"]`)
+	sourced := NewResponse("0.1", "").SetAPIItemsSource("test", "", fields, &sliceItemSource{})
+	fields[0] = "again"
+	if data := sourced.Data.(*itemsData); data.Fields[0] != "changed" {
+		t.Errorf("SetAPIItemsSource should copy the fields, found: %v\n", data.Fields)
+	}
+}
+
+// TestAbsorbStoredMessages to see if stored msgs are moved into a Response
+func TestAbsorbStoredMessages(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetStoredNote(NewMsg("Using cached index\n", 0, "INFO"))
+	SetStoredNonFatalWarning(NewMsg("This is a warning\n", 2122, "ISSUE"))
+	resp := NewResponse("0.1", "dvlnTest")
+	resp.Note = NewMsg("Nothing matched\n", 0, "INFO")
+	resp.AbsorbStoredMessages()
+	if note := resp.Note.(Msg); note.Message != "Nothing matched\nUsing cached index\n" {
+		t.Errorf("Absorbed note should follow the existing note, found: %q\n", note.Message)
+	}
+	if warn := resp.Warning.(Msg); warn.Code != 2122 || resp.Error != nil || resp.ID != 0 {
+		t.Errorf("Absorbed warning not as expected, found: %+v, error: %v, id: %d\n", warn, resp.Error, resp.ID)
+	}
+	if storedNote.Message == "" {
+		t.Errorf("Stored note should be kept when not clearing\n")
+	}
+	SetStoredFatalError(NewMsg("This is a fatal error\n", 2121, "FATAL"))
+	resp = NewResponse("0.1", "dvlnTest").AbsorbStoredMessages(true)
+	if errMsg, ok := resp.Error.(Msg); !ok || errMsg.Code != 2121 || resp.ID != -1 {
+		t.Errorf("Absorbed fatal error should set the error and id -1, found: %v, id: %d\n", resp.Error, resp.ID)
+	}
+	if storedFatalError.Message != "" || storedNonFatalWarning.Message != "" || storedNote.Message != "" {
+		t.Errorf("Stored msgs should be cleared once absorbed\n")
+	}
+}
+
+// TestSetMaxStoredWarnings to see if msgs beyond the cap are summarized
+func TestSetMaxStoredWarnings(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	if MaxStoredWarnings() != 0 || MaxStoredNotes() != 0 {
+		t.Errorf("Max stored warnings and notes should default to unlimited\n")
+	}
+	SetMaxStoredWarnings(2)
+	defer SetMaxStoredWarnings(0)
+	SetMaxStoredNotes(1)
+	defer SetMaxStoredNotes(0)
+	for i := 1; i <= 5; i++ {
+		SetStoredNonFatalWarning(NewMsg(fmt.Sprintf("warning %d\n", i), 2122, "ISSUE"))
+	}
+	SetStoredNote(NewMsg("note 1\n", 0, "INFO"))
+	SetStoredNote(NewMsg("note 1\n", 0, "INFO"))
+	SetStoredNote(NewMsg("note 2\n", 0, "INFO"))
+	output, _ := GetJSONOutput("0.1", "", "", "", nil, nil)
+	checkResultContains(t, output, `"warning":{"message":"warning 2\nwarning 1\n...and 3 more warnings\n"`)
+	checkResultContains(t, output, `"note":{"message":"note 1 (repeated 2 times)\n...and 1 more notes\n"`)
+
+	// once the stored msgs are cleared the counts start again
+	resp := NewResponse("0.1", "").AbsorbStoredMessages(true)
+	if warn := resp.Warning.(Msg); !strings.HasSuffix(warn.Message, "...and 3 more warnings\n") {
+		t.Errorf("Absorbed warning should have the dropped summary, found: %q\n", warn.Message)
+	}
+	SetStoredNonFatalWarning(NewMsg("warning 6\n", 2122, "ISSUE"))
+	output, _ = GetJSONOutput("0.1", "", "", "", nil, nil)
+	checkResultContains(t, output, `"warning":{"message":"warning 6\n","code":2122`)
+}
+
+// TestSetDedupAcrossSeverities to see if a note repeating the warning is
+// dropped
+func TestSetDedupAcrossSeverities(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	SetStoredNote(NewMsg("Disk nearly full\n", 0, "INFO"))
+	SetStoredNonFatalWarning(NewMsg("Disk nearly full\n", 2122, "ISSUE"))
+	output, _ := GetJSONOutput("0.1", "", "", "", nil, nil)
+	checkResultContains(t, output, `"note":{"message":"Disk nearly full\n"`)
+	SetDedupAcrossSeverities(true)
+	defer SetDedupAcrossSeverities(false)
+	output, _ = GetJSONOutput("0.1", "", "", "", nil, nil)
+	checkResultOmits(t, output, `"note"`)
+	checkResultContains(t, output, `"warning":{"message":"Disk nearly full\n","code":2122,"level":"ISSUE"}`)
+	SetStoredNonFatalWarning(NewMsg("Mirror slow\n", 2122, "ISSUE"))
+	output, _ = GetJSONOutput("0.1", "", "", "", nil, nil)
+	checkResultOmits(t, output, `"note"`)
+	SetStoredNote(NewMsg("Using cached index\n", 0, "INFO"))
+	output, _ = GetJSONOutput("0.1", "", "", "", nil, nil)
+	checkResultContains(t, output, `"note":{"message":"Using cached index\nDisk nearly full\n"`)
+	resetStoredMsgs()
+	SetStoredNote(NewMsg("Disk nearly full\n", 0, "INFO"))
+	SetStoredNonFatalWarning(NewMsg("Disk nearly full on /var\n", 2122, "ISSUE"))
+	output, _ = GetJSONOutput("0.1", "", "", "", nil, nil)
+	checkResultContains(t, output, `"note":{"message":"Disk nearly full\n"`)
+	checkResultContains(t, output, `"warning":{"message":"Disk nearly full on /var\n"`)
+}
+
+// TestSecureFieldEqual to see if sensitive values are compared correctly
+func TestSecureFieldEqual(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		equal bool
+	}{
+		{"s3cr3t-token", "s3cr3t-token", true},
+		{"s3cr3t-token", "s3cr3t-tokex", false},
+		{"s3cr3t-token", "s3cr3t", false},
+		{"", "", true},
+		{"", "x", false},
+	}
+	for _, test := range tests {
+		if equal := SecureFieldEqual(test.a, test.b); equal != test.equal {
+			t.Errorf("SecureFieldEqual(%q, %q) should be %t\n", test.a, test.b, test.equal)
+		}
+	}
+}
+
+// TestRegisterKindFields to see if registered struct fields are used when
+// SetAPIItems is given no fields
+func TestRegisterKindFields(t *testing.T) {
+	type base struct {
+		ID string `json:"id"`
+	}
+	type pkg struct {
+		base
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+		Secret  string `json:"-"`
+		Size    int
+		hidden  bool
+	}
+	RegisterKindFields("pkg", &pkg{})
+	defer RegisterKindFields("pkg", nil)
+	resp := NewResponse("0.1", "").SetAPIItems("pkg", "", nil, []interface{}{pkg{Name: "one"}})
+	j, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatalf("Marshal of response failed, error: %s\n", err)
+	}
+	checkResultContains(t, string(j), `"fields":["id","name","version","Size"]`)
+	resp = NewResponse("0.1", "").SetAPIItems("pkg", "", []string{"name"}, nil)
+	if data := resp.Data.(*itemsData); !reflect.DeepEqual(data.Fields, []string{"name"}) {
+		t.Errorf("Given fields should be used over registered ones, found: %v\n", data.Fields)
+	}
+	resp = NewResponse("0.1", "").SetAPIItems("other", "", nil, nil)
+	if data := resp.Data.(*itemsData); data.Fields != nil {
+		t.Errorf("Unregistered kind should have no fields, found: %v\n", data.Fields)
+	}
+	RegisterKindFields("pkg", nil)
+	resp = NewResponse("0.1", "").SetAPIItems("pkg", "", nil, nil)
+	if data := resp.Data.(*itemsData); data.Fields != nil {
+		t.Errorf("Removed kind should have no fields, found: %v\n", data.Fields)
+	}
+}
+
+// TestSetAPIItemsDuplicateFields to see if duplicate fields are dropped with
+// a warning
+func TestSetAPIItemsDuplicateFields(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	resp := NewResponse("0.1", "").SetAPIItems("test", "", []string{"name", "size", "name", "size", "name"}, nil)
+	if data := resp.Data.(*itemsData); !reflect.DeepEqual(data.Fields, []string{"name", "size"}) {
+		t.Errorf("Duplicate fields should be dropped, found: %v\n", data.Fields)
+	}
+	if warn := storedNonFatalWarning; warn.Code != 1013 || warn.Message != "Duplicate fields dropped: name, size\n" {
+		t.Errorf("Duplicate fields warning not as expected, found: %+v\n", warn)
+	}
+	resetStoredMsgs()
+	NewResponse("0.1", "").SetAPIItems("test", "", []string{"name", "size"}, nil)
+	if storedNonFatalWarning.Message != "" {
+		t.Errorf("Unique fields should not store a warning, found: %+v\n", storedNonFatalWarning)
+	}
+}
+
+// TestSetMessageSeparator to see if combined messages are delimited
+func TestSetMessageSeparator(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	if sep := MessageSeparator(); sep != DefaultMessageSeparator {
+		t.Errorf("Message separator default was not %q, found: %q\n", DefaultMessageSeparator, sep)
+	}
+	SetStoredNonFatalWarning(NewMsg("disk slow", 2122, "ISSUE"))
+	SetStoredNonFatalWarning(NewMsg("net slow", 2122, "ISSUE"))
+	SetStoredNote(NewMsg("First note\n", 0, "INFO"))
+	SetStoredNote(NewMsg("Second note\n", 0, "INFO"))
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	output, _ := GetJSONOutput("0.1", "", "", "", nil, nil)
+	checkResultContains(t, output, `"message":"net slow; disk slow"`)
+	checkResultContains(t, output, `"message":"Second note\nFirst note\n"`)
+
+	resetStoredMsgs()
+	SetMessageSeparator(" | ")
+	defer SetMessageSeparator(DefaultMessageSeparator)
+	SetFatalOverwritePolicy(FatalAccumulate)
+	defer SetFatalOverwritePolicy(FatalLastWins)
+	SetStoredFatalError(NewMsg("build failed", 2121, "FATAL"))
+	SetStoredFatalError(NewMsg("tests failed", 2121, "FATAL"))
+	output, _ = GetJSONOutput("0.1", "", "", "", nil, nil)
+	checkResultContains(t, output, `"message":"build failed | tests failed"`)
+}
+
+// TestExitCode to see if the exit code matches the id in the JSON output
+func TestExitCode(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	steps := []struct {
+		change func()
+		code   int
+	}{
+		{func() {}, 0},
+		{func() { SetStoredNonFatalWarning(NewMsg("This is a warning\n", 2122, "ISSUE")) }, 0},
+		{func() { SetStoredID(2) }, 2},
+		{func() { SetStoredFatalError(NewMsg("This is a fatal error\n", 2121, "FATAL")) }, -1},
+	}
+	for i, step := range steps {
+		step.change()
+		if code := ExitCode(); code != step.code {
+			t.Errorf("Step %d: exit code should be %d, found %d\n", i, step.code, code)
+		}
+		output, _ := GetJSONOutput("0.1", "", "", "", nil, nil)
+		checkResultContains(t, output, fmt.Sprintf(`"id":%d,`, step.code))
+	}
+}
+
+// TestMergeFields to see if fields lists are unioned in order without dups
+func TestMergeFields(t *testing.T) {
+	tests := []struct {
+		a, b     []string
+		expected []string
+	}{
+		{nil, nil, nil},
+		{[]string{}, nil, nil},
+		{[]string{"name"}, nil, []string{"name"}},
+		{nil, []string{"name", "value"}, []string{"name", "value"}},
+		{[]string{"name", "value"}, []string{"value", "kind", "name"}, []string{"name", "value", "kind"}},
+		{[]string{"name", "name"}, []string{"kind", "kind"}, []string{"name", "kind"}},
+	}
+	for _, test := range tests {
+		merged := MergeFields(test.a, test.b)
+		if fmt.Sprint(merged) != fmt.Sprint(test.expected) || (merged == nil) != (test.expected == nil) {
+			t.Errorf("MergeFields(%v, %v) expected %v, found: %v\n", test.a, test.b, test.expected, merged)
+		}
+	}
+}
+
+// TestAddDiagnostic to see if diagnostics end up in the "diagnostics" array
+func TestAddDiagnostic(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	AddDiagnostic(LevelWarning, "Unused variable", "main.go:12")
+	AddDiagnostic(LevelFatal, "Missing file", "")
+	if diags := Diagnostics(); len(diags) != 2 {
+		t.Fatalf("Expected 2 stored diagnostics, found: %v\n", diags)
+	}
+	output, fatal := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	if fatal {
+		t.Fatalf("GetJSONOutput indicated fatal, shouldn't have.  Output:\n%s", output)
+	}
+	checkResultContains(t, output, "  \"diagnostics\": [\n    {\n      \"level\": \"WARNING\",\n      \"message\": \"Unused variable\",\n      \"location\": \"main.go:12\"\n    },")
+	checkResultContains(t, output, "      \"level\": \"FATAL\",\n      \"message\": \"Missing file\"\n    }")
+	ClearDiagnostics()
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	checkResultOmits(t, output, `"diagnostics"`)
+}
+
+// TestAddLink to see if links end up in the root "links" object
+func TestAddLink(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	AddLink("self", "https://example.com/api/items")
+	AddLink("docs", "https://example.com/docs")
+	output, _ := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	checkResultContains(t, output, "  \"links\": {\n    \"docs\": \"https://example.com/docs\",\n    \"self\": \"https://example.com/api/items\"\n  }")
+	ClearLinks()
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	checkResultOmits(t, output, `"links"`)
+}
+
+// TestSetStoredID to see if the stored id is used when there is no fatal
+func TestSetStoredID(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetStoredID(2)
+	output, fatal := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	if fatal {
+		t.Fatalf("GetJSONOutput indicated fatal, shouldn't have.  Output:\n%s", output)
+	}
+	checkResultContains(t, output, `  "id": 2,`)
+	SetStoredFatalError(NewMsg("This is a fatal error\n", 2121, "FATAL"))
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	checkResultContains(t, output, `  "id": -1,`)
+	if resp := NewResponse("0.1", "dvlnTest").SetID(3); resp.ID != 3 {
+		t.Errorf("Response SetID did not set the id, found: %d\n", resp.ID)
+	}
+}
+
+// TestLevelSeverity to see if levels are ordered by severity
+func TestLevelSeverity(t *testing.T) {
+	ordered := []string{"UNKNOWN", "NOTE", "ISSUE", "WARNING", "FATAL"}
+	for i := 1; i < len(ordered); i++ {
+		if !MoreSevere(ordered[i], ordered[i-1]) || MoreSevere(ordered[i-1], ordered[i]) {
+			t.Errorf("Expected %s to be more severe than %s\n", ordered[i], ordered[i-1])
+		}
+	}
+	if LevelSeverity("fatal") != LevelSeverity("FATAL") {
+		t.Errorf("Level severity should not depend on case")
+	}
+	if LevelSeverity("BOGUS") != UnknownLevelSeverity || MoreSevere("BOGUS", "UNKNOWN") {
+		t.Errorf("Unknown levels should get the unknown level severity")
+	}
+}
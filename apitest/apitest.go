@@ -0,0 +1,108 @@
+// Copyright © 2016 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package apitest contains helpers for tests that check the JSON responses
+// built by the dvln/api package (or received from tools using it).
+package apitest
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// AssertResponsesEqual fails the test if the expected and actual JSON
+// responses differ once both are parsed, the ignored keys are dropped and
+// both are put in canonical form (so key order and formatting don't matter).
+// An ignore key without a dot (eg: "timestamp") is dropped at any depth
+// while a dotted key (eg: "metadata.host") is dropped only at that path from
+// the root (array elements are at the path of the array, eg: an "id" in each
+// item is "data.items.id"), handy for volatile fields like timestamps.
+func AssertResponsesEqual(t testing.TB, expected, actual []byte, ignore ...string) {
+	t.Helper()
+	exp, err := canonicalJSON(expected, ignore)
+	if err != nil {
+		t.Errorf("Unable to parse expected JSON response, error: %s\n%s", err, expected)
+		return
+	}
+	act, err := canonicalJSON(actual, ignore)
+	if err != nil {
+		t.Errorf("Unable to parse actual JSON response, error: %s\n%s", err, actual)
+		return
+	}
+	if exp != act {
+		t.Errorf("JSON responses differ (ignoring: %s)\nExpected:\n%s\nActual:\n%s", strings.Join(ignore, ", "), exp, act)
+	}
+}
+
+// canonicalJSON parses the given JSON, drops the ignored keys and returns it
+// indented with sorted keys (numbers are kept exactly as given)
+func canonicalJSON(b []byte, ignore []string) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+	anywhere := make(map[string]bool)
+	var paths []string
+	for _, key := range ignore {
+		if strings.Contains(key, ".") {
+			paths = append(paths, key)
+		} else {
+			anywhere[key] = true
+		}
+	}
+	v = dropKeys(v, "", anywhere, paths)
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// dropKeys returns the given parsed JSON value with the ignored keys removed
+// from any objects, path is the dotted path of the value from the root
+func dropKeys(v interface{}, path string, anywhere map[string]bool, paths []string) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		kept := make(map[string]interface{}, len(val))
+		for key, child := range val {
+			childPath := key
+			if path != "" {
+				childPath = path + "." + key
+			}
+			if anywhere[key] || hasPath(paths, childPath) {
+				continue
+			}
+			kept[key] = dropKeys(child, childPath, anywhere, paths)
+		}
+		return kept
+	case []interface{}:
+		for i, child := range val {
+			val[i] = dropKeys(child, path, anywhere, paths)
+		}
+	}
+	return v
+}
+
+// hasPath returns true if the given path is in the list of paths
+func hasPath(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
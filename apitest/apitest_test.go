@@ -0,0 +1,72 @@
+// Copyright © 2016 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apitest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// recordingT records any test failures instead of failing the real test
+type recordingT struct {
+	testing.TB
+	failures []string
+}
+
+func (r *recordingT) Helper() {}
+
+func (r *recordingT) Errorf(format string, args ...interface{}) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+// TestAssertResponsesEqual to see if responses compare equal ignoring key
+// order, formatting and the ignored keys (but not other differences)
+func TestAssertResponsesEqual(t *testing.T) {
+	expected := []byte(`{"apiVersion": "0.1", "id": 0, "metadata": {"timestamp": "2016-01-01", "host": "a"}, "data": {"items": [{"n": 10000000000000001, "requestId": 1}]}}`)
+	actual := []byte(`{
+  "id": 0,
+  "data": {"items": [{"requestId": 2, "n": 10000000000000001}]},
+  "metadata": {"host": "b", "timestamp": "2016-02-02"},
+  "apiVersion": "0.1"
+}`)
+	tests := []struct {
+		ignore []string
+		equal  bool
+	}{
+		{[]string{"timestamp", "requestId", "metadata.host"}, true},
+		{[]string{"timestamp", "requestId", "host"}, true},
+		{[]string{"timestamp", "requestId"}, false},
+		{[]string{"timestamp", "data.items.requestId", "metadata.host"}, true},
+		{[]string{"timestamp", "items.requestId", "metadata.host"}, false},
+		{[]string{"timestamp", "metadata.host", "data"}, true},
+	}
+	for i, test := range tests {
+		rt := &recordingT{TB: t}
+		AssertResponsesEqual(rt, expected, actual, test.ignore...)
+		if equal := len(rt.failures) == 0; equal != test.equal {
+			t.Errorf("Test %d: responses equal should be %t, failures: %v\n", i, test.equal, rt.failures)
+		}
+	}
+	rt := &recordingT{TB: t}
+	AssertResponsesEqual(rt, expected, []byte(`{"id": `))
+	if len(rt.failures) != 1 || !strings.Contains(rt.failures[0], "Unable to parse actual JSON") {
+		t.Errorf("Invalid actual JSON should fail to parse, failures: %v\n", rt.failures)
+	}
+	rt = &recordingT{TB: t}
+	AssertResponsesEqual(rt, []byte(`{"id": 0, "big": 10000000000000001}`), []byte(`{"id": 0, "big": 10000000000000002}`))
+	if len(rt.failures) != 1 {
+		t.Errorf("Large numbers that differ should not compare equal, failures: %v\n", rt.failures)
+	}
+}
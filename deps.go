@@ -0,0 +1,36 @@
+// Copyright © 2016 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !dvln_nodeps
+// +build !dvln_nodeps
+
+// The dvln/api/deps.go module wraps the few routines used from the dvln
+// str and cast packages, build with the 'dvln_nodeps' tag to use the std
+// lib fallbacks in deps_nodeps.go instead (for minimal dependency vendoring)
+
+package api
+
+import (
+	"github.com/dvln/cast"
+	"github.com/dvln/str"
+)
+
+// bytesToString converts the given bytes to a string
+func bytesToString(b []byte) string {
+	return cast.ToString(b)
+}
+
+// spaces returns a string of n spaces (eg: for JSON indentation)
+func spaces(n int) string {
+	return str.Pad("", " ", n)
+}
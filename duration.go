@@ -0,0 +1,272 @@
+// Copyright © 2016 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The dvln/api/duration.go module controls how time.Duration values found
+// within items are rendered, by default json.Marshal renders them as an
+// integer count of nanoseconds which clients often misread.
+
+package api
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats available for SetDurationFormat() which controls how any Go
+// time.Duration values within items are rendered
+const (
+	DurationNanoseconds = "nanoseconds" // 3723000000000 (the default)
+	DurationSeconds     = "seconds"     // 3723
+	DurationString      = "string"      // "1h2m3s"
+	DurationISO8601     = "iso8601"     // "PT1H2M3S"
+)
+
+// maxDurationWalkDepth limits how deep items are walked looking for durations,
+// anything deeper is left as is (json.Marshal will report cycles and such)
+const maxDurationWalkDepth = 1000
+
+var (
+	// durationFormat is how durations in items are rendered, one of the
+	// Duration* formats above (accessed under mutex from api.go)
+	durationFormat = DurationNanoseconds
+
+	durationType      = reflect.TypeOf(time.Duration(0))
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// DurationFormat returns the current format used for durations in items
+func DurationFormat() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	format := durationFormat
+	return format
+}
+
+// SetDurationFormat can be used to change how Go time.Duration values found
+// within items given to SetAPIItems (and the like) are rendered, use one of
+// DurationNanoseconds (default), DurationSeconds, DurationString (eg: "1h2m")
+// or DurationISO8601 (eg: "PT1H2M").  If any format other than nanoseconds
+// is used then items containing durations are converted to generic maps and
+// slices (honoring json tags) before being marshaled.
+func SetDurationFormat(format string) {
+	mu.Lock()
+	defer mu.Unlock()
+	durationFormat = format
+}
+
+// formatDuration renders the given duration in the given format
+func formatDuration(d time.Duration, format string) interface{} {
+	switch format {
+	case DurationSeconds:
+		return d.Seconds()
+	case DurationString:
+		return d.String()
+	case DurationISO8601:
+		return iso8601Duration(d)
+	}
+	return int64(d)
+}
+
+// iso8601Duration renders the given duration as an ISO-8601 duration using
+// hours, minutes and seconds (eg: "PT1H2M3.5S"), zero is "PT0S"
+func iso8601Duration(d time.Duration) string {
+	if d == 0 {
+		return "PT0S"
+	}
+	var out strings.Builder
+	if d < 0 {
+		out.WriteString("-")
+		d = -d
+	}
+	out.WriteString("PT")
+	if hours := d / time.Hour; hours > 0 {
+		fmt.Fprintf(&out, "%dH", hours)
+		d -= hours * time.Hour
+	}
+	if minutes := d / time.Minute; minutes > 0 {
+		fmt.Fprintf(&out, "%dM", minutes)
+		d -= minutes * time.Minute
+	}
+	if d > 0 {
+		out.WriteString(strconv.FormatFloat(d.Seconds(), 'f', -1, 64))
+		out.WriteString("S")
+	}
+	return out.String()
+}
+
+// convertItemDurations returns the items with any durations they contain
+// rendered in the current duration format (see SetDurationFormat), the
+// given items slice is not modified
+func convertItemDurations(items []interface{}) []interface{} {
+	format := DurationFormat()
+	if format == DurationNanoseconds || items == nil {
+		return items
+	}
+	newItems := make([]interface{}, len(items))
+	for i, item := range items {
+		newItems[i] = convertDurations(reflect.ValueOf(item), format, 0)
+	}
+	return newItems
+}
+
+// canHoldDuration returns true if values of the given type could contain a
+// time.Duration (interfaces could hold anything so they are always true)
+func canHoldDuration(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if t == durationType || t.Kind() == reflect.Interface {
+		return true
+	}
+	if seen[t] {
+		return false
+	}
+	seen[t] = true
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return canHoldDuration(t.Elem(), seen)
+	case reflect.Map:
+		return canHoldDuration(t.Elem(), seen)
+	case reflect.Struct:
+		if t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType) {
+			return false
+		}
+		for i := 0; i < t.NumField(); i++ {
+			if canHoldDuration(t.Field(i).Type, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// convertDurations walks the given value and returns a version of it with
+// any durations rendered in the given format, structs, maps and slices that
+// might contain durations are converted to generic maps and slices
+func convertDurations(v reflect.Value, format string, depth int) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	t := v.Type()
+	if t == durationType {
+		return formatDuration(time.Duration(v.Int()), format)
+	}
+	if depth > maxDurationWalkDepth || !canHoldDuration(t, map[reflect.Type]bool{}) {
+		return v.Interface()
+	}
+	if t.Implements(jsonMarshalerType) {
+		return v.Interface()
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return convertDurations(v.Elem(), format, depth+1)
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		m := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			m[mapKeyString(iter.Key())] = convertDurations(iter.Value(), format, depth+1)
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		s := make([]interface{}, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			s[i] = convertDurations(v.Index(i), format, depth+1)
+		}
+		return s
+	case reflect.Struct:
+		m := make(map[string]interface{})
+		addStructFields(m, v, format, depth)
+		return m
+	}
+	return v.Interface()
+}
+
+// mapKeyString renders a map key the way encoding/json would
+func mapKeyString(k reflect.Value) string {
+	if k.Kind() == reflect.String {
+		return k.String()
+	}
+	if k.Type().Implements(textMarshalerType) {
+		if text, err := k.Interface().(encoding.TextMarshaler).MarshalText(); err == nil {
+			return string(text)
+		}
+	}
+	return fmt.Sprint(k.Interface())
+}
+
+// addStructFields adds the exported fields of the given struct to the map
+// honoring the json tags (names, "-" and omitempty), embedded structs with
+// no json name have their fields added directly (as encoding/json does)
+func addStructFields(m map[string]interface{}, v reflect.Value, format string, depth int) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		fv := v.Field(i)
+		if field.Anonymous && name == "" {
+			ft := field.Type
+			if ft.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue
+				}
+				ft = ft.Elem()
+				fv = fv.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				addStructFields(m, fv, format, depth+1)
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			// unexported field
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if strings.Contains(","+opts+",", ",omitempty,") && isEmptyValue(fv) {
+			continue
+		}
+		m[name] = convertDurations(fv, format, depth+1)
+	}
+}
+
+// isEmptyValue returns true if the value is "empty" as far as the json
+// omitempty option goes (matches the encoding/json rules)
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Interface, reflect.Ptr:
+		return v.IsZero()
+	}
+	return false
+}
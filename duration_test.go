@@ -0,0 +1,73 @@
+// Copyright © 2016 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+// TestSetDurationFormat to see if durations in items are rendered as desired
+func TestSetDurationFormat(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	if format := DurationFormat(); format != DurationNanoseconds {
+		t.Errorf("Duration format default was not %s, found: %s\n", DurationNanoseconds, format)
+	}
+	type Base struct {
+		Name string `json:"name"`
+	}
+	type job struct {
+		Base
+		Elapsed time.Duration   `json:"elapsed"`
+		Timeout *time.Duration  `json:"timeout,omitempty"`
+		Steps   []time.Duration `json:"steps"`
+		Skip    time.Duration   `json:"-"`
+		secret  time.Duration
+	}
+	elapsed := time.Hour + 2*time.Minute + 3500*time.Millisecond
+	items := []interface{}{
+		job{Base: Base{Name: "build"}, Elapsed: elapsed, Steps: []time.Duration{time.Second}, Skip: time.Second, secret: time.Second},
+		map[string]interface{}{"name": "map", "elapsed": 2 * time.Minute},
+	}
+	tests := []struct {
+		format   string
+		elapsed  string
+		step     string
+		mapValue string
+	}{
+		{DurationNanoseconds, `"elapsed": 3723500000000,`, `        1000000000`, `"elapsed": 120000000000,`},
+		{DurationSeconds, `"elapsed": 3723.5,`, `        1`, `"elapsed": 120,`},
+		{DurationString, `"elapsed": "1h2m3.5s",`, `        "1s"`, `"elapsed": "2m0s",`},
+		{DurationISO8601, `"elapsed": "PT1H2M3.5S",`, `        "PT1S"`, `"elapsed": "PT2M",`},
+	}
+	defer SetDurationFormat(DurationNanoseconds)
+	for _, test := range tests {
+		SetDurationFormat(test.format)
+		output, _ := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, items)
+		checkResultContains(t, output, test.elapsed)
+		checkResultContains(t, output, test.step)
+		checkResultContains(t, output, test.mapValue)
+		checkResultContains(t, output, `"name": "build",`)
+		checkResultOmits(t, output, `"timeout"`)
+		checkResultOmits(t, output, `"Skip"`)
+		checkResultOmits(t, output, `"secret"`)
+	}
+	if d := iso8601Duration(-90 * time.Second); d != "-PT1M30S" {
+		t.Errorf("ISO-8601 duration for -90s not as expected, found: %s\n", d)
+	}
+	if d := iso8601Duration(0); d != "PT0S" {
+		t.Errorf("ISO-8601 duration for 0 not as expected, found: %s\n", d)
+	}
+}
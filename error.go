@@ -0,0 +1,80 @@
+// Copyright © 2016 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The dvln/api/error.go module bridges JSON API responses and Go error
+// handling, a fatal response can be turned into a Go error via the
+// ErrorFromResponse() routine.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// APIError is a Go error wrapping the fatal error Msg from a JSON API
+// response, the Code() and Level() of the fatal error are available
+type APIError struct {
+	msg Msg
+}
+
+// NewAPIError creates an APIError from the given (fatal error) Msg
+func NewAPIError(msg Msg) *APIError {
+	return &APIError{msg: msg}
+}
+
+// Error returns the fatal error message (satisfies the error interface)
+func (e *APIError) Error() string {
+	return e.msg.Message
+}
+
+// Code returns the code of the fatal error
+func (e *APIError) Code() int {
+	return e.msg.Code
+}
+
+// Level returns the level of the fatal error (eg: "FATAL")
+func (e *APIError) Level() string {
+	return e.msg.Level
+}
+
+// Msg returns the full Msg for the fatal error
+func (e *APIError) Msg() Msg {
+	return e.msg
+}
+
+// ErrorFromResponse takes a JSON API response (eg: from GetJSONOutput) and
+// returns a non-nil *APIError if the response indicates a fatal error, nil
+// will be returned if it was successful.  If the JSON can't be parsed then
+// the JSON decoding error is returned instead.  Any UTF-8 BOM at the start
+// of the response is skipped (see SetEmitBOM).
+func ErrorFromResponse(b []byte) error {
+	var resp struct {
+		ID    int  `json:"id"`
+		Error *Msg `json:"error"`
+	}
+	if err := json.Unmarshal(bytes.TrimPrefix(b, []byte(utf8BOM)), &resp); err != nil {
+		return err
+	}
+	if resp.Error == nil && resp.ID != -1 {
+		return nil
+	}
+	var msg Msg
+	if resp.Error != nil {
+		msg = *resp.Error
+	}
+	if msg.Message == "" {
+		msg.Message = "Unknown Fatal Error (no error message in response)"
+	}
+	return NewAPIError(msg)
+}
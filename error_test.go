@@ -0,0 +1,56 @@
+// Copyright © 2016 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"testing"
+)
+
+// TestErrorFromResponse to see if fatal responses become Go errors
+func TestErrorFromResponse(t *testing.T) {
+	err := ErrorFromResponse(jsonSample)
+	if err == nil {
+		t.Fatalf("ErrorFromResponse on a fatal response returned a nil error")
+	}
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		t.Fatalf("ErrorFromResponse did not return an *APIError, found: %T\n", err)
+	}
+	if apiErr.Code() != 2001 || apiErr.Level() != "ISSUE" {
+		t.Errorf("APIError code/level not as expected, found: %d/%s\n", apiErr.Code(), apiErr.Level())
+	}
+	checkResultContains(t, apiErr.Error(), "Please use a valid subcommand")
+
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	output, _ := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, []interface{}{"one"})
+	if err = ErrorFromResponse([]byte(output)); err != nil {
+		t.Errorf("ErrorFromResponse on a successful response returned an error: %s\n", err)
+	}
+	if err = ErrorFromResponse([]byte("{ bad json")); err == nil {
+		t.Errorf("ErrorFromResponse on bad JSON did not return an error")
+	}
+
+	SetEmitBOM(true)
+	defer SetEmitBOM(false)
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, []interface{}{"one"})
+	if err = ErrorFromResponse([]byte(output)); err != nil {
+		t.Errorf("ErrorFromResponse on a successful response with a BOM returned an error: %s\n", err)
+	}
+	SetStoredFatalError(Msg{Message: "Something broke", Code: 2002})
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, []interface{}{"one"})
+	if _, ok = ErrorFromResponse([]byte(output)).(*APIError); !ok {
+		t.Errorf("ErrorFromResponse on a fatal response with a BOM did not return an *APIError:\n%s", output)
+	}
+}
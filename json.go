@@ -20,28 +20,130 @@ package api
 
 // for imports the goal is to use very little outside the std lib,
 // note that str and cast have no dependencies outside the std lib
-// (exception: cast testing file which uses 'testify')
+// (exception: cast testing file which uses 'testify'), those are only
+// used via deps.go (build with the 'dvln_nodeps' tag to avoid them)
 import (
 	"bytes"
+	stdcontext "context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
 
-	"github.com/dvln/cast"
-	"github.com/dvln/str"
+// Default JSON output formatting settings, see SetJSONIndentLevel(),
+// SetJSONPrefix() and SetJSONRaw() to change the current settings
+const (
+	DefaultJSONIndentLevel = 2
+	DefaultJSONPrefix      = ""
+	DefaultJSONRaw         = false
+	// DefaultMaxJSONPrefixLen is the default sanity cap on the length of
+	// the PrettyJSON() prefix, see SetMaxJSONPrefixLen()
+	DefaultMaxJSONPrefixLen = 1024
 )
 
 var (
 	// Some default JSON output formatting settings that can be overridden
 	// via Set* API calls below (accessed under mutex from api.go)
-	jsonIndentLevel = 2
-	jsonPrefix      = ""
-	jsonRaw         = false
+	jsonIndentLevel = DefaultJSONIndentLevel
+	jsonPrefix      = DefaultJSONPrefix
+	jsonRaw         = DefaultJSONRaw
+	// maxJSONPrefixLen is a sanity cap on the PrettyJSON prefix length
+	maxJSONPrefixLen = DefaultMaxJSONPrefixLen
+	// maxPrettyInputBytes caps the size of the JSON PrettyJSON will indent,
+	// 0 means unlimited (the default)
+	maxPrettyInputBytes = 0
+	// includeDataChecksum indicates if the JSON output has a checksum of
+	// the data section (see SetIncludeDataChecksum)
+	includeDataChecksum = false
+	// maxPrettyDepth is the nesting depth beyond which PrettyJSON leaves any
+	// JSON compact on one line, 0 means unlimited (see SetMaxPrettyDepth)
+	maxPrettyDepth = 0
+	// htmlSafe indicates if <, > and & are escaped in JSON strings (both in
+	// marshaled JSON and in hand built JSON, eg: from FatalJSONMsg)
+	htmlSafe = true
+	// doubleEscapeGuard indicates if EscapeJSONString leaves existing \uXXXX
+	// escape sequences alone so that re-escaping a string is a no-op
+	doubleEscapeGuard = false
+	// unknownFatalMsg is the last ditch fatal error used by FatalJSONMsg
+	// when no error was given or stored (see SetUnknownFatalMsg)
+	unknownFatalMsg = NewMsg("Unknown Fatal Error (Coding Error?)", 0, "UNKNOWN")
+	// partialDataOnFatal indicates if items are still included in the JSON
+	// output when there is a fatal error (see SetIncludePartialDataOnFatal)
+	partialDataOnFatal = false
+	// jsonAlignColons indicates if PrettyJSON pads values so they line up
+	// within each JSON object (see SetJSONAlignColons)
+	jsonAlignColons = false
+	// outputObserver, if set, is given every JSON output produced by
+	// GetJSONOutput and the like (see SetOutputObserver)
+	outputObserver func(context string, output string, fatal bool)
+	// errorsOnly indicates if JSON output is trimmed down to just the API
+	// version, id and any error (see SetErrorsOnly)
+	errorsOnly = false
+	// apiVersionPattern, if set, is used to validate API versions and
+	// apiVersionFatal indicates if a bad version is fatal or just a warning
+	apiVersionPattern *regexp.Regexp
+	apiVersionFatal   = false
+	// getenv is used for all env lookups so tests can stub it out
+	getenv = os.Getenv
+	// emitBOM indicates if JSON output starts with a UTF-8 BOM
+	emitBOM = false
+	// allowMissingAPIVersion indicates if an empty API version is allowed
+	// (the field is omitted) rather than being a fatal error
+	allowMissingAPIVersion = false
+	// fatalRenderer, if set, replaces the default FatalJSONMsg renderer
+	fatalRenderer func(apiVer string, errMsg Msg) string
+	// autoFormatForTTY indicates if WriteJSONOutput only pretty prints when
+	// writing to a terminal (see SetAutoFormatForTTY)
+	autoFormatForTTY = false
+	// isTerminal is used to check if a writer is a terminal so tests can
+	// stub it out
+	isTerminal = writerIsTerminal
+	// prettyScope is the part of the JSON output that is pretty printed
+	// (see SetPrettyScope)
+	prettyScope = PrettyScopeAll
+	// outputFilters are run, in order, on every JSON output produced by
+	// GetJSONOutput and the like (see SetOutputFilter)
+	outputFilters []func(string) string
+	// headerCompact indicates if the JSON output is a compact header line
+	// followed by the pretty data section (see SetHeaderCompact)
+	headerCompact = false
+	// diagnosticsWriter, if set, is given the notes, warnings and diagnostics
+	// of each JSON output as a JSON line, diagnosticsDivert indicates if they
+	// are then left out of the JSON output (see SetDiagnosticsWriter)
+	diagnosticsWriter io.Writer
+	diagnosticsDivert = false
+	// diagnosticsWriteMu keeps JSON lines written to the diagnostics writer
+	// from interleaving
+	diagnosticsWriteMu sync.Mutex
+)
+
+// Scopes available for SetPrettyScope(), ie: which part of the JSON output
+// GetJSONOutput (and the like) pretty prints
+const (
+	PrettyScopeAll      = "all"      // the whole response (the default)
+	PrettyScopeEnvelope = "envelope" // all but the data section
+	PrettyScopeData     = "data"     // only the data section
 )
 
+// prettyScopeToken stands in for the data section when the envelope and data
+// are formatted separately (see prettyResponse)
+const prettyScopeToken = "dvlnPrettyScopeData-7f3a9c"
+
+// utf8BOM is the UTF-8 byte order mark (see SetEmitBOM)
+const utf8BOM = "\xef\xbb\xbf"
+
 // JSONIndentLevel can be used to get the current indentation level for each
-// "step" in PrettyJSON() output (defaults to 2 currently)
+// "step" in PrettyJSON() output (defaults to DefaultJSONIndentLevel)
 func JSONIndentLevel() int {
 	mu.RLock()
 	defer mu.RUnlock()
@@ -71,7 +173,69 @@ func JSONPrefix() string {
 func SetJSONPrefix(pfx string) {
 	mu.Lock()
 	defer mu.Unlock()
- 	jsonPrefix = pfx
+	jsonPrefix = pfx
+}
+
+// MaxJSONPrefixLen returns the current max length allowed for the prefix
+// used by PrettyJSON(), 0 means unlimited
+func MaxJSONPrefixLen() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	length := maxJSONPrefixLen
+	return length
+}
+
+// SetMaxJSONPrefixLen can be used to change the sanity cap on the length of
+// the prefix used by PrettyJSON() (via SetJSONPrefix or given directly), as
+// every line gets the prefix an overly long one is usually a bug that makes
+// the output explode in size.  If the prefix is longer than the cap then
+// PrettyJSON() returns an error (and the JSON as is).  Use 0 for no cap, the
+// default is DefaultMaxJSONPrefixLen.
+func SetMaxJSONPrefixLen(length int) {
+	mu.Lock()
+	defer mu.Unlock()
+	maxJSONPrefixLen = length
+}
+
+// MaxPrettyInputBytes returns the current max size (in bytes) of the JSON
+// that PrettyJSON() will indent, 0 means unlimited
+func MaxPrettyInputBytes() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	size := maxPrettyInputBytes
+	return size
+}
+
+// SetMaxPrettyInputBytes can be used to cap the size of the JSON input that
+// PrettyJSON() will try to indent, indenting makes a full copy of the input
+// (and more) so for very large or untrusted input this avoids blowing up
+// memory use.  If the input is bigger than the cap then PrettyJSON() returns
+// an error (and the JSON as is) so the caller can fall back to the raw JSON.
+// Use 0 for no cap (the default).
+func SetMaxPrettyInputBytes(size int) {
+	mu.Lock()
+	defer mu.Unlock()
+	maxPrettyInputBytes = size
+}
+
+// MaxPrettyDepth returns the nesting depth beyond which PrettyJSON() leaves
+// the JSON compact, 0 means unlimited
+func MaxPrettyDepth() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	depth := maxPrettyDepth
+	return depth
+}
+
+// SetMaxPrettyDepth can be used to have PrettyJSON() indent only the given
+// number of levels of nesting, any object or array nested deeper than that
+// is collapsed into compact JSON on a single line (so deeply nested debug
+// output doesn't turn into lines that are mostly indentation), eg: a depth of
+// 1 indents only the top level members.  Use 0 for unlimited (the default).
+func SetMaxPrettyDepth(depth int) {
+	mu.Lock()
+	defer mu.Unlock()
+	maxPrettyDepth = depth
 }
 
 // JSONRaw can be used to determine if we're in raw JSON output mode (true)
@@ -93,6 +257,88 @@ func SetJSONRaw(b bool) {
 	jsonRaw = b
 }
 
+// JSONAlignColons can be used to determine if PrettyJSON() output has the
+// values within each JSON object column aligned (true) or not (false)
+func JSONAlignColons() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	align := jsonAlignColons
+	return align
+}
+
+// SetJSONAlignColons can be used to have PrettyJSON() line up the values
+// within each JSON object, spaces are added after the colon so that all
+// values in an object start in the same column (still valid JSON)
+func SetJSONAlignColons(b bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	jsonAlignColons = b
+}
+
+// HTMLSafe can be used to determine if the HTML sensitive characters <, >
+// and & are being escaped in JSON strings (true, the default) or not
+func HTMLSafe() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	safe := htmlSafe
+	return safe
+}
+
+// SetHTMLSafe can be used to control if the HTML sensitive characters <, >
+// and & are escaped (as \u003c, \u003e and \u0026) in JSON strings so the
+// JSON can be safely embedded in an HTML page.  This applies consistently
+// to both marshaled JSON and the hand built JSON (eg: FatalJSONMsg) and
+// defaults to true (as the Go json.Marshal routine does).
+func SetHTMLSafe(b bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	htmlSafe = b
+}
+
+// DoubleEscapeGuard can be used to determine if the EscapeJSONString() guard
+// against re-escaping existing \uXXXX sequences is active (default false)
+func DoubleEscapeGuard() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	guard := doubleEscapeGuard
+	return guard
+}
+
+// SetDoubleEscapeGuard can be used to have EscapeJSONString() leave any
+// existing \uXXXX escape sequences in a string as is so that escaping an
+// already escaped string is a no-op (ie: the output of EscapeJSONString()
+// can be fed back in and comes back unchanged).  By default this is false
+// so a backslash is always escaped (as a literal "\u0022" is valid text).
+func SetDoubleEscapeGuard(b bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	doubleEscapeGuard = b
+}
+
+// isUnicodeEscape returns true if b starts with a \uXXXX escape sequence
+func isUnicodeEscape(b []byte) bool {
+	if len(b) < 6 || b[0] != '\\' || b[1] != 'u' {
+		return false
+	}
+	for _, ch := range b[2:6] {
+		if !((ch >= '0' && ch <= '9') || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')) {
+			return false
+		}
+	}
+	return true
+}
+
+// marshalJSON is like json.Marshal but honors the HTMLSafe() setting
+func marshalJSON(v interface{}) ([]byte, error) {
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(HTMLSafe())
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(out.Bytes(), "\n"), nil
+}
+
 // PrettyJSON pretty prints JSON data.  Provide the data and that can be followed
 // by two optional arguments, a prefix string and an indent level (both of which
 // are strings).  If neither is provided then no prefix used and indent of two
@@ -100,16 +346,49 @@ func SetJSONRaw(b bool) {
 // related DVLN_JSONPREFIX, DVLN_JSONINDENT to adjust indentation and prefix
 // as well as cfgfile:jsonraw and DVLN_JSONRAW for skipping pretty printing)
 func PrettyJSON(b []byte, fmt ...string) (string, error) {
+	out, err := PrettyJSONBytes(b, fmt...)
+	return bytesToString(out), err
+}
+
+// PrettyJSONBytes is like PrettyJSON but the result is returned as bytes to
+// avoid a copy for callers that need bytes anyway (eg: to write to a socket),
+// note that if the JSON is left as is (eg: in raw mode or on error) then the
+// given slice itself is returned
+func PrettyJSONBytes(b []byte, fmt ...string) ([]byte, error) {
+	return prettyJSONBytes(b, true, fmt...)
+}
+
+// prettyMarshaledJSON is PrettyJSON for JSON this package built itself (eg:
+// via marshalJSON), that can't have trailing data so in raw mode the check
+// for it (a second full decode) is skipped
+func prettyMarshaledJSON(j []byte) (string, error) {
+	out, err := prettyJSONBytes(j, false)
+	return bytesToString(out), err
+}
+
+// prettyJSONBytes does the work for PrettyJSONBytes, checkTrailing is used
+// to check caller supplied input for trailing data in raw mode
+func prettyJSONBytes(b []byte, checkTrailing bool, fmt ...string) ([]byte, error) {
+	if err := inputSizeError(b); err != nil {
+		return b, err
+	}
 	mu.RLock()
 	if jsonRaw {
 		mu.RUnlock()
 		// if there's an override to say pretty JSON is not desired, honor it,
 		// Feature: this could be changed to specifically remove carriage
 		//          returns and shorten output around {} and :'s and such (?)
-		return cast.ToString(b), nil
+		// (json.Indent rejects trailing data otherwise, here it's checked)
+		if !checkTrailing {
+			return b, nil
+		}
+		return b, trailingDataError(b)
 	}
 	prefix := jsonPrefix
-	indent := str.Pad("", " ", jsonIndentLevel)
+	indent := spaces(jsonIndentLevel)
+	align := jsonAlignColons
+	maxPrefixLen := maxJSONPrefixLen
+	maxDepth := maxPrettyDepth
 	mu.RUnlock()
 	if len(fmt) == 1 {
 		prefix = fmt[0]
@@ -117,16 +396,473 @@ func PrettyJSON(b []byte, fmt ...string) (string, error) {
 		prefix = fmt[0]
 		indent = fmt[1]
 	}
-	var out bytes.Buffer
-	err := json.Indent(&out, b, prefix, indent)
-	return cast.ToString(out.Bytes()) + "\n", err
+	if maxPrefixLen > 0 && len(prefix) > maxPrefixLen {
+		return b, prefixLenError(len(prefix), maxPrefixLen)
+	}
+	var out cappedBuffer
+	out.Grow(len(b) + len(b)/2)
+	var err error
+	if maxDepth > 0 {
+		err = indentJSON(&out, b, prefix, indent, maxDepth)
+	} else {
+		err = json.Indent(&out.Buffer, b, prefix, indent)
+	}
+	err = syntaxContext(err, b)
+	if err == nil && align {
+		return []byte(alignColons(out.String(), prefix, indent) + "\n"), nil
+	}
+	out.WriteByte('\n')
+	return out.Bytes(), err
+}
+
+// errOutputCapped is returned by a cappedBuffer once its cap has been hit so
+// that the pretty printing writing to it can stop early
+var errOutputCapped = errors.New("JSON output cap reached")
+
+// cappedBuffer is a bytes.Buffer that refuses to grow past max bytes (if max
+// is > 0), anything written up to the cap is kept and then errOutputCapped
+// is returned
+type cappedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+// Write writes what fits under the cap, see cappedBuffer
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if c.max > 0 && c.Len()+len(p) > c.max {
+		n, _ := c.Buffer.Write(p[:c.max-c.Len()])
+		return n, errOutputCapped
+	}
+	return c.Buffer.Write(p)
+}
+
+// WriteString writes what fits under the cap, see cappedBuffer
+func (c *cappedBuffer) WriteString(s string) (int, error) {
+	if c.max > 0 && c.Len()+len(s) > c.max {
+		n, _ := c.Buffer.WriteString(s[:c.max-c.Len()])
+		return n, errOutputCapped
+	}
+	return c.Buffer.WriteString(s)
+}
+
+// WriteByte writes the byte if it fits under the cap, see cappedBuffer
+func (c *cappedBuffer) WriteByte(b byte) error {
+	if c.max > 0 && c.Len() >= c.max {
+		return errOutputCapped
+	}
+	return c.Buffer.WriteByte(b)
+}
+
+// indentJSON is like json.Indent but objects and arrays nested deeper than
+// maxDepth are left compact (if maxDepth > 0, see SetMaxPrettyDepth) and it
+// stops as soon as a write to out fails (eg: a cappedBuffer hitting its cap)
+func indentJSON(out *cappedBuffer, src []byte, prefix string, indent string, maxDepth int) error {
+	if !json.Valid(src) {
+		var scratch bytes.Buffer
+		return json.Compact(&scratch, src)
+	}
+	var err error
+	newline := func(depth int) {
+		if err == nil {
+			err = out.WriteByte('\n')
+		}
+		if err == nil {
+			_, err = out.WriteString(prefix)
+		}
+		for n := 0; n < depth && err == nil; n++ {
+			_, err = out.WriteString(indent)
+		}
+	}
+	depth := 0
+	for i := 0; i < len(src) && err == nil; i++ {
+		c := src[i]
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			// white space between tokens is re-done by the indenting
+		case '"':
+			end := stringEnd(src, i)
+			_, err = out.Write(src[i:end])
+			i = end - 1
+		case '{', '[':
+			if maxDepth > 0 && depth >= maxDepth {
+				end := valueEnd(src, i)
+				var compact bytes.Buffer
+				if err = json.Compact(&compact, src[i:end]); err == nil {
+					_, err = out.Write(compact.Bytes())
+				}
+				i = end - 1
+				continue
+			}
+			err = out.WriteByte(c)
+			next := i + 1
+			for next < len(src) && isJSONSpace(src[next]) {
+				next++
+			}
+			if next < len(src) && (src[next] == '}' || src[next] == ']') {
+				if err == nil {
+					err = out.WriteByte(src[next])
+				}
+				i = next
+				continue
+			}
+			depth++
+			newline(depth)
+		case '}', ']':
+			depth--
+			newline(depth)
+			if err == nil {
+				err = out.WriteByte(c)
+			}
+		case ',':
+			err = out.WriteByte(c)
+			newline(depth)
+		case ':':
+			_, err = out.WriteString(": ")
+		default:
+			err = out.WriteByte(c)
+		}
+	}
+	return err
+}
+
+// isJSONSpace returns true for the white space allowed between JSON tokens
+func isJSONSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// stringEnd returns the offset just past the end of the (valid) JSON string
+// starting at offset i of b
+func stringEnd(b []byte, i int) int {
+	for i++; i < len(b); i++ {
+		switch b[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return len(b)
+}
+
+// valueEnd returns the offset just past the end of the (valid) JSON
+// object or array starting at offset i of b
+func valueEnd(b []byte, i int) int {
+	depth := 0
+	for ; i < len(b); i++ {
+		switch b[i] {
+		case '"':
+			i = stringEnd(b, i) - 1
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(b)
+}
+
+// jsonSyntaxError is a syntax error from PrettyJSON() along with a snippet
+// of the JSON around where the error was found, to help diagnose it
+type jsonSyntaxError struct {
+	*json.SyntaxError
+	Snippet string
+}
+
+// Error returns the syntax error message with its offset and snippet
+func (e *jsonSyntaxError) Error() string {
+	return fmt.Sprintf("%s (at offset %d near %q)", e.SyntaxError.Error(), e.Offset, e.Snippet)
+}
+
+// Unwrap returns the underlying json.SyntaxError
+func (e *jsonSyntaxError) Unwrap() error {
+	return e.SyntaxError
+}
+
+// syntaxContext adds a snippet of b (up to 20 bytes either side of the error
+// offset) to a json.SyntaxError found in b, other errors are returned as is
+func syntaxContext(err error, b []byte) error {
+	syntaxErr, ok := err.(*json.SyntaxError)
+	if !ok {
+		return err
+	}
+	start, end := int(syntaxErr.Offset)-20, int(syntaxErr.Offset)+20
+	if start < 0 {
+		start = 0
+	}
+	if end > len(b) {
+		end = len(b)
+	}
+	if start > end {
+		start = end
+	}
+	return &jsonSyntaxError{syntaxErr, string(b[start:end])}
+}
+
+// beautifyWarning returns the warning (1003) stored in the JSON output when
+// it can't be pretty printed, for a syntax error the offset and snippet of
+// the JSON around it are put in the details
+func beautifyWarning(err error) Msg {
+	warnMsg := NewMsg(fmt.Sprintf("Unable to beautify JSON output: %s", err), 1003, "ISSUE")
+	var syntaxErr *jsonSyntaxError
+	if errors.As(err, &syntaxErr) {
+		warnMsg.Details = map[string]interface{}{
+			"offset":  syntaxErr.Offset,
+			"snippet": syntaxErr.Snippet,
+		}
+	}
+	return warnMsg
+}
+
+// prefixLenError returns the error used when the PrettyJSON() prefix is
+// too long (see SetMaxJSONPrefixLen)
+func prefixLenError(length int, maxLength int) error {
+	return fmt.Errorf("JSON prefix length %d exceeds the max allowed length of %d", length, maxLength)
+}
+
+// inputSizeError returns an error if b is bigger than the max size that
+// PrettyJSON will indent (see SetMaxPrettyInputBytes), this is checked before
+// anything else so overly large input isn't scanned or copied (raw mode does
+// no indenting so there's no cap)
+func inputSizeError(b []byte) error {
+	maxBytes := MaxPrettyInputBytes()
+	if maxBytes <= 0 || len(b) <= maxBytes || JSONRaw() {
+		return nil
+	}
+	return fmt.Errorf("JSON input size %d exceeds the max pretty print size of %d bytes", len(b), maxBytes)
+}
+
+// trailingDataError returns an error if there is anything other than white
+// space after the first JSON value in b (eg: two concatenated JSON objects),
+// so such bugs surface rather than the extra data being silently dropped
+// (an invalid first value is left for the caller to report), the value is
+// decoded into an empty struct so it is only scanned, not copied
+func trailingDataError(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	var skip struct{}
+	if err := dec.Decode(&skip); err != nil {
+		if _, ok := err.(*json.UnmarshalTypeError); !ok {
+			return nil
+		}
+	}
+	offset := dec.InputOffset()
+	if _, err := dec.Token(); err == io.EOF {
+		return nil
+	}
+	rest := bytes.TrimLeft(b[offset:], " \t\r\n")
+	offset = int64(len(b) - len(rest))
+	if len(rest) > 20 {
+		rest = rest[:20]
+	}
+	return fmt.Errorf("unexpected data after top-level JSON value at offset %d: %q", offset, rest)
+}
+
+// alignColons takes pretty JSON (as formatted by json.Indent with the given
+// prefix and indent) and pads the values of each object with spaces after
+// the colon so they all start in the same column
+func alignColons(pretty string, prefix string, indent string) string {
+	type keyLine struct {
+		line  int // index of the line with the key
+		colon int // byte offset of the colon in the line
+		width int // width of the key (in chars)
+	}
+	type container struct {
+		object bool
+		keys   []keyLine
+	}
+	lines := strings.Split(pretty, "\n")
+	var stack []*container
+	alignObject := func(c *container) {
+		maxWidth := 0
+		for _, k := range c.keys {
+			if k.width > maxWidth {
+				maxWidth = k.width
+			}
+		}
+		for _, k := range c.keys {
+			l := lines[k.line]
+			pad := strings.Repeat(" ", maxWidth-k.width)
+			lines[k.line] = l[:k.colon+2] + pad + l[k.colon+2:]
+		}
+	}
+	for i, l := range lines {
+		// first line has no prefix or indent (see json.Indent), closing
+		// lines are indented one level less than the container contents
+		depth := len(stack)
+		if trimmed := strings.TrimLeft(strings.TrimPrefix(l, prefix), " \t"); depth > 0 && (strings.HasPrefix(trimmed, "}") || strings.HasPrefix(trimmed, "]")) {
+			depth--
+		}
+		lead := 0
+		if i > 0 {
+			lead = len(prefix) + len(indent)*depth
+		}
+		if lead > len(l) {
+			continue
+		}
+		content := l[lead:]
+		if content == "" {
+			continue
+		}
+		if depth < len(stack) && (content[0] == '}' || content[0] == ']') {
+			if c := stack[len(stack)-1]; c.object {
+				alignObject(c)
+			}
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		if len(stack) > 0 && stack[len(stack)-1].object && content[0] == '"' {
+			// find the end of the key string, skipping escaped chars
+			end := 1
+			for end < len(content) && content[end] != '"' {
+				if content[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end+2 < len(content) && content[end+1:end+3] == ": " {
+				c := stack[len(stack)-1]
+				c.keys = append(c.keys, keyLine{line: i, colon: lead + end + 1, width: utf8.RuneCountInString(content[:end+1])})
+			}
+		}
+		switch content[len(content)-1] {
+		case '{':
+			stack = append(stack, &container{object: true})
+		case '[':
+			stack = append(stack, &container{object: false})
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// NormalizeJSON produces canonical formatting for the given JSON regardless
+// of how it was formatted coming in (eg: mixed indentation from various
+// sources), the JSON is compacted and then re-indented as per the current
+// settings (ie: as PrettyJSON would do, including raw output if JSONRaw()).
+func NormalizeJSON(b []byte) ([]byte, error) {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, b); err != nil {
+		return nil, err
+	}
+	// json.Compact already rejected any trailing data
+	output, err := prettyMarshaledJSON(compact.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return []byte(output), nil
+}
+
+// PrettyJSONCapped is like PrettyJSON but the output will be cut off after
+// maxBytes bytes (at the last full line that fits if possible) and have a
+// "... (truncated)" marker line added, the bool returned indicates if any
+// truncation happened.  Note that truncated output is not valid JSON, this
+// is meant for display (eg: in a terminal).  A maxBytes <= 0 means no cap.
+// The indenting stops once the cap is hit so a huge input isn't formatted in
+// full just to show the start of it.
+func PrettyJSONCapped(b []byte, maxBytes int, fmt ...string) (string, bool, error) {
+	if maxBytes <= 0 {
+		output, err := PrettyJSON(b, fmt...)
+		return output, false, err
+	}
+	if err := inputSizeError(b); err != nil {
+		return bytesToString(b), false, err
+	}
+	mu.RLock()
+	raw := jsonRaw
+	prefix := jsonPrefix
+	indent := spaces(jsonIndentLevel)
+	align := jsonAlignColons
+	maxPrefixLen := maxJSONPrefixLen
+	maxDepth := maxPrettyDepth
+	mu.RUnlock()
+	if raw || align {
+		// raw output is the input as is and aligning colons needs all of
+		// the output lines, so there's nothing to save by stopping early
+		output, err := PrettyJSON(b, fmt...)
+		if err != nil || len(output) <= maxBytes {
+			return output, false, err
+		}
+		return truncateOutput(output, maxBytes), true, nil
+	}
+	if len(fmt) == 1 {
+		prefix = fmt[0]
+	} else if len(fmt) == 2 {
+		prefix = fmt[0]
+		indent = fmt[1]
+	}
+	if maxPrefixLen > 0 && len(prefix) > maxPrefixLen {
+		return bytesToString(b), false, prefixLenError(len(prefix), maxPrefixLen)
+	}
+	// one byte past the cap is kept so truncateOutput can see if the cut
+	// lands in the middle of a multi-byte char
+	out := cappedBuffer{max: maxBytes + 1}
+	err := indentJSON(&out, b, prefix, indent, maxDepth)
+	if err == nil {
+		err = out.WriteByte('\n')
+	}
+	if err != nil && err != errOutputCapped {
+		return bytesToString(b), false, syntaxContext(err, b)
+	}
+	output := out.String()
+	if len(output) <= maxBytes {
+		return output, false, nil
+	}
+	return truncateOutput(output, maxBytes), true, nil
+}
+
+// truncateOutput cuts output (which is longer than maxBytes) back to the last
+// full line within maxBytes if possible and adds the "... (truncated)" marker
+func truncateOutput(output string, maxBytes int) string {
+	capped := output[:maxBytes]
+	if idx := strings.LastIndex(capped, "\n"); idx > 0 {
+		capped = capped[:idx]
+	} else {
+		// no full line fits, make sure we don't split a multi-byte char
+		for len(capped) > 0 && !utf8.RuneStart(output[len(capped)]) {
+			capped = capped[:len(capped)-1]
+		}
+	}
+	return capped + "\n... (truncated)\n"
+}
+
+// needsEscape and needsEscapeHTML are used by EscapeJSONString to quickly
+// scan for any control chars, quotes or backslashes (and <, >, & for HTML)
+func needsEscape(r rune) bool {
+	return r <= 31 || r == '"' || r == '\\'
+}
+
+func needsEscapeHTML(r rune) bool {
+	return r <= 31 || r == '"' || r == '\\' || r == '<' || r == '>' || r == '&'
 }
 
-// EscapeJSONString escapes control chars in a string so JSON likes em
+// EscapeJSONString escapes control chars, quotes and backslashes in a string
+// so JSON likes em, if HTMLSafe() is true then <, > and & are also escaped.
+// If nothing needs escaping the given slice is returned (no allocations).
+// See SetDoubleEscapeGuard() to avoid re-escaping already escaped strings.
 func EscapeJSONString(ctrl []byte) (esc []byte) {
+	escHTML := HTMLSafe()
+	scan := needsEscape
+	if escHTML {
+		scan = needsEscapeHTML
+	}
+	start := bytes.IndexFunc(ctrl, scan)
+	if start < 0 {
+		return ctrl
+	}
 	u := []byte(`\u0000`)
-	for i, ch := range ctrl {
-		if ch <= 31 || ch == 34 {
+	guard := DoubleEscapeGuard()
+	for i := start; i < len(ctrl); i++ {
+		ch := ctrl[i]
+		if guard && isUnicodeEscape(ctrl[i:]) {
+			if esc == nil {
+				esc = append(make([]byte, 0, len(ctrl)+len(u)), ctrl[:i]...)
+			}
+			esc = append(esc, ctrl[i:i+6]...)
+			i += 5
+			continue
+		}
+		if escapeByte(ch, escHTML) {
 			if esc == nil {
 				esc = append(make([]byte, 0, len(ctrl)+len(u)), ctrl[:i]...)
 			}
@@ -138,12 +874,59 @@ func EscapeJSONString(ctrl []byte) (esc []byte) {
 			esc = append(esc, ch)
 		}
 	}
-	if esc == nil {
-		return ctrl
-	}
 	return esc
 }
 
+// escapeByte returns true if the given byte must be escaped in a JSON string
+// (html indicates if the HTML sensitive characters <, > and & are escaped)
+func escapeByte(ch byte, html bool) bool {
+	return ch <= 31 || ch == '"' || ch == '\\' || (html && (ch == '<' || ch == '>' || ch == '&'))
+}
+
+// WriteEscapedJSONString is like EscapeJSONString but the escaped string is
+// written directly to the given writer (without building the whole escaped
+// string in memory), handy for streaming large messages (ResponseStream uses
+// it for the envelope msgs).  The number of bytes written is returned along
+// with any error writing.
+func WriteEscapedJSONString(w io.Writer, ctrl []byte) (int, error) {
+	escHTML := HTMLSafe()
+	guard := DoubleEscapeGuard()
+	u := []byte(`\u0000`)
+	total := 0
+	start := 0
+	for i := 0; i < len(ctrl); i++ {
+		if guard && isUnicodeEscape(ctrl[i:]) {
+			i += 5
+			continue
+		}
+		if !escapeByte(ctrl[i], escHTML) {
+			continue
+		}
+		if start < i {
+			n, err := w.Write(ctrl[start:i])
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+		hex.Encode(u[len(u)-2:], ctrl[i:i+1])
+		n, err := w.Write(u)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		start = i + 1
+	}
+	if start < len(ctrl) {
+		n, err := w.Write(ctrl[start:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
 // encodeMsginRawJSON takes the flavor of the Msg ("error", "warning" or "note")
 // and the message and returns a JSON encoded string with no preceeding or
 // following comments
@@ -151,93 +934,748 @@ func encodeMsgInRawJSON(flavor string, msg Msg) string {
 	if msg.Message == "" {
 		return ""
 	}
-	cleanMsg := EscapeJSONString([]byte(msg.Message))
-	rawJSON := fmt.Sprintf("\"%s\": { \"message\": \"%s\", \"code\": %d, \"level\": \"%s\"}", flavor, cleanMsg, msg.Code, msg.Level)
+	rawJSON := fmt.Sprintf("\"%s\": %s", flavor, encodeMsgObjInRawJSON(truncateMsg(msg)))
 	return rawJSON
 }
 
-// FatalJSONMsg is for cases where Marshal is failing so we need
-// some JSON we can dump on the output... if we get to this level then
-// what we're generating is a valid JSON error basically (shouldn't happen)
-func FatalJSONMsg(apiVer string, errMsg Msg) string {
-	noteMsgJSON := encodeMsgInRawJSON("note", storedNote)
-	warnMsgJSON := encodeMsgInRawJSON("warning", storedNonFatalWarning)
-	errMsgJSON := encodeMsgInRawJSON("error", errMsg)
-	// we really need an error, try global setting else fallback to unknown
-	if errMsgJSON == "" {
-		errMsgJSON = encodeMsgInRawJSON("error", storedFatalError)
-		if errMsgJSON == "" {
-			errMsg = NewMsg("Unknown Fatal Error (Coding Error?)", 0, "UNKNOWN")
-			errMsgJSON = encodeMsgInRawJSON("error", errMsg)
+// encodeMsgObjInRawJSON returns the given Msg as a raw JSON object, any
+// details and causes the Msg has are included (see WrapMsg) unless the
+// legacy Msg schema is used (see SetMsgSchemaVersion)
+func encodeMsgObjInRawJSON(msg Msg) string {
+	legacy := MsgSchemaVersion() == MsgSchemaLegacy
+	if legacy {
+		msg = legacyMsg(msg)
+	}
+	code := fmt.Sprintf("%d", renderedCode(msg.Code))
+	if CodesAsStrings() {
+		code = fmt.Sprintf("\"%d\"", renderedCode(msg.Code))
+	}
+	causesJSON := ""
+	if msg.Causes != nil {
+		causes := make([]string, len(msg.Causes))
+		for i, cause := range msg.Causes {
+			causes[i] = encodeMsgObjInRawJSON(cause)
 		}
+		causesJSON = fmt.Sprintf(", \"causes\": [ %s ]", strings.Join(causes, ", "))
 	}
-	msgsJSON := ""
-	if noteMsgJSON != "" {
-		msgsJSON = fmt.Sprintf("%s, ", noteMsgJSON)
+	level := fmt.Sprintf("\"%s\"", EscapeJSONString([]byte(msg.Level)))
+	if StructuredLevels() && !legacy {
+		level = fmt.Sprintf("{ \"name\": %s, \"value\": %d }", level, LevelSeverity(msg.Level))
 	}
-	if warnMsgJSON != "" {
-		msgsJSON = fmt.Sprintf("%s%s, ", msgsJSON, warnMsgJSON)
+	if msg.CodeString != "" {
+		code = fmt.Sprintf("%s, \"codeString\": \"%s\"", code, EscapeJSONString([]byte(msg.CodeString)))
 	}
-	msgsJSON = fmt.Sprintf("%s%s", msgsJSON, errMsgJSON)
-	cmdError := -1
-	rawJSON := fmt.Sprintf("{ \"apiVersion\":\"%s\", \"id\": %d, %s }", apiVer, cmdError, msgsJSON)
-	output, err := PrettyJSON([]byte(rawJSON))
-	if err != nil {
-		output = rawJSON
+	detailsJSON := ""
+	if msg.Details != nil {
+		// eg: the full message of a truncated msg (see SetMaxMessageLength)
+		if details, err := marshalJSON(msg.Details); err == nil {
+			detailsJSON = fmt.Sprintf(", \"details\": %s", details)
+		}
 	}
-	return output
+	countJSON := ""
+	if msg.Count != 0 {
+		countJSON = fmt.Sprintf(", \"count\": %d", msg.Count)
+	}
+	var rawJSON strings.Builder
+	rawJSON.WriteString("{ \"message\": \"")
+	WriteEscapedJSONString(&rawJSON, []byte(msg.Message))
+	fmt.Fprintf(&rawJSON, "\", \"code\": %s, \"level\": %s%s%s%s}", code, level, detailsJSON, causesJSON, countJSON)
+	return rawJSON.String()
 }
 
-// GetJSONOutput takes the various things needed from a DVLN api call and
-// combines pertinent details into a JSON "results" string (pretty or not
-// depending upon settings) and returns that representation to the caller.
-// It will return a boolean indicating if a fatal occurred (if so the err
-// will be encoded in the JSON being returned already, print the string and
-// exit non-zero basically if you get false back in the boolean)
-func GetJSONOutput(apiVer string, context string, kind string, verbosity string, fields []string, items []interface{}) (string, bool) {
-	var j []byte
-	var err error
-	var output, rawJSON string
-	var errMsg, warnMsg, noteMsg Msg
-	fatalErr := false
+// IncludePartialDataOnFatal returns true if items are included in the JSON
+// output even if there is a fatal error
+func IncludePartialDataOnFatal() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	partial := partialDataOnFatal
+	return partial
+}
 
-	if apiVer == "" {
-		// In case the API version couldn't be passed, last ditch try
-		apiVer = os.Getenv("PKG_API_APIVER")
-		if apiVer == "" {
-			apiVer = "?.?"
-			errMsg.Message = "No valid JSON API version is available"
-			errMsg.Code = 1001
-			errMsg.Level = "FATAL"
-			fatalErr = true
+// SetIncludePartialDataOnFatal can be used to have GetJSONOutput (and the
+// like) still include whatever items were given in the 'data' section when
+// there is a fatal error, partial data plus the error can be more useful to
+// the client than just the error.  Defaults to false (only the error).
+func SetIncludePartialDataOnFatal(b bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	partialDataOnFatal = b
+}
+
+// SetOutputFilter can be used to set functions that rewrite every JSON
+// output produced by GetJSONOutput (and the like) just before it is returned
+// (and given to any output observer, see SetOutputObserver), eg: to insert a
+// watermark or rewrite URLs, for output requirements this package doesn't
+// otherwise handle.  The filters are run in the order given, each getting
+// the output of the one before.  Call with no filters (the default) to leave
+// the output unchanged, nil filters are skipped.
+func SetOutputFilter(filters ...func(string) string) {
+	mu.Lock()
+	defer mu.Unlock()
+	outputFilters = append([]func(string) string(nil), filters...)
+}
+
+// filterOutput runs the output filters (see SetOutputFilter) on the output
+func filterOutput(output string) string {
+	mu.RLock()
+	filters := outputFilters
+	mu.RUnlock()
+	for _, filter := range filters {
+		if filter != nil {
+			output = filter(output)
 		}
 	}
-	apiRoot := newAPIData(apiVer, context)
-	if errMsg.Message == "" && storedFatalError.Message != "" {
-		errMsg = storedFatalError
-		fatalErr = true
+	return output
+}
+
+// SetOutputObserver can be used to set a function that is given the context,
+// final output and fatal flag for every JSON output produced by GetJSONOutput
+// (and the like) just before it is returned, handy for centrally logging or
+// auditing all API output.  Use nil (the default) for no observer.
+func SetOutputObserver(observer func(context string, output string, fatal bool)) {
+	mu.Lock()
+	defer mu.Unlock()
+	outputObserver = observer
+}
+
+// ErrorsOnly returns true if JSON output is trimmed to just the API version,
+// id and any fatal error
+func ErrorsOnly() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	errs := errorsOnly
+	return errs
+}
+
+// SetErrorsOnly can be used to have GetJSONOutput (and the like) drop the
+// context, data, notes and warnings from the output so it has only the
+// "apiVersion", "id" and "error" fields, this is a compact mode for machine
+// parsing by clients that only care about errors.  On success the output
+// then has only the "apiVersion" and an "id" of 0.  Defaults to false.
+func SetErrorsOnly(b bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	errorsOnly = b
+}
+
+// MissingAPIVersionAllowed returns true if an empty API version is allowed
+func MissingAPIVersionAllowed() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	allowed := allowMissingAPIVersion
+	return allowed
+}
+
+// AllowMissingAPIVersion can be used to allow GetJSONOutput (and the like)
+// to be called with no API version (for purely internal pipe to pipe use),
+// the "apiVersion" field is then simply omitted from the output instead of
+// resulting in the "No valid JSON API version" fatal error.  Defaults to
+// false (an API version is required).
+func AllowMissingAPIVersion(b bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	allowMissingAPIVersion = b
+}
+
+// EmitBOM returns true if JSON output starts with a UTF-8 BOM
+func EmitBOM() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	bom := emitBOM
+	return bom
+}
+
+// SetEmitBOM can be used to have the JSON output from GetJSONOutput (and the
+// like) start with the UTF-8 byte order mark (BOM), some legacy (Windows)
+// consumers require it.  Caveat: a BOM is not allowed by the JSON spec and
+// breaks most JSON parsers (including the Go json package) so only turn this
+// on for consumers known to need it.  Defaults to false.
+func SetEmitBOM(b bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	emitBOM = b
+}
+
+// SetAPIVersionPattern can be used to have the API version given to
+// GetJSONOutput (and the like) checked against the given pattern (eg:
+// regexp.MustCompile(`^\d+\.\d+$`)), if it doesn't match then a warning
+// is stored or, if the optional fatal bool is given as true, the bad version
+// is a fatal error.  Use nil (the default) to allow any API version.
+func SetAPIVersionPattern(pattern *regexp.Regexp, fatal ...bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	apiVersionPattern = pattern
+	apiVersionFatal = false
+	if fatal != nil {
+		apiVersionFatal = fatal[0]
+	}
+}
+
+// apiVersionCheck returns the API version pattern and fatal setting
+func apiVersionCheck() (*regexp.Regexp, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	return apiVersionPattern, apiVersionFatal
+}
+
+// UnknownFatalMsg returns the last ditch fatal error Msg that FatalJSONMsg
+// uses when there is no fatal error given or stored
+func UnknownFatalMsg() Msg {
+	mu.RLock()
+	defer mu.RUnlock()
+	msg := unknownFatalMsg
+	return msg
+}
+
+// SetUnknownFatalMsg can be used to change (eg: localize) the last ditch
+// fatal error Msg that FatalJSONMsg uses when there is no fatal error given
+// or stored, the default is "Unknown Fatal Error (Coding Error?)" with a
+// code of 0 and a level of "UNKNOWN"
+func SetUnknownFatalMsg(msg Msg) {
+	mu.Lock()
+	defer mu.Unlock()
+	unknownFatalMsg = msg
+}
+
+// SetFatalRenderer can be used to replace the routine FatalJSONMsg uses to
+// build the last ditch fatal JSON so it can match some other envelope schema
+// (eg: when dvln is embedded into other tools), use nil to get the default
+// renderer back.  The renderer must not call FatalJSONMsg itself.
+func SetFatalRenderer(renderer func(apiVer string, errMsg Msg) string) {
+	mu.Lock()
+	defer mu.Unlock()
+	fatalRenderer = renderer
+}
+
+// FatalJSONMsg is for cases where Marshal is failing so we need
+// some JSON we can dump on the output... if we get to this level then
+// what we're generating is a valid JSON error basically (shouldn't happen),
+// see SetFatalRenderer to control the JSON generated
+func FatalJSONMsg(apiVer string, errMsg Msg) string {
+	mu.RLock()
+	renderer := fatalRenderer
+	mu.RUnlock()
+	if renderer != nil {
+		return renderer(apiVer, errMsg)
+	}
+	return defaultFatalJSONMsg(apiVer, errMsg)
+}
+
+// defaultFatalJSONMsg is the default FatalJSONMsg renderer, it hand builds
+// the JSON (no marshaling) from the given error and any stored messages
+func defaultFatalJSONMsg(apiVer string, errMsg Msg) string {
+	// copy the stored msgs, the lock is not held while encoding them as that
+	// reads other settings (which lock as well)
+	mu.RLock()
+	noteMsg := storedNote
+	warnMsg := storedNonFatalWarning
+	fatalMsg := storedFatalError
+	mu.RUnlock()
+	noteMsgJSON := encodeMsgInRawJSON("note", noteMsg)
+	warnMsgJSON := encodeMsgInRawJSON("warning", warnMsg)
+	errMsgJSON := encodeMsgInRawJSON("error", errMsg)
+	// we really need an error, try global setting else fallback to unknown
+	if errMsgJSON == "" {
+		errMsgJSON = encodeMsgInRawJSON("error", fatalMsg)
+		if errMsgJSON == "" {
+			errMsg = UnknownFatalMsg()
+			errMsgJSON = encodeMsgInRawJSON("error", errMsg)
+		}
+	}
+	cmdError := -1
+	fields := []string{
+		fmt.Sprintf("\"apiVersion\":\"%s\"", EscapeJSONString([]byte(apiVer))),
+		fmt.Sprintf("\"id\": %d", cmdError),
+	}
+	for _, msgJSON := range []string{noteMsgJSON, warnMsgJSON, errMsgJSON} {
+		if msgJSON != "" {
+			fields = append(fields, msgJSON)
+		}
+	}
+	rawJSON := fmt.Sprintf("{ %s }", strings.Join(fields, ", "))
+	output, err := prettyMarshaledJSON([]byte(rawJSON))
+	if err != nil {
+		output = rawJSON
+	}
+	return output
+}
+
+// IncludeDataChecksum returns true if the JSON output has a data checksum
+func IncludeDataChecksum() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	include := includeDataChecksum
+	return include
+}
+
+// SetIncludeDataChecksum can be used to have the JSON output include a
+// "dataChecksum" next to the "data" section, the SHA-256 (in hex) of the
+// compact JSON of the data section, so a client can detect a response that
+// was truncated or corrupted in transport (see VerifyDataChecksum).  The
+// checksum doesn't depend on pretty printing.  Defaults to false.
+func SetIncludeDataChecksum(b bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	includeDataChecksum = b
+}
+
+// dataChecksum returns the checksum of the given compact data section JSON
+func dataChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyDataChecksum checks the "dataChecksum" in the given JSON response
+// (see SetIncludeDataChecksum) against its "data" section, true is returned
+// if they match.  An error is returned if the response can't be parsed or it
+// has no data section or checksum to verify.
+func VerifyDataChecksum(b []byte) (bool, error) {
+	var root map[string]json.RawMessage
+	if err := json.Unmarshal(bytes.TrimPrefix(b, []byte(utf8BOM)), &root); err != nil {
+		return false, err
+	}
+	data, found := root[schemaKey("data")]
+	if !found {
+		return false, fmt.Errorf("no data section in the JSON response")
+	}
+	var checksum string
+	if err := json.Unmarshal(root[schemaKey("dataChecksum")], &checksum); err != nil || checksum == "" {
+		return false, fmt.Errorf("no valid data checksum in the JSON response")
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, data); err != nil {
+		return false, err
+	}
+	return dataChecksum(compact.Bytes()) == checksum, nil
+}
+
+// GetJSONOutput takes the various things needed from a DVLN api call and
+// combines pertinent details into a JSON "results" string (pretty or not
+// depending upon settings) and returns that representation to the caller.
+// It will return a boolean indicating if a fatal occurred (if so the err
+// will be encoded in the JSON being returned already, print the string and
+// exit non-zero basically if you get false back in the boolean).  If no API
+// version is given the PKG_API_APIVER env var is tried, if that is also not
+// set (and missing versions are not allowed, see AllowMissingAPIVersion)
+// the "No valid JSON API version" error (1001) is the fatal error that is
+// returned (an invalid version can also be a fatal error, see
+// SetAPIVersionPattern).  That error takes precedence over any stored fatal
+// error (see SetStoredFatalError) but the stored error is not lost, it is
+// included as the cause of the API version error (see WrapMsg).
+func GetJSONOutput(apiVer string, context string, kind string, verbosity string, fields []string, items []interface{}) (string, bool) {
+	setItems := func(r *Response) {
+		r.SetAPIItems(kind, verbosity, fields, items)
+	}
+	return getJSONOutput(apiVer, context, setItems, false)
+}
+
+// GetKeyedJSONOutput is like GetJSONOutput but the items are returned in a
+// JSON object keyed by the value of the given keyField in each item rather
+// than in an array (see SetAPIItemsKeyed for how bad keys are handled)
+func GetKeyedJSONOutput(apiVer string, context string, kind string, keyField string, items []interface{}) (string, bool) {
+	setItems := func(r *Response) {
+		r.SetAPIItemsKeyed(kind, keyField, items)
+	}
+	return getJSONOutput(apiVer, context, setItems, false)
+}
+
+// getJSONOutput does the work for GetJSONOutput and the like, it renders the
+// JSON output (see renderJSONOutput), runs any output filters on it and
+// passes it to any output observer, if raw is true then the output is
+// compact regardless of JSONRaw()
+func getJSONOutput(apiVer string, context string, setItems func(*Response), raw bool) (string, bool) {
+	output, fatalErr := renderJSONOutput(apiVer, context, setItems, raw)
+	return postProcessOutput(context, output, fatalErr, withBOM), fatalErr
+}
+
+// postProcessOutput is what's done with all rendered JSON output before it is
+// returned (or written), the output filters are run (see SetOutputFilter),
+// then the optional wrap function (eg: to add the BOM, see withBOM) and the
+// result is given to any output observer (see SetOutputObserver)
+func postProcessOutput(context string, output string, fatalErr bool, wrap func(string) string) string {
+	output = filterOutput(output)
+	if wrap != nil {
+		output = wrap(output)
+	}
+	observeOutput(context, output, fatalErr)
+	return output
+}
+
+// withBOM returns the output with the UTF-8 BOM in front of it if it is to
+// be emitted (see SetEmitBOM)
+func withBOM(output string) string {
+	if EmitBOM() {
+		return utf8BOM + output
+	}
+	return output
+}
+
+// observeOutput passes the given JSON output to any output observer (see
+// SetOutputObserver)
+func observeOutput(context string, output string, fatalErr bool) {
+	mu.RLock()
+	observer := outputObserver
+	mu.RUnlock()
+	if observer != nil {
+		observer(context, output, fatalErr)
+	}
+}
+
+// jsonpCallback is the pattern a JSONP callback name must match, a JS
+// identifier optionally qualified by dotted identifiers (eg: "app.onData"),
+// so nothing but a function call can be injected into the page
+var jsonpCallback = regexp.MustCompile(`^[A-Za-z_$][0-9A-Za-z_$]*(?:\.[A-Za-z_$][0-9A-Za-z_$]*)*$`)
+
+// GetJSONPOutput is like GetJSONOutput but the JSON output is wrapped in a
+// call of the given JSONP callback, ie: "callback(<json>);", for browser
+// consumers that can only load responses as scripts.  Any output filters
+// are run on the JSON before it is wrapped (see SetOutputFilter).  The
+// callback name must be a (dotted) JS identifier, if it isn't then the
+// (fatal) "Invalid JSONP callback" error (1012) is returned as plain JSON,
+// unwrapped, and the boolean returned is true (as for any other fatal error).
+func GetJSONPOutput(callback string, apiVer string, context string, kind string, verbosity string, fields []string, items []interface{}) (string, bool) {
+	if !jsonpCallback.MatchString(callback) {
+		errMsg := NewMsg(fmt.Sprintf("Invalid JSONP callback name: %q\n", callback), 1012, "FATAL")
+		return postProcessOutput(context, FatalJSONMsg(apiVer, errMsg), true, withBOM), true
+	}
+	setItems := func(r *Response) {
+		r.SetAPIItems(kind, verbosity, fields, items)
+	}
+	output, fatalErr := renderJSONOutput(apiVer, context, setItems, false)
+	// the output filters see the JSON, the output observer the JSONP
+	wrap := func(output string) string {
+		return callback + "(" + strings.TrimRight(output, "\n") + ");\n"
+	}
+	return postProcessOutput(context, output, fatalErr, wrap), fatalErr
+}
+
+// GetJSONOutputRaw is like GetJSONOutput but the JSON output is always raw
+// (compact) for this call, regardless of the JSONRaw() setting (which is
+// left untouched, see SetJSONRaw)
+func GetJSONOutputRaw(apiVer string, context string, kind string, verbosity string, fields []string, items []interface{}) (string, bool) {
+	setItems := func(r *Response) {
+		r.SetAPIItems(kind, verbosity, fields, items)
+	}
+	return getJSONOutput(apiVer, context, setItems, true)
+}
+
+// GetJSONOutputWithSize is like GetJSONOutput but the size of the JSON
+// output in bytes (as written, including any BOM) is also returned, for
+// callers enforcing response size quotas or logging sizes (see
+// SetOutputObserver to track the size of all JSON output centrally).
+func GetJSONOutputWithSize(apiVer string, context string, kind string, verbosity string, fields []string, items []interface{}) (string, int, bool) {
+	output, fatalErr := GetJSONOutput(apiVer, context, kind, verbosity, fields, items)
+	return output, len(output), fatalErr
+}
+
+// GetItemsJSON returns just the given items as a top level JSON array (no
+// response envelope) formatted as per the current JSON settings (see
+// SetJSONRaw, SetJSONIndentLevel and the like), handy for tools like jq that
+// only want the data.  Items are transformed and durations rendered as with
+// SetAPIItems but no version, error, warning or note handling is done and no
+// stored msgs are used or stored, any failure is simply returned.
+func GetItemsJSON(items []interface{}) (string, error) {
+	items = convertItemDurations(transformItems(items))
+	if items == nil {
+		items = []interface{}{}
+	}
+	j, err := marshalJSON(items)
+	if err != nil {
+		return "", err
+	}
+	return prettyMarshaledJSON(j)
+}
+
+// BuildResponse builds the Response that GetJSONOutput would render (using
+// the same stored errors, warnings and notes and settings) but returns it as
+// is so it can be inspected or marshaled differently.  The boolean returned
+// is true if the Response has a fatal error.
+func BuildResponse(apiVer string, context string, kind string, verbosity string, fields []string, items []interface{}) (*Response, bool) {
+	setItems := func(r *Response) {
+		r.SetAPIItems(kind, verbosity, fields, items)
+	}
+	return buildResponse(apiVer, context, setItems)
+}
+
+// AsMap is like GetJSONOutput but the response is returned as a generic map
+// (keyed as the JSON would be, see SetKeyStyle) rather than marshaled, so it
+// can be embedded in a larger JSON document or post-processed without having
+// to parse the JSON back.  The data section is a map as well, its items (and
+// the note, warning and error Msgs) are left as is, they are rendered as
+// usual if the map is marshaled.  The boolean returned is true if a fatal
+// error occurred.
+func AsMap(apiVer string, context string, kind string, verbosity string, fields []string, items []interface{}) (map[string]interface{}, bool) {
+	setItems := func(r *Response) {
+		r.SetAPIItems(kind, verbosity, fields, items)
+	}
+	apiRoot, fatalErr := buildResponse(apiVer, context, setItems)
+	writeDiagnostics(apiRoot)
+	type responseAlias Response
+	if apiRoot.Data != nil && IncludeDataChecksum() {
+		if data, err := marshalJSON(apiRoot.Data); err == nil {
+			apiRoot.DataChecksum = dataChecksum(data)
+		}
 	}
-	if storedNonFatalWarning.Message != "" {
-		warnMsg = storedNonFatalWarning
+	apiRoot.Data = dataAsMap(apiRoot.Data)
+	if AlwaysEmitContext() {
+		return keyStyleMap(responseAlias(*apiRoot), "context"), fatalErr
 	}
-	if storedNote.Message != "" {
-		noteMsg = storedNote
+	return keyStyleMap(responseAlias(*apiRoot)), fatalErr
+}
+
+// dataAsMap returns the given data section as a generic map (see AsMap), a
+// data section of some other type is returned as is
+func dataAsMap(data interface{}) interface{} {
+	type itemsDataAlias itemsData
+	switch d := data.(type) {
+	case *itemsData:
+		if d.source != nil {
+			items := *d
+			if drained := drainItemSource(d.source); len(drained) > 0 {
+				items.Items = drained
+			}
+			d = &items
+		}
+		return keyStyleMap(itemsDataAlias(*d))
+	case *groupsData:
+		groups := make([]interface{}, 0, len(d.Groups))
+		for _, group := range d.Groups {
+			groups = append(groups, dataAsMap(group))
+		}
+		return map[string]interface{}{"groups": groups}
+	}
+	return data
+}
+
+// WriteTo writes the Response as JSON, followed by a newline, to the given
+// writer (implementing io.WriterTo so a Response can be handed to io.Copy
+// and the like).  The JSON is pretty printed or raw as per the current
+// settings (see SetJSONRaw), if pretty printing fails the raw JSON is written.
+// The number of bytes written is returned along with any marshal or write
+// error.  Unlike GetJSONOutput no stored msgs are added to the Response.
+func (r *Response) WriteTo(w io.Writer) (int64, error) {
+	j, err := marshalJSON(r)
+	if err != nil {
+		return 0, err
+	}
+	output, err := prettyMarshaledJSON(j)
+	if err != nil {
+		output = bytesToString(j)
+	}
+	output = strings.TrimRight(output, "\n") + "\n"
+	n, err := io.WriteString(w, output)
+	return int64(n), err
+}
+
+// combineMsgs returns the first Msg with the second one added after it (as
+// SetStoredNote would combine them), either may be empty
+func combineMsgs(first Msg, second Msg) Msg {
+	if second.Message == "" {
+		return first
+	}
+	if first.Message == "" {
+		return second
+	}
+	first.Message = joinMessages(first.Message, foldMsgCount(second).Message, MessageSeparator())
+	if first.Code == 0 {
+		first.Code = second.Code
+	}
+	return first
+}
+
+// EmptyResult returns the JSON output (see GetJSONOutput) for a successful
+// call that has no items of the given kind, eg: nothing matched a query, the
+// data section has an empty items array and a note with the given reason is
+// included (before any stored note) to tell the client why.  As with
+// GetJSONOutput the boolean returned is true if a fatal error occurred (eg:
+// a stored fatal error) in which case the reason is not included.
+func EmptyResult(apiVer string, context string, kind string, reason string) (string, bool) {
+	setItems := func(r *Response) {
+		r.SetAPIItems(kind, "", nil, nil)
+		// unlike SetAPIItems the (empty) items array is always included
+		r.Data.(*itemsData).Items = []interface{}{}
+		if reason != "" {
+			r.Note = NewMsg(reason, 0, string(LevelNote))
+		}
+	}
+	return getJSONOutput(apiVer, context, setItems, false)
+}
+
+// renderJSONOutput builds the response (see buildResponse), hands off its
+// diagnostics (see writeDiagnostics) and renders it into the JSON output
+// string (see renderResponse)
+func renderJSONOutput(apiVer string, context string, setItems func(*Response), raw bool) (string, bool) {
+	apiRoot, fatalErr := buildResponse(apiVer, context, setItems)
+	writeDiagnostics(apiRoot)
+	return renderResponse(apiRoot, fatalErr, raw)
+}
+
+// SetDiagnosticsWriter can be used to have the note, warning and diagnostics
+// of each JSON output generated via GetJSONOutput (and the like) written to
+// the given writer (eg: a CI archive file) as a single compact JSON line, ie:
+// {"context":..., "note":..., "warning":..., "diagnostics":[...]}, outputs
+// with none of these write nothing.  By default they are also left in the
+// JSON output, if divert is given as true they're left out of it instead so
+// the data envelope stays clean for a data pipeline.  Write errors are
+// ignored.  Use a nil writer to stop (the default).
+func SetDiagnosticsWriter(w io.Writer, divert ...bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	diagnosticsWriter = w
+	diagnosticsDivert = divert != nil && divert[0]
+}
+
+// diagnosticsLine is the JSON line written to the diagnostics writer
+type diagnosticsLine struct {
+	Context     string       `json:"context,omitempty"`
+	Note        interface{}  `json:"note,omitempty"`
+	Warning     interface{}  `json:"warning,omitempty"`
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty"`
+}
+
+// writeDiagnostics writes the note, warning and diagnostics of the given
+// Response to the diagnostics writer (if any) and strips them from the
+// Response if they're to be diverted (see SetDiagnosticsWriter)
+func writeDiagnostics(apiRoot *Response) {
+	mu.RLock()
+	w := diagnosticsWriter
+	divert := diagnosticsDivert
+	mu.RUnlock()
+	if w == nil || (apiRoot.Note == nil && apiRoot.Warning == nil && apiRoot.Diagnostics == nil) {
+		return
+	}
+	line := diagnosticsLine{apiRoot.Context, apiRoot.Note, apiRoot.Warning, apiRoot.Diagnostics}
+	if j, err := marshalJSON(&line); err == nil {
+		diagnosticsWriteMu.Lock()
+		w.Write(append(j, '\n'))
+		diagnosticsWriteMu.Unlock()
+	}
+	if divert {
+		apiRoot.Note = nil
+		apiRoot.Warning = nil
+		apiRoot.Diagnostics = nil
+	}
+}
+
+// checkAPIVersion returns the API version to use for a response (see
+// GetJSONOutput for how a missing version is handled) along with the fatal
+// error if it is missing or invalid, if store is true then the warning for
+// an invalid version that isn't fatal is stored (see SetAPIVersionPattern)
+func checkAPIVersion(apiVer string, store bool) (string, Msg) {
+	var errMsg Msg
+	if apiVer == "" {
+		// In case the API version couldn't be passed, last ditch try
+		apiVer = getenv("PKG_API_APIVER")
+		if apiVer == "" && !MissingAPIVersionAllowed() {
+			apiVer = "?.?"
+			errMsg.Message = "No valid JSON API version is available"
+			errMsg.Code = 1001
+			errMsg.Level = "FATAL"
+		}
+	} else if pattern, fatal := apiVersionCheck(); pattern != nil && !pattern.MatchString(apiVer) {
+		msg := fmt.Sprintf("Invalid JSON API version: %s (expected pattern: %s)\n", apiVer, pattern)
+		if fatal {
+			errMsg = NewMsg(msg, 1008, "FATAL")
+		} else if store {
+			SetStoredNonFatalWarning(NewMsg(msg, 1008, "ISSUE"))
+		}
+	}
+	return apiVer, errMsg
+}
+
+// pendingFatal returns the fatal error a response for the given API version
+// would have (an API version error or else the stored fatal error) and true
+// if there is one, for writers that stream items before the response is
+// built (see WriteSSE) to check up front, nothing is stored
+func pendingFatal(apiVer string) (Msg, bool) {
+	if _, errMsg := checkAPIVersion(apiVer, false); errMsg.Message != "" {
+		return errMsg, true
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	errMsg := storedFatalError
+	return errMsg, errMsg.Message != ""
+}
+
+// buildResponse builds the API "root" Response, the setItems func is used
+// to add the items into the 'data' section if there is no fatal error (it
+// may store warnings or notes, these are picked up after it runs)
+func buildResponse(apiVer string, context string, setItems func(*Response)) (*Response, bool) {
+	var warnMsg, noteMsg Msg
+	apiVer, errMsg := checkAPIVersion(apiVer, true)
+	fatalErr := errMsg.Message != ""
+	apiRoot := newAPIData(apiVer, context)
+	// precedence: an API version error (if any) wins since the response is
+	// busted without a version, any stored fatal becomes its cause
+	mu.RLock()
+	storedErrMsg := storedFatalError
+	mu.RUnlock()
+	if storedErrMsg.Message != "" {
+		if errMsg.Message == "" {
+			errMsg = storedErrMsg
+		} else {
+			errMsg = WrapMsg(errMsg, storedErrMsg)
+		}
+		fatalErr = true
 	}
 	if errMsg.Message == "" {
 		// if no errors so far then add in our items and 'data' details
-		apiRoot.SetAPIItems(kind, verbosity, fields, items)
+		apiRoot.SetID(StoredID())
+		setItems(apiRoot)
+		mu.RLock()
+		warnMsg = summarizeDropped(storedNonFatalWarning, droppedWarningCount, "warnings")
+		noteMsg = summarizeDropped(storedNote, droppedNoteCount, "notes")
+		mu.RUnlock()
+		if itemsNote, ok := apiRoot.Note.(Msg); ok {
+			// a note set along with the items (eg: about paging) comes first
+			noteMsg = combineMsgs(itemsNote, noteMsg)
+		}
+		mu.RLock()
+		warnMsg = mergeDefaultMsgs(warnMsg, defaultWarnings)
+		noteMsg = mergeDefaultMsgs(noteMsg, defaultNotes)
+		mu.RUnlock()
+		if DedupAcrossSeverities() && noteMsg.Message != "" && hasMessage(warnMsg.Message, noteMsg.Message, MessageSeparator()) {
+			noteMsg = Msg{}
+		}
 		if warnMsg.Message != "" {
-			apiRoot.Warning = warnMsg
+			apiRoot.Warning = truncateMsg(warnMsg)
 		}
 		if noteMsg.Message != "" {
-			apiRoot.Note = noteMsg
+			apiRoot.Note = truncateMsg(noteMsg)
 		}
 	} else {
 		// otherwise indicate issue and encode that into JSON
 		apiRoot.ID = -1
-		apiRoot.Error = errMsg
+		apiRoot.Error = truncateMsg(errMsg)
+		if IncludePartialDataOnFatal() {
+			setItems(apiRoot)
+			apiRoot.Note = nil
+		}
+	}
+	apiRoot.Diagnostics = Diagnostics()
+	apiRoot.Links = Links()
+	if IncludeRuntimeMeta() {
+		addRuntimeMeta(apiRoot)
+	}
+	if ErrorsOnly() {
+		// compact machine parsing mode, keep only the version, id and error
+		apiRoot = &Response{APIVersion: apiRoot.APIVersion, ID: apiRoot.ID, Error: apiRoot.Error}
 	}
-	j, err = json.Marshal(apiRoot)
+	return apiRoot, fatalErr
+}
+
+// renderResponse marshals the given Response into the JSON output string
+// (pretty or not depending upon settings, if raw is true it is never made
+// pretty), if marshaling fails then a hand built fatal JSON error is
+// returned (see FatalJSONMsg)
+func renderResponse(apiRoot *Response, fatalErr bool, raw bool) (string, bool) {
+	var errMsg, warnMsg Msg
+	var output, rawJSON string
+	apiVer := apiRoot.APIVersion
+	if fatalErr {
+		errMsg, _ = apiRoot.Error.(Msg)
+	}
+	j, err := marshalJSON(apiRoot)
 	if err != nil {
 		if errMsg.Message == "" {
 			errMsg.Message = "Unable to marshal basic JSON API string"
@@ -249,15 +1687,16 @@ func GetJSONOutput(apiVer string, context string, kind string, verbosity string,
 		rawJSON = FatalJSONMsg(apiVer, errMsg)
 		return rawJSON, fatalErr
 	}
+	if raw {
+		return bytesToString(j), fatalErr
+	}
 	// put in indentation and formatting, can turn that off as well
 	// if desired via the "jsonraw" globs (viper) setting
-	output, err = PrettyJSON(j)
+	output, err = prettyResponse(apiRoot, j)
 	if err != nil {
-		warnMsg.Message = fmt.Sprintf("Unable to beautify JSON output: %s", err)
-		warnMsg.Code = 1003
-		warnMsg.Level = "ISSUE"
+		warnMsg = beautifyWarning(err)
 		apiRoot.Warning = warnMsg
-		j, err = json.Marshal(apiRoot)
+		j, err = marshalJSON(apiRoot)
 		// if 1st marshal ok but pretty failed, add warning to JSON and if basic
 		// re-Marshal fails for any reason "bump" to a FATAL error, unlikely:
 		if err != nil {
@@ -268,11 +1707,284 @@ func GetJSONOutput(apiVer string, context string, kind string, verbosity string,
 			return rawJSON, fatalErr
 		}
 		// retry pretty probably won't work again, if not just use raw json
-		output, err = PrettyJSON(j)
+		output, err = prettyMarshaledJSON(j)
 		if err != nil {
-			output = cast.ToString(j)
+			output = bytesToString(j)
 		}
 	}
 	// Return the output (typically), fatalErr is false if we get to here
 	return output, fatalErr
 }
+
+// PrettyScope returns the part of the JSON output that is pretty printed
+func PrettyScope() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	scope := prettyScope
+	return scope
+}
+
+// SetPrettyScope can be used to choose which part of the JSON output from
+// GetJSONOutput (and the like) is pretty printed: PrettyScopeAll (the whole
+// response, the default), PrettyScopeEnvelope (the data section stays
+// compact, handy for big responses where the note, warning and error should
+// still be readable) or PrettyScopeData (the envelope stays compact).  This
+// has no effect if the JSON output is raw (see SetJSONRaw).
+func SetPrettyScope(scope string) {
+	mu.Lock()
+	defer mu.Unlock()
+	prettyScope = scope
+}
+
+// HeaderCompact returns true if the JSON output has a compact header line
+func HeaderCompact() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	compact := headerCompact
+	return compact
+}
+
+// SetHeaderCompact can be used to have GetJSONOutput (and the like) produce
+// a log oriented format: the first line is the response without its data
+// section as compact JSON (apiVersion, id, counts, any note, warning or error
+// and so on), for log systems that index the first line, and the following
+// lines are the pretty printed data section on its own.  Note that this is
+// NOT a single valid JSON document (it is two JSON values) so it should only
+// be used for logs, not for clients parsing the output.  This has no effect
+// if the JSON output is raw (see SetJSONRaw).  Defaults to false.
+func SetHeaderCompact(b bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	headerCompact = b
+}
+
+// headerCompactResponse formats the given response as a compact header line
+// followed by the pretty data section (see SetHeaderCompact)
+func headerCompactResponse(apiRoot *Response, j []byte) (string, error) {
+	envelope := *apiRoot
+	envelope.Data = nil
+	var data []byte
+	var err error
+	if apiRoot.Data != nil {
+		if data, err = marshalJSON(apiRoot.Data); err != nil {
+			return bytesToString(j), err
+		}
+		if IncludeDataChecksum() {
+			envelope.DataChecksum = dataChecksum(data)
+		}
+	}
+	env, err := marshalJSON(&envelope)
+	if err != nil {
+		return bytesToString(j), err
+	}
+	if data == nil {
+		return bytesToString(env) + "\n", nil
+	}
+	prettyData, err := prettyMarshaledJSON(data)
+	if err != nil {
+		return bytesToString(j), err
+	}
+	return bytesToString(env) + "\n" + prettyData, nil
+}
+
+// prettyResponse pretty prints the given marshaled response as per the
+// pretty scope (see SetPrettyScope), for a partial scope the envelope and
+// data section are formatted separately and the data is then put in place
+// (see SetHeaderCompact for the log oriented format)
+func prettyResponse(apiRoot *Response, j []byte) (string, error) {
+	if HeaderCompact() && !JSONRaw() {
+		return headerCompactResponse(apiRoot, j)
+	}
+	scope := PrettyScope()
+	if scope == PrettyScopeAll || apiRoot.Data == nil || JSONRaw() {
+		return prettyMarshaledJSON(j)
+	}
+	data, err := marshalJSON(apiRoot.Data)
+	if err != nil {
+		return bytesToString(j), err
+	}
+	envelope := *apiRoot
+	envelope.Data = prettyScopeToken
+	if IncludeDataChecksum() {
+		envelope.DataChecksum = dataChecksum(data)
+	}
+	env, err := marshalJSON(&envelope)
+	if err != nil {
+		return bytesToString(j), err
+	}
+	token := "\"" + prettyScopeToken + "\""
+	if scope == PrettyScopeData {
+		prettyData, err := prettyMarshaledJSON(data)
+		if err != nil {
+			return bytesToString(j), err
+		}
+		return strings.Replace(bytesToString(env), token, strings.TrimRight(prettyData, "\n"), 1), nil
+	}
+	prettyEnv, err := prettyMarshaledJSON(env)
+	if err != nil {
+		return bytesToString(j), err
+	}
+	return strings.Replace(prettyEnv, token, bytesToString(data), 1), nil
+}
+
+// GetJSONOutputURLSafe is like GetJSONOutput but the resulting JSON is made
+// compact and then base64url encoded (no padding) so it can be embedded as
+// is into a URL query parameter, use DecodeURLSafe() to get the JSON back.
+// As with GetJSONOutput the boolean returned is true if a fatal occurred.
+func GetJSONOutputURLSafe(apiVer string, context string, kind string, verbosity string, fields []string, items []interface{}) (string, bool) {
+	output, fatalErr := GetJSONOutput(apiVer, context, kind, verbosity, fields, items)
+	var out bytes.Buffer
+	j := []byte(strings.TrimPrefix(output, utf8BOM))
+	if err := json.Compact(&out, j); err == nil {
+		j = out.Bytes()
+	}
+	return base64.RawURLEncoding.EncodeToString(j), fatalErr
+}
+
+// DecodeURLSafe takes a string created by GetJSONOutputURLSafe() and turns
+// it back into the JSON it was created from (padded input is also accepted)
+func DecodeURLSafe(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// AutoFormatForTTY returns true if WriteJSONOutput only pretty prints JSON
+// when writing to a terminal
+func AutoFormatForTTY() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	auto := autoFormatForTTY
+	return auto
+}
+
+// SetAutoFormatForTTY can be used to have WriteJSONOutput detect if the
+// writer it is given is a terminal, if not (eg: output is piped or going to
+// a file) the JSON is written raw (compact) for that call, otherwise the
+// usual settings apply (see SetJSONRaw).  Defaults to false (the settings
+// always apply).
+func SetAutoFormatForTTY(b bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	autoFormatForTTY = b
+}
+
+// writerIsTerminal returns true if the given writer is a file that is a
+// terminal (character device)
+func writerIsTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// WriteJSONOutput is like GetJSONOutput but the JSON output, ending with a
+// single newline, is written to the given writer (eg: os.Stdout).  If auto format
+// is on (see SetAutoFormatForTTY) and the writer isn't a terminal then the
+// JSON is raw for this call.  The boolean returned is true if a fatal error
+// was encoded in the JSON, any write error is also returned.
+func WriteJSONOutput(w io.Writer, apiVer string, context string, kind string, verbosity string, fields []string, items []interface{}) (bool, error) {
+	return WriteJSONOutputContext(stdcontext.Background(), w, apiVer, context, kind, verbosity, fields, items)
+}
+
+// WriteJSONOutputContext is like WriteJSONOutput but the given ctx is checked
+// before the JSON output is built and again before it is written, if it is
+// done (eg: the client went away) then nothing is written and the ctx error
+// is returned (see ResponseStream.WriteContext to stream large responses)
+func WriteJSONOutputContext(ctx stdcontext.Context, w io.Writer, apiVer string, context string, kind string, verbosity string, fields []string, items []interface{}) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	setItems := func(r *Response) {
+		r.SetAPIItems(kind, verbosity, fields, items)
+	}
+	raw := AutoFormatForTTY() && !isTerminal(w)
+	output, fatalErr := getJSONOutput(apiVer, context, setItems, raw)
+	if err := ctx.Err(); err != nil {
+		return fatalErr, err
+	}
+	_, err := io.WriteString(w, strings.TrimRight(output, "\n")+"\n")
+	return fatalErr, err
+}
+
+// WriteJSONOutputToTempFile is like GetJSONOutput but the JSON output is
+// written to a new temp file (see os.CreateTemp for how the pattern is used)
+// instead of being returned.  The path to the temp file is returned and a
+// note is stored with the path (see SetStoredNote) so any JSON output that
+// follows (eg: a summary on stdout) tells the client where to find it.  The
+// boolean returned is true if a fatal error was encoded in the JSON.
+func WriteJSONOutputToTempFile(pattern string, apiVer string, context string, kind string, verbosity string, fields []string, items []interface{}) (string, bool, error) {
+	output, fatalErr := GetJSONOutput(apiVer, context, kind, verbosity, fields, items)
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", fatalErr, err
+	}
+	path := f.Name()
+	if _, err = f.WriteString(output); err != nil {
+		f.Close()
+		return path, fatalErr, err
+	}
+	if err = f.Close(); err != nil {
+		return path, fatalErr, err
+	}
+	SetStoredNote(NewMsg(fmt.Sprintf("JSON output written to file: %s\n", path), 0, string(LevelNote)))
+	return path, fatalErr, nil
+}
+
+// WriteJSONPages is like GetJSONOutput but the items are split into pages of
+// up to pageSize items, each page is written as a standalone JSON response
+// to its own file in the given dir named <baseName>-<page>.json (eg:
+// items-1.json, items-2.json) and the list of file paths is returned.  The
+// data section of each page has the totalItems of all pages (counting only
+// the items kept, see SetDropNilItems) along with its own startIndex and
+// currentItemCount and each page has a note about which page it is.  Each
+// page goes through any output filters and observer as for GetJSONOutput
+// and the API version, context, kind, verbosity and fields are used as they
+// are there.  Once written a note is stored with the dir and number of pages
+// (see SetStoredNote) for any JSON output that follows.  If a fatal error was
+// encoded in a page then no more pages are written and an error is returned
+// along with the paths written so far.
+func WriteJSONPages(dir string, baseName string, pageSize int, apiVer string, context string, kind string, verbosity string, fields []string, items []interface{}) ([]string, error) {
+	if pageSize <= 0 {
+		return nil, fmt.Errorf("invalid JSON page size %d, must be greater than 0", pageSize)
+	}
+	// items (and fields) are prepared once so the total only counts the items
+	// kept and any warnings are only stored once rather than for every page
+	fields = dedupeFields(fieldsForKind(kind, fields))
+	items = prepareItems(items)
+	total := len(items)
+	pages := (total + pageSize - 1) / pageSize
+	if pages == 0 {
+		pages = 1
+	}
+	var paths []string
+	for page := 1; page <= pages; page++ {
+		start := (page - 1) * pageSize
+		end := start + pageSize
+		if end > total {
+			end = total
+		}
+		setItems := func(r *Response) {
+			r.setPreparedItems(kind, verbosity, fields, items[start:end])
+			if data, ok := r.Data.(*itemsData); ok {
+				data.TotalItems = total
+				data.StartIndex = start + 1
+			}
+			r.Note = NewMsg(fmt.Sprintf("Page %d of %d (items %d-%d of %d)\n", page, pages, start+1, end, total), 0, string(LevelNote))
+		}
+		output, fatalErr := getJSONOutput(apiVer, context, setItems, false)
+		path := filepath.Join(dir, fmt.Sprintf("%s-%d.json", baseName, page))
+		if err := os.WriteFile(path, []byte(output), 0644); err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+		if fatalErr {
+			return paths, fmt.Errorf("fatal error encoded in JSON page %s", path)
+		}
+	}
+	SetStoredNote(NewMsg(fmt.Sprintf("JSON output written as %d pages of up to %d items to dir: %s\n", pages, pageSize, dir), 0, string(LevelNote)))
+	return paths, nil
+}
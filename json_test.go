@@ -16,9 +16,16 @@ package api
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -50,21 +57,21 @@ func checkResultOmits(t *testing.T, result string, check string) {
 // TestJSONIndentLevel to see if indent level set/get functions
 func TestJSONIndentLevel(t *testing.T) {
 	level := JSONIndentLevel()
-	if level != 2 {
-		t.Errorf("JSON default indent level was not 2 as expected, found: %d\n", level)
+	if level != DefaultJSONIndentLevel {
+		t.Errorf("JSON default indent level was not %d as expected, found: %d\n", DefaultJSONIndentLevel, level)
 	}
 	SetJSONIndentLevel(4)
 	level = JSONIndentLevel()
 	if level != 4 {
 		t.Errorf("JSON indent level was set to 4 but not found as 4, found: %d\n", level)
 	}
-	SetJSONIndentLevel(2)
+	SetJSONIndentLevel(DefaultJSONIndentLevel)
 }
 
 // TestJSONPrefix to see if JSON prefix text set/get functions ok
 func TestJSONPrefix(t *testing.T) {
 	prefix := JSONPrefix()
-	if prefix != "" {
+	if prefix != DefaultJSONPrefix {
 		t.Errorf("JSON default prefix was not \"\" as expected, found: \"%s\"\n", prefix)
 	}
 	SetJSONPrefix("  ")
@@ -72,13 +79,13 @@ func TestJSONPrefix(t *testing.T) {
 	if prefix != "  " {
 		t.Errorf("JSON prefix was just set to \"  \" but when checking it, found: \"%s\"\n", prefix)
 	}
-	SetJSONPrefix("")
+	SetJSONPrefix(DefaultJSONPrefix)
 }
 
 // TestJSONRaw to see if JSON raw or formatted output mode "setup" works...
 func TestJSONRaw(t *testing.T) {
 	raw := JSONRaw()
-	if raw != false {
+	if raw != DefaultJSONRaw {
 		t.Errorf("JSON \"raw\" output default was not \"false\" as expected, found: %v\n", raw)
 	}
 	SetJSONRaw(true)
@@ -86,7 +93,7 @@ func TestJSONRaw(t *testing.T) {
 	if raw != true {
 		t.Errorf("JSON \"raw\" was set to true but just found it currently set to \"%v\"\n", raw)
 	}
-	SetJSONRaw(false)
+	SetJSONRaw(DefaultJSONRaw)
 }
 
 // TestPrettyJSON to see if it does beautify some "raw" JSON
@@ -99,6 +106,32 @@ func TestPrettyJSON(t *testing.T) {
 	checkResultContains(t, results, "    \"message\": ")
 }
 
+// TestPrettyJSONBytes to see if the bytes match what PrettyJSON gives
+func TestPrettyJSONBytes(t *testing.T) {
+	results, err := PrettyJSONBytes(jsonSample)
+	if err != nil {
+		t.Errorf("Properly formatted JSON failed to be made pretty: %s", jsonSample)
+	}
+	expected, _ := PrettyJSON(jsonSample)
+	if string(results) != expected {
+		t.Errorf("PrettyJSONBytes and PrettyJSON differ, bytes:\n%s\nstring:\n%s", results, expected)
+	}
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	results, _ = PrettyJSONBytes(jsonSample)
+	if &results[0] != &jsonSample[0] {
+		t.Errorf("PrettyJSONBytes in raw mode should return the given bytes as is\n")
+	}
+}
+
+// BenchmarkPrettyJSONBytes to check the pretty printing allocations
+func BenchmarkPrettyJSONBytes(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		PrettyJSONBytes(jsonSample)
+	}
+}
+
 // TestEscapeJSONString to see if things like carriage return are escaped...
 func TestEscapeJSONString(t *testing.T) {
 	multiLineSample := []byte("This is a test\nthis is only a test\n")
@@ -106,6 +139,38 @@ func TestEscapeJSONString(t *testing.T) {
 	checkResultContains(t, string(results), ` test\u000athis `)
 }
 
+// TestEscapeJSONStringNoAlloc to see that nothing is allocated if no escaping
+// is needed and that quotes and backslashes are escaped
+func TestEscapeJSONStringNoAlloc(t *testing.T) {
+	plainSample := []byte("This is a test, this is only a test")
+	allocs := testing.AllocsPerRun(100, func() {
+		EscapeJSONString(plainSample)
+	})
+	if allocs != 0 {
+		t.Errorf("EscapeJSONString allocated %v times with nothing to escape, expected 0\n", allocs)
+	}
+	results := EscapeJSONString([]byte(`a "quoted" C:\path`))
+	checkResultContains(t, string(results), `a \u0022quoted\u0022 C:\u005cpath`)
+}
+
+// BenchmarkEscapeJSONStringNoEscape to check the no escape needed fast path
+func BenchmarkEscapeJSONStringNoEscape(b *testing.B) {
+	plainSample := []byte("This is a test, this is only a test, nothing to escape here")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		EscapeJSONString(plainSample)
+	}
+}
+
+// BenchmarkEscapeJSONString to check the escaping path
+func BenchmarkEscapeJSONString(b *testing.B) {
+	multiLineSample := []byte("This is a test\nthis is only a test\n")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		EscapeJSONString(multiLineSample)
+	}
+}
+
 // TestFatalJSONMsg to see if it correctly builds a JSON fatal message string
 func TestFatalJSONMsg(t *testing.T) {
 	fatalErr := Msg{
@@ -128,6 +193,416 @@ func TestFatalJSONMsg(t *testing.T) {
 	}
 }
 
+// TestFatalJSONMsgConcurrent to see if the fatal JSON can be built while the
+// stored msgs are being set (run with -race to check the locking)
+func TestFatalJSONMsgConcurrent(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			SetStoredNote(NewMsg("This is a note\n", 0, string(LevelNote)))
+			SetStoredNonFatalWarning(NewMsg("This is a warning\n", 2122, "ISSUE"))
+			SetStoredFatalError(NewMsg(fmt.Sprintf("fatal %d\n", i), 2121, "FATAL"))
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		var result interface{}
+		if output := FatalJSONMsg("0.1", Msg{}); json.Unmarshal([]byte(output), &result) != nil {
+			t.Errorf("FatalJSONMsg produced invalid JSON:\n%s", output)
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+// TestFatalJSONMsgSeparators to see if the hand built fatal JSON has the
+// right commas for the note only, warning only and all three msg mixes
+func TestFatalJSONMsgSeparators(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	note := NewMsg("This is a note\n", 0, "INFO")
+	warning := NewMsg("This is a warning\n", 2122, "WARNING")
+	fatalErr := NewMsg("This is a fatal error\n", 2121, "FATAL")
+	tests := []struct {
+		name     string
+		note     Msg
+		warning  Msg
+		contains []string
+		omits    []string
+	}{
+		{"note only", note, Msg{}, []string{`"id": -1, "note": {`, `}, "error": {`}, []string{`"warning"`}},
+		{"warning only", Msg{}, warning, []string{`"id": -1, "warning": {`, `}, "error": {`}, []string{`"note"`}},
+		{"all three", note, warning, []string{`"id": -1, "note": {`, `}, "warning": {`, `}, "error": {`}, nil},
+	}
+	for _, test := range tests {
+		resetStoredMsgs()
+		SetStoredNote(test.note)
+		SetStoredNonFatalWarning(test.warning)
+		output := FatalJSONMsg("0.1", fatalErr)
+		for _, str := range test.contains {
+			checkResultContains(t, output, str)
+		}
+		for _, str := range test.omits {
+			checkResultOmits(t, output, str)
+		}
+		checkResultOmits(t, output, ", ,")
+		checkResultOmits(t, output, ",  }")
+		var result interface{}
+		if err := json.Unmarshal([]byte(output), &result); err != nil {
+			t.Fatalf("FatalJSONMsg %s JSON is not valid, error: %s\n%s", test.name, err, output)
+		}
+	}
+}
+
+// TestGetItemsJSON to see if items are emitted as a bare top level array
+func TestGetItemsJSON(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	output, err := GetItemsJSON([]interface{}{"one", map[string]interface{}{"two": 2}})
+	if err != nil {
+		t.Fatalf("GetItemsJSON failed, error: %s\n", err)
+	}
+	if !strings.HasPrefix(output, "[\n") {
+		t.Fatalf("GetItemsJSON should return a pretty top level array, found:\n%s", output)
+	}
+	checkResultContains(t, output, `  "one",`)
+	checkResultContains(t, output, `    "two": 2`)
+	checkResultOmits(t, output, "apiVersion")
+	if storedNonFatalWarning.Message != "" || storedFatalError.Message != "" {
+		t.Fatalf("GetItemsJSON should not store any msgs\n")
+	}
+
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	output, err = GetItemsJSON(nil)
+	if err != nil || output != "[]" {
+		t.Fatalf("GetItemsJSON of no items should be [], found %q (error: %v)\n", output, err)
+	}
+	if _, err = GetItemsJSON([]interface{}{make(chan int)}); err == nil {
+		t.Fatalf("GetItemsJSON of an unmarshalable item should fail\n")
+	}
+}
+
+// TestResponseWriteTo to see if a Response can be written as an io.WriterTo
+func TestResponseWriteTo(t *testing.T) {
+	var resp io.WriterTo = NewResponse("0.1", "dvlnTest").SetAPIItems("test", "", nil, []interface{}{"one"})
+	var out bytes.Buffer
+	n, err := resp.WriteTo(&out)
+	if err != nil {
+		t.Fatalf("Response WriteTo failed, error: %s\n", err)
+	}
+	if n != int64(out.Len()) {
+		t.Errorf("Response WriteTo returned %d bytes written, wrote %d\n", n, out.Len())
+	}
+	output := out.String()
+	checkResultContains(t, output, "{\n  \"apiVersion\": \"0.1\",")
+	if !strings.HasSuffix(output, "}\n") || strings.HasSuffix(output, "\n\n") {
+		t.Errorf("Response WriteTo output should end with a single newline, found: %q\n", output)
+	}
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	out.Reset()
+	if _, err = resp.WriteTo(&out); err != nil {
+		t.Fatalf("Response WriteTo failed, error: %s\n", err)
+	}
+	checkResultContains(t, out.String(), `{"apiVersion":"0.1","context":"dvlnTest","id":0,`)
+	resp.(*Response).Metadata = make(chan int)
+	if _, err = resp.WriteTo(&out); err == nil {
+		t.Errorf("Response WriteTo of an unmarshalable Response should fail\n")
+	}
+}
+
+// TestWriteJSONOutput to see if output is pretty only for terminals when
+// auto formatting for TTYs is on
+func TestWriteJSONOutput(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	terminal := false
+	isTerminal = func(io.Writer) bool { return terminal }
+	defer func() { isTerminal = writerIsTerminal }()
+	var out bytes.Buffer
+	fatal, err := WriteJSONOutput(&out, "0.1", "dvlnTest", "test", "", nil, []interface{}{"one"})
+	if fatal || err != nil {
+		t.Fatalf("WriteJSONOutput failed, fatal: %t, error: %v\n", fatal, err)
+	}
+	checkResultContains(t, out.String(), "{\n  \"apiVersion\": \"0.1\",")
+	if !strings.HasSuffix(out.String(), "}\n") || strings.HasSuffix(out.String(), "\n\n") {
+		t.Errorf("WriteJSONOutput output should end with a single newline, found: %q\n", out.String())
+	}
+	SetAutoFormatForTTY(true)
+	defer SetAutoFormatForTTY(false)
+	out.Reset()
+	WriteJSONOutput(&out, "0.1", "dvlnTest", "test", "", nil, []interface{}{"one"})
+	checkResultContains(t, out.String(), `{"apiVersion":"0.1","context":"dvlnTest",`)
+	terminal = true
+	out.Reset()
+	WriteJSONOutput(&out, "0.1", "dvlnTest", "test", "", nil, []interface{}{"one"})
+	checkResultContains(t, out.String(), "{\n  \"apiVersion\": \"0.1\",")
+	if writerIsTerminal(&out) {
+		t.Errorf("A buffer should not be detected as a terminal\n")
+	}
+}
+
+// TestSetPrettyScope to see if only the chosen part of the output is pretty
+func TestSetPrettyScope(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	if scope := PrettyScope(); scope != PrettyScopeAll {
+		t.Errorf("Pretty scope default was not %q, found: %q\n", PrettyScopeAll, scope)
+	}
+	items := []interface{}{map[string]interface{}{"name": "one"}}
+	SetPrettyScope(PrettyScopeEnvelope)
+	defer SetPrettyScope(PrettyScopeAll)
+	output, _ := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, items)
+	checkResultContains(t, output, "{\n  \"apiVersion\": \"0.1\",\n")
+	checkResultContains(t, output, `  "data": {"kind":"test","totalItems":1,"startIndex":1,"currentItemCount":1,"items":[{"name":"one"}]}`)
+
+	SetPrettyScope(PrettyScopeData)
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, items)
+	checkResultContains(t, output, `{"apiVersion":"0.1","context":"dvlnTest","id":0,"data":{`+"\n")
+	checkResultContains(t, output, "\n  \"items\": [\n    {\n      \"name\": \"one\"\n    }\n  ]\n}}")
+
+	for _, scope := range []string{PrettyScopeEnvelope, PrettyScopeData} {
+		SetPrettyScope(scope)
+		output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, items)
+		var result interface{}
+		if err := json.Unmarshal([]byte(output), &result); err != nil {
+			t.Errorf("Pretty scope %q output is not valid JSON, error: %s\n%s", scope, err, output)
+		}
+	}
+}
+
+// TestSetHeaderCompact to see if the envelope is one compact line followed
+// by the pretty data section
+func TestSetHeaderCompact(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetHeaderCompact(true)
+	defer SetHeaderCompact(false)
+	items := []interface{}{map[string]string{"name": "one"}}
+	output, fatal := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, items)
+	if fatal {
+		t.Fatalf("GetJSONOutput indicated fatal, shouldn't have.  Output:\n%s", output)
+	}
+	expected := "{\"apiVersion\":\"0.1\",\"context\":\"dvlnTest\",\"id\":0}\n{\n  \"kind\": \"test\",\n  \"totalItems\": 1,"
+	if !strings.HasPrefix(output, expected) {
+		t.Errorf("Header compact output should start with:\n%s\nfound:\n%s", expected, output)
+	}
+	checkResultContains(t, output, "\n  \"items\": [\n    {\n      \"name\": \"one\"\n    }\n  ]\n}\n")
+
+	SetStoredFatalError(NewMsg("This is a fatal error\n", 2121, "FATAL"))
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, items)
+	if strings.Count(output, "\n") != 1 || !strings.Contains(output, `"id":-1,"error":{`) {
+		t.Errorf("Header compact output with no data should be a single line, found:\n%s", output)
+	}
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, items)
+	var result interface{}
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		t.Errorf("Raw output should ignore header compact, error: %s\n%s", err, output)
+	}
+}
+
+// TestAsMap to see if the response map marshals to the same JSON as the
+// JSON output
+func TestAsMap(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	SetStoredNote(NewMsg("Using cached index\n", 0, "INFO"))
+	items := []interface{}{map[string]string{"name": "one"}}
+	m, fatal := AsMap("0.1", "dvlnTest", "test", "", []string{"name"}, items)
+	if fatal {
+		t.Fatalf("AsMap indicated fatal, shouldn't have.  Map:\n%v", m)
+	}
+	if m["apiVersion"] != "0.1" || m["id"] != 0 {
+		t.Errorf("AsMap root fields not as expected, found: %v\n", m)
+	}
+	data, ok := m["data"].(map[string]interface{})
+	if !ok || data["totalItems"] != 1 || !reflect.DeepEqual(data["items"], items) {
+		t.Errorf("AsMap data section should be a map with the items as is, found: %v\n", m["data"])
+	}
+	if _, found := m["error"]; found {
+		t.Errorf("AsMap should omit empty fields, found: %v\n", m)
+	}
+	j, err := json.Marshal(map[string]interface{}{"result": m})
+	if err != nil {
+		t.Fatalf("Marshal of embedded AsMap failed, error: %s\n", err)
+	}
+	output, _ := GetJSONOutput("0.1", "dvlnTest", "test", "", []string{"name"}, items)
+	var embedded, expected interface{}
+	json.Unmarshal(j, &embedded)
+	json.Unmarshal([]byte(`{"result":`+output+`}`), &expected)
+	if !reflect.DeepEqual(embedded, expected) {
+		t.Errorf("Embedded AsMap mismatch, expected:\n%s\nfound:\n%s", output, j)
+	}
+
+	SetKeyStyle(KeyStyleSnake)
+	defer SetKeyStyle(KeyStyleCamel)
+	SetStoredFatalError(NewMsg("This is a fatal error\n", 2121, "FATAL"))
+	m, fatal = AsMap("0.1", "", "test", "", nil, items)
+	if !fatal || m["api_version"] != "0.1" || m["id"] != -1 || m["error"] == nil || m["data"] != nil {
+		t.Errorf("AsMap with a fatal error not as expected, found: %v\n", m)
+	}
+}
+
+// TestEmptyResult to see if a no items success response has the reason note
+func TestEmptyResult(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	SetStoredNote(NewMsg("Using cached index\n", 0, "INFO"))
+	output, fatal := EmptyResult("0.1", "dvlnTest", "pkg", "Nothing matched \"foo*\"\n")
+	if fatal {
+		t.Fatalf("EmptyResult indicated fatal, shouldn't have.  Output:\n%s", output)
+	}
+	checkResultContains(t, output, `"id":0,"note":{"message":"Nothing matched \"foo*\"\nUsing cached index\n","level":"NOTE"}`)
+	checkResultContains(t, output, `"data":{"kind":"pkg","startIndex":1,"items":[]}`)
+
+	SetStoredFatalError(NewMsg("This is a fatal error\n", 2121, "FATAL"))
+	SetIncludePartialDataOnFatal(true)
+	defer SetIncludePartialDataOnFatal(false)
+	output, fatal = EmptyResult("0.1", "dvlnTest", "pkg", "Nothing matched\n")
+	if !fatal {
+		t.Errorf("EmptyResult with a stored fatal error should be fatal\n")
+	}
+	checkResultOmits(t, output, "Nothing matched")
+}
+
+// TestGetJSONPOutput to see if the output is wrapped in the callback and
+// that bad callback names are rejected
+func TestGetJSONPOutput(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	items := []interface{}{map[string]string{"name": "one"}}
+	output, fatal := GetJSONPOutput("app.onData", "0.1", "dvlnTest", "test", "", nil, items)
+	if fatal {
+		t.Fatalf("GetJSONPOutput indicated fatal, shouldn't have.  Output:\n%s", output)
+	}
+	checkResultContains(t, output, `app.onData({"apiVersion":"0.1",`)
+	checkResultContains(t, output, `"items":[{"name":"one"}]}});`)
+
+	for _, callback := range []string{"", "1abc", "alert(1);x", "a..b", "a-b"} {
+		output, fatal = GetJSONPOutput(callback, "0.1", "dvlnTest", "test", "", nil, items)
+		if !fatal {
+			t.Errorf("GetJSONPOutput with callback %q should be fatal\n", callback)
+		}
+		checkResultContains(t, output, `"code": 1012`)
+		checkResultOmits(t, output, `"name": "one"`)
+		var result interface{}
+		if err := json.Unmarshal([]byte(output), &result); err != nil {
+			t.Errorf("Bad callback %q output is not plain JSON, error: %s\n%s", callback, err, output)
+		}
+	}
+
+	observed := ""
+	SetOutputObserver(func(context string, output string, fatal bool) { observed = output })
+	defer SetOutputObserver(nil)
+	SetOutputFilter(func(s string) string { return strings.Replace(s, `"one"`, `"uno"`, -1) })
+	defer SetOutputFilter()
+	output, _ = GetJSONPOutput("app.onData", "0.1", "dvlnTest", "test", "", nil, items)
+	checkResultContains(t, output, `app.onData({"apiVersion":"0.1",`)
+	checkResultContains(t, output, `"items":[{"name":"uno"}]}});`)
+	if observed != output {
+		t.Errorf("Output observer should see the filtered JSONP output, found:\n%s", observed)
+	}
+}
+
+// TestSetIncludeDataChecksum to see if the data checksum is included and
+// can be verified regardless of pretty printing
+func TestSetIncludeDataChecksum(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	items := []interface{}{map[string]string{"name": "<one>"}, map[string]int{"size": 2}}
+	output, _ := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, items)
+	checkResultOmits(t, output, "dataChecksum")
+	if _, err := VerifyDataChecksum([]byte(output)); err == nil {
+		t.Errorf("VerifyDataChecksum with no checksum should fail\n")
+	}
+	SetIncludeDataChecksum(true)
+	defer SetIncludeDataChecksum(false)
+	for _, raw := range []bool{false, true} {
+		SetJSONRaw(raw)
+		output, fatal := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, items)
+		SetJSONRaw(DefaultJSONRaw)
+		if fatal {
+			t.Fatalf("GetJSONOutput indicated fatal, shouldn't have.  Output:\n%s", output)
+		}
+		checkResultContains(t, output, "dataChecksum")
+		if ok, err := VerifyDataChecksum([]byte(output)); !ok || err != nil {
+			t.Errorf("VerifyDataChecksum (raw: %t) should match, error: %v\n%s", raw, err, output)
+		}
+		if err := ValidateAgainstSchema([]byte(output)); err != nil {
+			t.Errorf("Output with a data checksum should be valid, error: %s\n", err)
+		}
+		corrupt := strings.Replace(output, `"size"`, `"sizes"`, 1)
+		if ok, err := VerifyDataChecksum([]byte(corrupt)); ok || err != nil {
+			t.Errorf("VerifyDataChecksum of corrupted data should not match, error: %v\n", err)
+		}
+	}
+	SetPrettyScope(PrettyScopeEnvelope)
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, items)
+	SetPrettyScope(PrettyScopeAll)
+	if ok, err := VerifyDataChecksum([]byte(output)); !ok || err != nil {
+		t.Errorf("VerifyDataChecksum with a pretty scope should match, error: %v\n%s", err, output)
+	}
+	if _, err := VerifyDataChecksum([]byte(`{"data": {"items": [`)); err == nil {
+		t.Errorf("VerifyDataChecksum of truncated JSON should fail\n")
+	}
+}
+
+// TestSetDiagnosticsWriter to see if notes, warnings and diagnostics are
+// written as JSON lines and optionally left out of the JSON output
+func TestSetDiagnosticsWriter(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	var diags bytes.Buffer
+	SetDiagnosticsWriter(&diags)
+	defer SetDiagnosticsWriter(nil)
+	output, _ := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	if diags.Len() != 0 {
+		t.Errorf("Output with no notes or warnings should write no diagnostics, found: %q\n", diags.String())
+	}
+	SetStoredNote(NewMsg("Using cached index\n", 0, "INFO"))
+	SetStoredNonFatalWarning(NewMsg("This is a warning\n", 2122, "ISSUE"))
+	AddDiagnostic(LevelWarning, "unused field", "pkg.json:3")
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	expected := `{"context":"dvlnTest","note":{"message":"Using cached index\n","level":"INFO"},"warning":{"message":"This is a warning\n","code":2122,"level":"ISSUE"},"diagnostics":[{"level":"WARNING","message":"unused field","location":"pkg.json:3"}]}` + "\n"
+	if diags.String() != expected {
+		t.Errorf("Diagnostics line mismatch, expected:\n%s\nfound:\n%s", expected, diags.String())
+	}
+	checkResultContains(t, output, `"warning":{"message":"This is a warning\n"`)
+
+	diags.Reset()
+	SetDiagnosticsWriter(&diags, true)
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	if diags.String() != expected {
+		t.Errorf("Diverted diagnostics line mismatch, expected:\n%s\nfound:\n%s", expected, diags.String())
+	}
+	for _, key := range []string{`"note"`, `"warning"`, `"diagnostics"`} {
+		checkResultOmits(t, output, key)
+	}
+}
+
 // TestGetJSONOutput to see if it correctly builds a complete JSON response
 func TestGetJSONOutput(t *testing.T) {
 	fatalErr := NewMsg("This is a fatal error\n", 2121, "FATAL")
@@ -177,3 +652,777 @@ func TestGetJSONOutput(t *testing.T) {
 		t.Fatalf("Unable to unmarshal fatal JSON generated by GetJSONOutput(), error: %s\n", err)
 	}
 }
+
+// TestGetJSONOutputURLSafe to see if URL safe output round trips correctly
+func TestGetJSONOutputURLSafe(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	items := []interface{}{"one?", "two&", "<three>"}
+	output, fatal := GetJSONOutputURLSafe("0.1", "dvlnTest", "test", "", nil, items)
+	if fatal {
+		t.Fatalf("GetJSONOutputURLSafe indicated fatal, shouldn't have.  Output:\n%s", output)
+	}
+	if strings.ContainsAny(output, "+/=?& \n") {
+		t.Errorf("URL safe output contains characters unsafe for URLs: %s\n", output)
+	}
+	j, err := DecodeURLSafe(output)
+	if err != nil {
+		t.Fatalf("Unable to decode URL safe output, error: %s\n", err)
+	}
+	checkResultContains(t, string(j), `"context":"dvlnTest"`)
+	var result interface{}
+	if err = json.Unmarshal(j, &result); err != nil {
+		t.Fatalf("Unable to unmarshal JSON decoded by DecodeURLSafe(), error: %s\n", err)
+	}
+}
+
+// TestPrettyJSONCapped to see if pretty output is capped at the requested size
+func TestPrettyJSONCapped(t *testing.T) {
+	results, truncated, err := PrettyJSONCapped(jsonSample, 0)
+	if err != nil || truncated {
+		t.Errorf("Uncapped pretty JSON should not be truncated or fail, truncated: %v, err: %v", truncated, err)
+	}
+	checkResultContains(t, results, "    \"level\": \"ISSUE\"")
+	results, truncated, err = PrettyJSONCapped(jsonSample, 40)
+	if err != nil {
+		t.Errorf("Properly formatted JSON failed to be made pretty: %s", jsonSample)
+	}
+	if !truncated {
+		t.Errorf("Pretty JSON capped at 40 bytes should have been truncated, got:\n%s", results)
+	}
+	checkResultContains(t, results, "  \"id\": -1,\n... (truncated)\n")
+	checkResultOmits(t, results, "\"error\"")
+
+	big := []byte("[" + strings.Repeat(`{"name": "item"},`, 100000) + `{"name": "last"}]`)
+	results, truncated, err = PrettyJSONCapped(big, 100)
+	if err != nil || !truncated {
+		t.Errorf("Large pretty JSON capped at 100 bytes should be truncated, truncated: %v, err: %v", truncated, err)
+	}
+	if len(results) > 100+len("\n... (truncated)\n") {
+		t.Errorf("Pretty JSON capped at 100 bytes is too long (%d bytes):\n%s", len(results), results)
+	}
+	checkResultContains(t, results, "[\n  {\n    \"name\": \"item\"\n  },\n")
+	out := cappedBuffer{max: 100}
+	if err = indentJSON(&out, big, "", "  ", 0); err != errOutputCapped || out.Len() != 100 {
+		t.Errorf("Indenting into a 100 byte capped buffer should stop at the cap, len: %d, err: %v", out.Len(), err)
+	}
+	if _, _, err = PrettyJSONCapped([]byte(`{"id": 1,}`), 100); err == nil {
+		t.Errorf("Invalid JSON should fail to be made pretty when capped")
+	}
+}
+
+// TestSetHTMLSafe to see if HTML characters are escaped consistently
+func TestSetHTMLSafe(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	if !HTMLSafe() {
+		t.Errorf("JSON HTML safe default was not true as expected")
+	}
+	msg := "Bad </script> & more\n"
+	results := EscapeJSONString([]byte(msg))
+	checkResultContains(t, string(results), `Bad \u003c/script\u003e \u0026 more`)
+	output := FatalJSONMsg("0.1", NewMsg(msg, 2121, "FATAL"))
+	checkResultContains(t, output, `\u003c/script\u003e`)
+	SetStoredFatalError(NewMsg(msg, 2121, "FATAL"))
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	checkResultContains(t, output, `\u003c/script\u003e`)
+
+	SetHTMLSafe(false)
+	defer SetHTMLSafe(true)
+	results = EscapeJSONString([]byte(msg))
+	checkResultContains(t, string(results), `Bad </script> & more`)
+	output = FatalJSONMsg("0.1", NewMsg(msg, 2121, "FATAL"))
+	checkResultContains(t, output, `</script>`)
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	checkResultContains(t, output, `</script>`)
+}
+
+// TestWriteJSONOutputToTempFile to see if output is written and a note stored
+func TestWriteJSONOutputToTempFile(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	items := []interface{}{"one", "two", "three"}
+	path, fatal, err := WriteJSONOutputToTempFile("dvlnTest*.json", "0.1", "dvlnTest", "test", "", nil, items)
+	if err != nil {
+		t.Fatalf("WriteJSONOutputToTempFile failed, error: %s\n", err)
+	}
+	defer os.Remove(path)
+	if fatal {
+		t.Errorf("WriteJSONOutputToTempFile indicated fatal, shouldn't have")
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unable to read temp file %s, error: %s\n", path, err)
+	}
+	checkResultContains(t, string(contents), `      "one",`)
+	checkResultOmits(t, string(contents), `"note"`)
+	output, _ := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	checkResultContains(t, output, `    "message": "JSON output written to file: `+path)
+}
+
+// TestWriteJSONPages to see if items are split into standalone page files
+func TestWriteJSONPages(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	dir := t.TempDir()
+	if _, err := WriteJSONPages(dir, "items", 0, "0.1", "dvlnTest", "pkg", "", nil, nil); err == nil {
+		t.Errorf("WriteJSONPages with a page size of 0 should fail\n")
+	}
+	items := []interface{}{"one", "two", "three", "four", "five"}
+	paths, err := WriteJSONPages(dir, "items", 2, "0.1", "dvlnTest", "pkg", "full", nil, items)
+	if err != nil {
+		t.Fatalf("WriteJSONPages failed, error: %s\n", err)
+	}
+	if len(paths) != 3 || paths[2] != filepath.Join(dir, "items-3.json") {
+		t.Fatalf("WriteJSONPages should have written 3 pages, found: %v\n", paths)
+	}
+	var page Response
+	contents, _ := os.ReadFile(paths[1])
+	if err = json.Unmarshal(contents, &page); err != nil {
+		t.Fatalf("Page %s is not a valid response, error: %s\n", paths[1], err)
+	}
+	checkResultContains(t, string(contents), `    "message": "Page 2 of 3 (items 3-4 of 5)\n",`)
+	checkResultContains(t, string(contents), `    "totalItems": 5,`)
+	checkResultContains(t, string(contents), `    "startIndex": 3,`)
+	checkResultContains(t, string(contents), `    "currentItemCount": 2,`)
+	checkResultContains(t, string(contents), `      "three",`)
+	checkResultContains(t, string(contents), `  "context": "dvlnTest",`)
+	checkResultContains(t, string(contents), `    "kind": "pkg",`)
+	checkResultContains(t, string(contents), `    "verbosity": "full",`)
+	contents, _ = os.ReadFile(paths[2])
+	checkResultContains(t, string(contents), `    "currentItemCount": 1,`)
+	output, _ := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	checkResultContains(t, output, `    "message": "JSON output written as 3 pages of up to 2 items to dir: `+dir)
+
+	SetStoredFatalError(NewMsg("This is a fatal error\n", 2121, "FATAL"))
+	paths, err = WriteJSONPages(dir, "fatal", 2, "0.1", "dvlnTest", "pkg", "", nil, items)
+	if err == nil || len(paths) != 1 {
+		t.Errorf("WriteJSONPages with a fatal error should stop after one page, found: %v (error: %v)\n", paths, err)
+	}
+}
+
+// TestWriteJSONPagesDropped to see if the page totals only count the items
+// kept and if each page goes through the output filters and observer
+func TestWriteJSONPagesDropped(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetDropNilItems(true)
+	defer SetDropNilItems(false)
+	observed := 0
+	SetOutputObserver(func(context string, output string, fatal bool) { observed++ })
+	defer SetOutputObserver(nil)
+	SetOutputFilter(func(s string) string { return strings.Replace(s, `"three"`, `"tres"`, -1) })
+	defer SetOutputFilter()
+	dir := t.TempDir()
+	items := []interface{}{"one", nil, "two", nil, "three"}
+	paths, err := WriteJSONPages(dir, "items", 2, "0.1", "", "", "", nil, items)
+	if err != nil {
+		t.Fatalf("WriteJSONPages failed, error: %s\n", err)
+	}
+	if len(paths) != 2 || observed != 2 {
+		t.Fatalf("WriteJSONPages should have written (and observed) 2 pages, found: %v (observed: %d)\n", paths, observed)
+	}
+	contents, _ := os.ReadFile(paths[0])
+	checkResultContains(t, string(contents), `    "message": "Page 1 of 2 (items 1-2 of 3)\n",`)
+	checkResultContains(t, string(contents), `    "totalItems": 3,`)
+	checkResultContains(t, string(contents), `Nil items were dropped (2 dropped)`)
+	contents, _ = os.ReadFile(paths[1])
+	checkResultContains(t, string(contents), `    "totalItems": 3,`)
+	checkResultContains(t, string(contents), `    "currentItemCount": 1,`)
+	checkResultContains(t, string(contents), `"tres"`)
+
+	// fields are used on every page, duplicates are only warned about once
+	resetStoredMsgs()
+	items = []interface{}{map[string]int{"a": 1}, map[string]int{"a": 2}, map[string]int{"a": 3}}
+	if paths, err = WriteJSONPages(dir, "fields", 2, "0.1", "", "", "", []string{"a", "a"}, items); err != nil {
+		t.Fatalf("WriteJSONPages with fields failed, error: %s\n", err)
+	}
+	contents, _ = os.ReadFile(paths[1])
+	checkResultContains(t, string(contents), "\"fields\": [\n      \"a\"\n    ],")
+	checkResultContains(t, string(contents), `"message": "Duplicate fields dropped: a\n",`)
+}
+
+// TestSetDoubleEscapeGuard to see if re-escaping an escaped string is stable
+func TestSetDoubleEscapeGuard(t *testing.T) {
+	if DoubleEscapeGuard() {
+		t.Errorf("JSON double escape guard default was not false as expected")
+	}
+	sample := []byte("A \"quoted\" <tag> & C:\\path\nand more\\u00")
+	once := EscapeJSONString(sample)
+	twice := EscapeJSONString(once)
+	if string(once) == string(twice) {
+		t.Errorf("Without the guard re-escaping should have escaped backslashes, found: %s\n", twice)
+	}
+	SetDoubleEscapeGuard(true)
+	defer SetDoubleEscapeGuard(false)
+	once = EscapeJSONString(sample)
+	twice = EscapeJSONString(once)
+	if string(once) != string(twice) {
+		t.Errorf("Re-escaping with the guard was not stable, once: %s, twice: %s\n", once, twice)
+	}
+	checkResultContains(t, string(once), `C:\u005cpath\u000aand more\u005cu00`)
+	results := EscapeJSONString([]byte(`already \u0022escaped\u0022`))
+	checkResultContains(t, string(results), `already \u0022escaped\u0022`)
+	var result string
+	if err := json.Unmarshal([]byte(`"`+string(twice)+`"`), &result); err != nil || result != string(sample) {
+		t.Errorf("Escaped string did not decode back to the original, found: %q, err: %v\n", result, err)
+	}
+}
+
+// TestSetUnknownFatalMsg to see if the last ditch fatal message can be changed
+func TestSetUnknownFatalMsg(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	output := FatalJSONMsg("0.1", Msg{})
+	checkResultContains(t, output, `    "message": "Unknown Fatal Error (Coding Error?)",`)
+	checkResultContains(t, output, `    "level": "UNKNOWN"`)
+	defMsg := UnknownFatalMsg()
+	defer SetUnknownFatalMsg(defMsg)
+	SetUnknownFatalMsg(NewMsg("Erreur fatale inconnue", 9999, "INCONNU"))
+	output = FatalJSONMsg("0.1", Msg{})
+	checkResultContains(t, output, `    "message": "Erreur fatale inconnue",`)
+	checkResultContains(t, output, `    "code": 9999,`)
+	checkResultContains(t, output, `    "level": "INCONNU"`)
+}
+
+// TestSetIncludePartialDataOnFatal to see if items can come back with a fatal
+func TestSetIncludePartialDataOnFatal(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetStoredFatalError(NewMsg("This is a fatal error\n", 2121, "FATAL"))
+	items := []interface{}{"one", "two"}
+	output, fatal := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, items)
+	if !fatal {
+		t.Fatalf("GetJSONOutput had a fatal but didn't indicate it, output:\n%s", output)
+	}
+	checkResultOmits(t, output, `"items"`)
+	SetIncludePartialDataOnFatal(true)
+	defer SetIncludePartialDataOnFatal(false)
+	output, fatal = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, items)
+	if !fatal {
+		t.Fatalf("GetJSONOutput had a fatal but didn't indicate it, output:\n%s", output)
+	}
+	checkResultContains(t, output, `  "id": -1,`)
+	checkResultContains(t, output, `    "message": "This is a fatal error\n",`)
+	checkResultContains(t, output, `      "one",`)
+}
+
+// TestSetJSONAlignColons to see if values in each object are column aligned
+func TestSetJSONAlignColons(t *testing.T) {
+	if JSONAlignColons() {
+		t.Errorf("JSON align colons default was not false as expected")
+	}
+	SetJSONAlignColons(true)
+	defer SetJSONAlignColons(false)
+	sample := []byte(`{"apiVersion": "0.1", "id": 0, "data": {"kind": "test", "a\"bc": [{"x": 1, "longer": {}}, "s: {"]}}`)
+	results, err := PrettyJSON(sample)
+	if err != nil {
+		t.Fatalf("Properly formatted JSON failed to be made pretty: %s", sample)
+	}
+	checkResultContains(t, results, "  \"apiVersion\": \"0.1\",\n  \"id\":         0,\n  \"data\":       {\n")
+	checkResultContains(t, results, "    \"kind\":  \"test\",\n    \"a\\\"bc\": [\n")
+	checkResultContains(t, results, "        \"x\":      1,\n        \"longer\": {}\n")
+	checkResultContains(t, results, "      \"s: {\"\n")
+	results, err = PrettyJSON(sample, ">", "\t")
+	if err != nil {
+		t.Fatalf("Properly formatted JSON failed to be made pretty: %s", sample)
+	}
+	checkResultContains(t, results, ">\t\"id\":         0,\n")
+	var result interface{}
+	if err = json.Unmarshal([]byte(strings.Replace(results, ">", "", -1)), &result); err != nil {
+		t.Fatalf("Unable to unmarshal aligned JSON, error: %s\n", err)
+	}
+}
+
+// TestGetJSONOutputWithSize to see if the size matches the output bytes
+func TestGetJSONOutputWithSize(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	items := []interface{}{map[string]string{"name": "ünïcode"}}
+	output, size, fatal := GetJSONOutputWithSize("0.1", "dvlnTest", "test", "", nil, items)
+	if fatal {
+		t.Fatalf("GetJSONOutputWithSize indicated fatal, shouldn't have.  Output:\n%s", output)
+	}
+	if size != len([]byte(output)) || size <= len([]rune(output)) {
+		t.Errorf("GetJSONOutputWithSize size should be the byte length %d, found: %d\n", len(output), size)
+	}
+	SetEmitBOM(true)
+	defer SetEmitBOM(false)
+	if _, bomSize, _ := GetJSONOutputWithSize("0.1", "dvlnTest", "test", "", nil, items); bomSize != size+len(utf8BOM) {
+		t.Errorf("GetJSONOutputWithSize size should include the BOM, found: %d\n", bomSize)
+	}
+}
+
+// TestSetOutputFilter to see if the filters rewrite the output in order
+func TestSetOutputFilter(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	observed := ""
+	SetOutputObserver(func(context string, output string, fatal bool) { observed = output })
+	defer SetOutputObserver(nil)
+	SetOutputFilter(
+		func(s string) string { return strings.Replace(s, "http://old.example", "https://new.example", -1) },
+		nil,
+		func(s string) string { return s + "<!-- dvln -->" },
+	)
+	defer SetOutputFilter()
+	items := []interface{}{map[string]string{"url": "http://old.example/pkg"}}
+	output, _ := GetJSONOutput("0.1", "", "test", "", nil, items)
+	if !strings.HasSuffix(output, `"items":[{"url":"https://new.example/pkg"}]}}<!-- dvln -->`) {
+		t.Errorf("Output filters should be applied in order, found:\n%s", output)
+	}
+	if observed != output {
+		t.Errorf("Output observer should see the filtered output, found:\n%s", observed)
+	}
+	SetOutputFilter()
+	output, _ = GetJSONOutput("0.1", "", "test", "", nil, items)
+	checkResultContains(t, output, "http://old.example/pkg")
+	checkResultOmits(t, output, "<!--")
+}
+
+// TestSetOutputObserver to see if the observer sees every output produced
+func TestSetOutputObserver(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	var contexts, outputs []string
+	var fatals []bool
+	SetOutputObserver(func(context string, output string, fatal bool) {
+		contexts = append(contexts, context)
+		outputs = append(outputs, output)
+		fatals = append(fatals, fatal)
+	})
+	defer SetOutputObserver(nil)
+	output, _ := GetJSONOutput("0.1", "dvlnFirst", "test", "", nil, nil)
+	SetStoredFatalError(NewMsg("This is a fatal error\n", 2121, "FATAL"))
+	GetJSONOutput("0.1", "dvlnSecond", "test", "", nil, nil)
+	if len(contexts) != 2 {
+		t.Fatalf("Output observer should have been called twice, found: %d\n", len(contexts))
+	}
+	if contexts[0] != "dvlnFirst" || outputs[0] != output || fatals[0] {
+		t.Errorf("Output observer got unexpected args: %s, %v, %s\n", contexts[0], fatals[0], outputs[0])
+	}
+	if contexts[1] != "dvlnSecond" || !fatals[1] {
+		t.Errorf("Output observer got unexpected args: %s, %v\n", contexts[1], fatals[1])
+	}
+}
+
+// TestGetJSONOutputErrorPrecedence to see which fatal error wins when both
+// an API version problem and a stored fatal error exist
+func TestGetJSONOutputErrorPrecedence(t *testing.T) {
+	defer resetStoredMsgs()
+	defer func() { getenv = os.Getenv }()
+	storedErr := NewMsg("This is a stored fatal error", 2121, "FATAL")
+	tests := []struct {
+		apiVer    string
+		envVer    string
+		storedErr bool
+		fatal     bool
+		code      string
+		cause     bool
+	}{
+		{"0.1", "", false, false, "", false},
+		{"0.1", "", true, true, `    "code": 2121,`, false},
+		{"", "0.2", false, false, "", false},
+		{"", "0.2", true, true, `    "code": 2121,`, false},
+		{"", "", false, true, `    "code": 1001,`, false},
+		{"", "", true, true, `    "code": 1001,`, true},
+	}
+	for i, test := range tests {
+		resetStoredMsgs()
+		envVer := test.envVer
+		getenv = func(key string) string {
+			if key == "PKG_API_APIVER" {
+				return envVer
+			}
+			return ""
+		}
+		if test.storedErr {
+			SetStoredFatalError(storedErr)
+		}
+		output, fatal := GetJSONOutput(test.apiVer, "dvlnTest", "test", "", nil, nil)
+		if fatal != test.fatal {
+			t.Errorf("Test %d: expected fatal %v, found %v, output:\n%s", i, test.fatal, fatal, output)
+		}
+		if test.code != "" {
+			checkResultContains(t, output, test.code)
+		}
+		if test.cause {
+			checkResultContains(t, output, `        "message": "This is a stored fatal error",`)
+		} else {
+			checkResultOmits(t, output, `"causes"`)
+		}
+		if test.envVer != "" {
+			checkResultContains(t, output, `  "apiVersion": "0.2",`)
+		}
+	}
+}
+
+// TestBuildResponse to see if the response is built without being rendered
+func TestBuildResponse(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetStoredNote(NewMsg("This is a note\n", 0, "INFO"))
+	items := []interface{}{"one", "two", "three"}
+	resp, fatal := BuildResponse("0.1", "dvlnTest", "test", "verbose", []string{"name"}, items)
+	if fatal {
+		t.Fatalf("BuildResponse on note indicated fatal, shouldn't have")
+	}
+	if resp.APIVersion != "0.1" || resp.Context != "dvlnTest" || resp.ID != 0 {
+		t.Errorf("BuildResponse root fields not as expected, found: %+v\n", resp)
+	}
+	if note, ok := resp.Note.(Msg); !ok || note.Message != "This is a note\n" {
+		t.Errorf("BuildResponse note not as expected, found: %v\n", resp.Note)
+	}
+	data, ok := resp.Data.(*itemsData)
+	if !ok {
+		t.Fatalf("BuildResponse data not as expected, found: %T\n", resp.Data)
+	}
+	if data.Kind != "test" || data.CurrentItemCount != 3 {
+		t.Errorf("BuildResponse data block not as expected, found: %+v\n", data)
+	}
+	SetStoredFatalError(NewMsg("This is a fatal error\n", 2121, "FATAL"))
+	resp, fatal = BuildResponse("0.1", "dvlnTest", "test", "verbose", nil, items)
+	if !fatal || resp.ID != -1 || resp.Data != nil {
+		t.Errorf("BuildResponse with stored fatal not as expected, found: %+v\n", resp)
+	}
+}
+
+// TestWriteEscapedJSONString to see if streamed escaping matches EscapeJSONString
+func TestWriteEscapedJSONString(t *testing.T) {
+	samples := []string{
+		"",
+		"nothing to escape",
+		"This is a test\nthis is only a \"test\"\n",
+		"<tag> & C:\\path \u0022 \\u0022",
+	}
+	for _, guard := range []bool{false, true} {
+		SetDoubleEscapeGuard(guard)
+		for _, sample := range samples {
+			var out bytes.Buffer
+			n, err := WriteEscapedJSONString(&out, []byte(sample))
+			if err != nil {
+				t.Fatalf("WriteEscapedJSONString failed, error: %s\n", err)
+			}
+			expected := string(EscapeJSONString([]byte(sample)))
+			if out.String() != expected || n != len(expected) {
+				t.Errorf("WriteEscapedJSONString wrote %q (%d bytes), expected %q\n", out.String(), n, expected)
+			}
+		}
+	}
+	SetDoubleEscapeGuard(false)
+}
+
+// TestSetErrorsOnly to see if output is trimmed down to just errors
+func TestSetErrorsOnly(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetErrorsOnly(true)
+	defer SetErrorsOnly(false)
+	SetStoredNote(NewMsg("This is a note\n", 0, "INFO"))
+	items := []interface{}{"one", "two"}
+	output, fatal := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, items)
+	if fatal {
+		t.Fatalf("GetJSONOutput indicated fatal, shouldn't have.  Output:\n%s", output)
+	}
+	if output != "{\n  \"apiVersion\": \"0.1\",\n  \"id\": 0\n}\n" {
+		t.Errorf("Errors only success output not as expected, found:\n%s", output)
+	}
+	SetStoredFatalError(NewMsg("This is a fatal error\n", 2121, "FATAL"))
+	SetIncludePartialDataOnFatal(true)
+	defer SetIncludePartialDataOnFatal(false)
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, items)
+	checkResultContains(t, output, `  "id": -1,`)
+	checkResultContains(t, output, `    "message": "This is a fatal error\n",`)
+	checkResultOmits(t, output, `"context"`)
+	checkResultOmits(t, output, `"data"`)
+}
+
+// TestGetJSONOutputRaw to see if a single call can get raw JSON output
+func TestGetJSONOutputRaw(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	items := []interface{}{"one", "two"}
+	output, fatal := GetJSONOutputRaw("0.1", "dvlnTest", "test", "", nil, items)
+	if fatal {
+		t.Fatalf("GetJSONOutputRaw indicated fatal, shouldn't have.  Output:\n%s", output)
+	}
+	checkResultContains(t, output, `{"apiVersion":"0.1","context":"dvlnTest","id":0,`)
+	checkResultOmits(t, output, "\n")
+	if JSONRaw() {
+		t.Errorf("GetJSONOutputRaw should not change the JSON raw setting")
+	}
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, items)
+	checkResultContains(t, output, "{\n  \"apiVersion\": \"0.1\",\n")
+}
+
+// TestSetAPIVersionPattern to see if bad API versions are warned or fatal
+func TestSetAPIVersionPattern(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	defer SetAPIVersionPattern(nil)
+	SetAPIVersionPattern(regexp.MustCompile(`^\d+\.\d+$`))
+	output, fatal := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	if fatal {
+		t.Fatalf("GetJSONOutput indicated fatal on a good version.  Output:\n%s", output)
+	}
+	checkResultOmits(t, output, `"warning"`)
+	output, fatal = GetJSONOutput("v0.1-garbage", "dvlnTest", "test", "", nil, nil)
+	if fatal {
+		t.Fatalf("GetJSONOutput indicated fatal on a bad version warning.  Output:\n%s", output)
+	}
+	checkResultContains(t, output, `    "message": "Invalid JSON API version: v0.1-garbage (expected pattern: ^\\d+\\.\\d+$)\n",`)
+
+	resetStoredMsgs()
+	SetAPIVersionPattern(regexp.MustCompile(`^\d+\.\d+$`), true)
+	output, fatal = GetJSONOutput("garbage", "dvlnTest", "test", "", nil, nil)
+	if !fatal {
+		t.Fatalf("GetJSONOutput should be fatal on a bad version.  Output:\n%s", output)
+	}
+	checkResultContains(t, output, `    "code": 1008,`)
+}
+
+// TestPrettyJSONTrailingData to see if data after the JSON value is an error
+func TestPrettyJSONTrailingData(t *testing.T) {
+	sample := []byte(`{"a": 1}` + "\n" + `{"b": 2}`)
+	if _, err := PrettyJSON(sample); err == nil {
+		t.Errorf("PrettyJSON of concatenated JSON objects should have failed")
+	} else {
+		checkResultContains(t, err.Error(), `after top-level value`)
+	}
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	if _, err := PrettyJSON(sample); err == nil {
+		t.Errorf("Raw PrettyJSON of concatenated JSON objects should have failed")
+	} else {
+		checkResultContains(t, err.Error(), `at offset 9: "{\"b\": 2}"`)
+	}
+	if _, err := PrettyJSON([]byte(`[1, 2]` + "\n" + `]`)); err == nil {
+		t.Errorf("Raw PrettyJSON of an array with a trailing bracket should have failed")
+	} else {
+		checkResultContains(t, err.Error(), `at offset 7: "]"`)
+	}
+	for _, raw := range []bool{true, false} {
+		SetJSONRaw(raw)
+		if _, err := PrettyJSON([]byte(`{"a": 1}` + " \n\t")); err != nil {
+			t.Errorf("PrettyJSON (raw: %t) with trailing white space should not fail, error: %s\n", raw, err)
+		}
+	}
+}
+
+// FuzzFatalJSONMsg to see that the hand built JSON paths (FatalJSONMsg and
+// encodeMsgInRawJSON which use EscapeJSONString) always produce valid JSON
+func FuzzFatalJSONMsg(f *testing.F) {
+	f.Add("0.1", "This is a multiline\nfatal message\n", 2121, "FATAL", false)
+	f.Add("0.1", `a "quoted" C:\path \u0022 </script> &`, 0, "ISSUE", true)
+	f.Add(`"0.1"`, "\x00\x1f\x7f\xff", -1, `"level"\`, false)
+	f.Fuzz(func(t *testing.T, apiVer string, message string, code int, level string, guard bool) {
+		SetDoubleEscapeGuard(guard)
+		defer SetDoubleEscapeGuard(false)
+		escaped := EscapeJSONString([]byte(message))
+		var str string
+		if err := json.Unmarshal([]byte(`"`+string(escaped)+`"`), &str); err != nil {
+			t.Fatalf("EscapeJSONString(%q) produced an invalid JSON string %q, error: %s\n", message, escaped, err)
+		}
+		msg := WrapMsg(NewMsg(message, code, level), NewMsg(level, code, message))
+		output := FatalJSONMsg(apiVer, msg)
+		var result map[string]interface{}
+		if err := json.Unmarshal([]byte(output), &result); err != nil {
+			t.Fatalf("FatalJSONMsg(%q, %q, %d, %q) produced invalid JSON, error: %s\n%s", apiVer, message, code, level, err, output)
+		}
+	})
+}
+
+// TestSetEmitBOM to see if the UTF-8 BOM is added to the output when desired
+func TestSetEmitBOM(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	output, _ := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	if strings.HasPrefix(output, "\xef\xbb\xbf") {
+		t.Errorf("JSON output should not start with a BOM by default")
+	}
+	SetEmitBOM(true)
+	defer SetEmitBOM(false)
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	if !strings.HasPrefix(output, "\xef\xbb\xbf{\n") {
+		t.Errorf("JSON output should start with a BOM, found: %q\n", output)
+	}
+	output, _ = GetJSONOutputURLSafe("0.1", "dvlnTest", "test", "", nil, nil)
+	j, err := DecodeURLSafe(output)
+	if err != nil || bytes.HasPrefix(j, []byte("\xef\xbb\xbf")) {
+		t.Errorf("URL safe JSON output should never have a BOM, found: %q, err: %v\n", j, err)
+	}
+}
+
+// TestSetMaxJSONPrefixLen to see if an overly long prefix is an error
+func TestSetMaxJSONPrefixLen(t *testing.T) {
+	if length := MaxJSONPrefixLen(); length != DefaultMaxJSONPrefixLen {
+		t.Errorf("Max JSON prefix length default was not %d, found: %d\n", DefaultMaxJSONPrefixLen, length)
+	}
+	SetMaxJSONPrefixLen(4)
+	defer SetMaxJSONPrefixLen(DefaultMaxJSONPrefixLen)
+	if _, err := PrettyJSON(jsonSample, "1234"); err != nil {
+		t.Errorf("PrettyJSON with a prefix at the max length should not fail, error: %s\n", err)
+	}
+	results, err := PrettyJSON(jsonSample, "12345")
+	if err == nil {
+		t.Errorf("PrettyJSON with a prefix over the max length should fail")
+	}
+	if results != string(jsonSample) {
+		t.Errorf("PrettyJSON with a too long prefix should return the JSON as is, found: %s\n", results)
+	}
+	SetJSONPrefix("12345")
+	defer SetJSONPrefix(DefaultJSONPrefix)
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	output, fatal := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	if fatal {
+		t.Fatalf("GetJSONOutput indicated fatal, shouldn't have.  Output:\n%s", output)
+	}
+	checkResultContains(t, output, `"message":"Unable to beautify JSON output: JSON prefix length 5 exceeds the max allowed length of 4"`)
+}
+
+// TestSetMaxPrettyInputBytes to see if overly large input is not pretty printed
+func TestSetMaxPrettyInputBytes(t *testing.T) {
+	if size := MaxPrettyInputBytes(); size != 0 {
+		t.Errorf("Max pretty input bytes default was not unlimited, found: %d\n", size)
+	}
+	SetMaxPrettyInputBytes(len(jsonSample))
+	defer SetMaxPrettyInputBytes(0)
+	if _, err := PrettyJSON(jsonSample); err != nil {
+		t.Errorf("PrettyJSON with input at the max size should not fail, error: %s\n", err)
+	}
+	big := append([]byte(" "), jsonSample...)
+	results, err := PrettyJSON(big)
+	if err == nil {
+		t.Errorf("PrettyJSON with input over the max size should fail")
+	}
+	if results != string(big) {
+		t.Errorf("PrettyJSON with too big input should return the JSON as is, found: %s\n", results)
+	}
+	SetJSONRaw(true)
+	if _, err = PrettyJSON(big); err != nil {
+		t.Errorf("PrettyJSON in raw mode should not check the input size, error: %s\n", err)
+	}
+	SetJSONRaw(DefaultJSONRaw)
+	SetMaxPrettyInputBytes(10)
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	output, fatal := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, nil)
+	if fatal {
+		t.Fatalf("GetJSONOutput indicated fatal, shouldn't have.  Output:\n%s", output)
+	}
+	checkResultContains(t, output, `"code":1003`)
+	checkResultContains(t, output, `exceeds the max pretty print size of 10 bytes`)
+}
+
+// TestPrettyJSONSyntaxError to see if a syntax error says where it was found
+func TestPrettyJSONSyntaxError(t *testing.T) {
+	bad := []byte(`{"apiVersion": "0.1", "id": 0, "data": {"items": [1, 2,, 3]}, "links": {}}`)
+	for _, depth := range []int{0, 2} {
+		SetMaxPrettyDepth(depth)
+		_, err := PrettyJSON(bad)
+		SetMaxPrettyDepth(0)
+		var syntaxErr *json.SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Fatalf("PrettyJSON of bad JSON should give a syntax error, found: %v\n", err)
+		}
+		if !strings.Contains(err.Error(), `at offset 56 near "\": {\"items\": [1, 2,, 3]}, \"links\": {}}"`) {
+			t.Errorf("PrettyJSON syntax error should have the offset and snippet, found: %s\n", err)
+		}
+		warnMsg := beautifyWarning(err)
+		if warnMsg.Code != 1003 || warnMsg.Details["offset"] != int64(56) || warnMsg.Details["snippet"] == "" {
+			t.Errorf("Beautify warning should have the offset and snippet details, found: %+v\n", warnMsg)
+		}
+	}
+	if warnMsg := beautifyWarning(prefixLenError(5, 4)); warnMsg.Details != nil {
+		t.Errorf("Beautify warning for a non-syntax error should have no details, found: %+v\n", warnMsg)
+	}
+}
+
+// TestSetMaxPrettyDepth to see if JSON nested beyond the max depth is compact
+func TestSetMaxPrettyDepth(t *testing.T) {
+	if depth := MaxPrettyDepth(); depth != 0 {
+		t.Errorf("Max pretty depth default was not unlimited, found: %d\n", depth)
+	}
+	full, _ := PrettyJSON(jsonSample)
+	SetMaxPrettyDepth(100)
+	defer SetMaxPrettyDepth(0)
+	if results, err := PrettyJSON(jsonSample); err != nil || results != full {
+		t.Errorf("PrettyJSON with a max depth not reached should match json.Indent, error: %v\n%s", err, results)
+	}
+	nested := []byte(`{"a": {"b": {"c": [1, {"d": "x,{y}\\"}]}, "e": []}, "f": "g"}`)
+	SetMaxPrettyDepth(2)
+	results, err := PrettyJSON(nested)
+	if err != nil {
+		t.Fatalf("PrettyJSON with a max depth failed, error: %s\n", err)
+	}
+	expected := "{\n  \"a\": {\n    \"b\": {\"c\":[1,{\"d\":\"x,{y}\\\\\"}]},\n    \"e\": []\n  },\n  \"f\": \"g\"\n}\n"
+	if results != expected {
+		t.Errorf("PrettyJSON with a max depth of 2 gave:\n%s\nexpected:\n%s", results, expected)
+	}
+	if _, err = PrettyJSON([]byte(`{"a": [}`)); err == nil {
+		t.Errorf("PrettyJSON with a max depth and invalid JSON should fail\n")
+	}
+}
+
+// TestNormalizeJSON to see if oddly formatted JSON comes out in canonical form
+func TestNormalizeJSON(t *testing.T) {
+	messy := []byte("{\"apiVersion\":\"0.1\",\n\t\t\"id\":   -1,\n      \"error\": {\r\n\"message\" :\"a  b\"}}")
+	results, err := NormalizeJSON(messy)
+	if err != nil {
+		t.Fatalf("NormalizeJSON failed on valid JSON, error: %s\n", err)
+	}
+	expected := "{\n  \"apiVersion\": \"0.1\",\n  \"id\": -1,\n  \"error\": {\n    \"message\": \"a  b\"\n  }\n}\n"
+	if string(results) != expected {
+		t.Errorf("NormalizeJSON output not as expected, found:\n%q\n", results)
+	}
+	again, err := NormalizeJSON(results)
+	if err != nil || string(again) != expected {
+		t.Errorf("NormalizeJSON of normalized JSON should be unchanged, found:\n%q\n", again)
+	}
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	results, _ = NormalizeJSON(messy)
+	if string(results) != `{"apiVersion":"0.1","id":-1,"error":{"message":"a  b"}}` {
+		t.Errorf("NormalizeJSON in raw mode should be compact, found: %s\n", results)
+	}
+	if _, err = NormalizeJSON([]byte(`{"bad": `)); err == nil {
+		t.Errorf("NormalizeJSON should fail on invalid JSON")
+	}
+}
+
+// TestAllowMissingAPIVersion to see if an empty version can just be omitted
+func TestAllowMissingAPIVersion(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	defer func() { getenv = os.Getenv }()
+	getenv = func(string) string { return "" }
+	output, fatal := GetJSONOutput("", "dvlnTest", "test", "", nil, nil)
+	if !fatal {
+		t.Fatalf("GetJSONOutput with no API version should be fatal.  Output:\n%s", output)
+	}
+	AllowMissingAPIVersion(true)
+	defer AllowMissingAPIVersion(false)
+	output, fatal = GetJSONOutput("", "dvlnTest", "test", "", nil, nil)
+	if fatal {
+		t.Fatalf("GetJSONOutput with allowed missing API version indicated fatal.  Output:\n%s", output)
+	}
+	checkResultOmits(t, output, `"apiVersion"`)
+	checkResultContains(t, output, "{\n  \"context\": \"dvlnTest\",\n  \"id\": 0,")
+}
+
+// TestSetFatalRenderer to see if the fatal JSON can be rendered by the caller
+func TestSetFatalRenderer(t *testing.T) {
+	SetFatalRenderer(func(apiVer string, errMsg Msg) string {
+		return fmt.Sprintf(`{"version": %q, "failure": %q}`, apiVer, errMsg.Message)
+	})
+	output := FatalJSONMsg("0.1", NewMsg("This is fatal", 2121, "FATAL"))
+	if output != `{"version": "0.1", "failure": "This is fatal"}` {
+		t.Errorf("Custom fatal renderer output not as expected, found: %s\n", output)
+	}
+	SetFatalRenderer(nil)
+	output = FatalJSONMsg("0.1", NewMsg("This is fatal", 2121, "FATAL"))
+	checkResultContains(t, output, `    "message": "This is fatal",`)
+}
@@ -0,0 +1,197 @@
+// Copyright © 2016 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The dvln/api/keystyle.go module controls the casing of the keys used in
+// the API "root" and 'data' sections of the JSON (eg: "apiVersion" in the
+// default camelCase or "api_version" in snake_case).  Item keys are under
+// the callers control and are never touched.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// Key styles available for SetKeyStyle()
+const (
+	KeyStyleCamel = "camel" // eg: "apiVersion", "totalItems" (the default)
+	KeyStyleSnake = "snake" // eg: "api_version", "total_items"
+)
+
+var (
+	// keyStyle is the casing used for root and data section keys, one of
+	// the KeyStyle* values above (accessed under mutex from api.go)
+	keyStyle = KeyStyleCamel
+)
+
+// KeyStyle returns the current key style used for root and data section keys
+func KeyStyle() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	style := keyStyle
+	return style
+}
+
+// SetKeyStyle can be used to change the casing of the API root level keys
+// and the 'data' section keys, use KeyStyleCamel (the default, eg: the key
+// "apiVersion") or KeyStyleSnake (eg: "api_version").  Keys within items are
+// controlled by the caller and are never changed.
+func SetKeyStyle(style string) {
+	mu.Lock()
+	defer mu.Unlock()
+	keyStyle = style
+}
+
+// snakeCase converts a camelCase key to snake_case (eg: "apiVersion" becomes
+// "api_version" and "currentItemCount" becomes "current_item_count")
+func snakeCase(key string) string {
+	var out strings.Builder
+	for i, r := range key {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				out.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		out.WriteRune(r)
+	}
+	return out.String()
+}
+
+// MarshalJSON renders the Response as JSON using the current key style,
+// the context is included even if empty if desired (see SetAlwaysEmitContext)
+// and the data checksum is added, unless already set, if desired (see
+// SetIncludeDataChecksum)
+func (r Response) MarshalJSON() ([]byte, error) {
+	type responseAlias Response
+	if r.Data != nil && r.DataChecksum == "" && IncludeDataChecksum() {
+		data, err := marshalJSON(r.Data)
+		if err != nil {
+			return nil, err
+		}
+		r.Data = json.RawMessage(data)
+		r.DataChecksum = dataChecksum(data)
+	}
+	if AlwaysEmitContext() {
+		return marshalKeyStyle(responseAlias(r), "context")
+	}
+	return marshalKeyStyle(responseAlias(r))
+}
+
+// MarshalJSON renders the data section as JSON using the current key style
+func (d itemsData) MarshalJSON() ([]byte, error) {
+	type itemsDataAlias itemsData
+	if d.source != nil {
+		if items := drainItemSource(d.source); len(items) > 0 {
+			d.Items = items
+		}
+		d.source = nil
+	}
+	return marshalKeyStyle(itemsDataAlias(d))
+}
+
+// marshalKeyStyle marshals the given struct with its keys in the current key
+// style, for camelCase it is marshaled as is (the json tags are camelCase)
+// otherwise each field is marshaled in order with the key converted.  Any
+// keep fields given (by JSON name) are included even if empty (omitempty is
+// ignored for them).
+func marshalKeyStyle(v interface{}, keep ...string) ([]byte, error) {
+	snake := KeyStyle() == KeyStyleSnake
+	if !snake && keep == nil {
+		return marshalJSON(v)
+	}
+	rv := reflect.ValueOf(v)
+	rt := rv.Type()
+	var out bytes.Buffer
+	out.WriteByte('{')
+	first := true
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		tag := field.Tag.Get("json")
+		if field.PkgPath != "" || tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+		fv := rv.Field(i)
+		if strings.Contains(","+opts+",", ",omitempty,") && isEmptyValue(fv) && !keepField(keep, name) {
+			continue
+		}
+		if snake {
+			name = snakeCase(name)
+		}
+		key, err := marshalJSON(name)
+		if err != nil {
+			return nil, err
+		}
+		val, err := marshalJSON(fv.Interface())
+		if err != nil {
+			return nil, err
+		}
+		if !first {
+			out.WriteByte(',')
+		}
+		first = false
+		out.Write(key)
+		out.WriteByte(':')
+		out.Write(val)
+	}
+	out.WriteByte('}')
+	return out.Bytes(), nil
+}
+
+// keyStyleMap is like marshalKeyStyle but the fields of the given struct
+// are put in a map (keyed in the current key style) rather than marshaled,
+// the field values are left as is
+func keyStyleMap(v interface{}, keep ...string) map[string]interface{} {
+	snake := KeyStyle() == KeyStyleSnake
+	rv := reflect.ValueOf(v)
+	rt := rv.Type()
+	m := make(map[string]interface{}, rt.NumField())
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		tag := field.Tag.Get("json")
+		if field.PkgPath != "" || tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+		fv := rv.Field(i)
+		if strings.Contains(","+opts+",", ",omitempty,") && isEmptyValue(fv) && !keepField(keep, name) {
+			continue
+		}
+		if snake {
+			name = snakeCase(name)
+		}
+		m[name] = fv.Interface()
+	}
+	return m
+}
+
+// keepField returns true if the given field name is in the keep list
+func keepField(keep []string, name string) bool {
+	for _, k := range keep {
+		if k == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+// Copyright © 2016 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// TestSetKeyStyle to see if root and data keys can be made snake_case
+func TestSetKeyStyle(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	if style := KeyStyle(); style != KeyStyleCamel {
+		t.Errorf("Key style default was not %s, found: %s\n", KeyStyleCamel, style)
+	}
+	items := []interface{}{map[string]interface{}{"itemName": "one"}}
+	output, _ := GetJSONOutput("0.1", "dvlnTest", "test", "", nil, items)
+	checkResultContains(t, output, `  "apiVersion": "0.1",`)
+	checkResultContains(t, output, `    "totalItems": 1,`)
+
+	SetKeyStyle(KeyStyleSnake)
+	defer SetKeyStyle(KeyStyleCamel)
+	SetStoredNote(NewMsg("This is a note\n", 0, "INFO"))
+	output, _ = GetJSONOutput("0.1", "dvlnTest", "test", "", nil, items)
+	checkResultContains(t, output, "{\n  \"api_version\": \"0.1\",\n  \"context\": \"dvlnTest\",\n  \"id\": 0,\n  \"note\": {")
+	checkResultContains(t, output, `    "total_items": 1,`)
+	checkResultContains(t, output, `    "current_item_count": 1,`)
+	checkResultContains(t, output, `        "itemName": "one"`)
+	checkResultOmits(t, output, `"verbosity"`)
+	var result interface{}
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		t.Fatalf("Unable to unmarshal snake_case JSON, error: %s\n", err)
+	}
+}
+
+// TestSetAlwaysEmitContext to see if an empty context can be kept in the JSON
+func TestSetAlwaysEmitContext(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetJSONRaw(true)
+	defer SetJSONRaw(DefaultJSONRaw)
+	output, _ := GetJSONOutput("0.1", "", "", "", nil, nil)
+	checkResultOmits(t, output, `"context"`)
+	SetAlwaysEmitContext(true)
+	defer SetAlwaysEmitContext(false)
+	output, _ = GetJSONOutput("0.1", "", "", "", nil, nil)
+	checkResultContains(t, output, `{"apiVersion":"0.1","context":"","id":0,"data":{`)
+	checkResultOmits(t, output, `"note"`)
+	SetKeyStyle(KeyStyleSnake)
+	defer SetKeyStyle(KeyStyleCamel)
+	output, _ = GetJSONOutput("0.1", "", "", "", nil, nil)
+	checkResultContains(t, output, `{"api_version":"0.1","context":"","id":0,"data":{`)
+}
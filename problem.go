@@ -0,0 +1,90 @@
+// Copyright © 2016 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The dvln/api/problem.go module maps fatal errors onto the RFC 7807
+// "application/problem+json" format for REST clients and tooling that
+// expect that error shape.
+
+package api
+
+import (
+	"net/http"
+)
+
+// problemData is the RFC 7807 problem details structure, the apiVersion,
+// code and level members are extensions carrying our own Msg details
+type problemData struct {
+	Type       string `json:"type"`
+	Title      string `json:"title"`
+	Status     int    `json:"status"`
+	Detail     string `json:"detail,omitempty"`
+	Instance   string `json:"instance,omitempty"`
+	APIVersion string `json:"apiVersion,omitempty"`
+	Code       int    `json:"code,omitempty"`
+	Level      string `json:"level,omitempty"`
+}
+
+// msgHTTPStatus maps a Msg to an HTTP status code, codes that are already
+// HTTP error statuses (400-599) are used as is (the Msg code should be the
+// rendered code, see SetCodeOffset), otherwise an "ISSUE" level
+// maps to 400 (Bad Request) and anything else to 500 (Internal Server Error)
+func msgHTTPStatus(msg Msg) int {
+	if msg.Code >= 400 && msg.Code <= 599 {
+		return msg.Code
+	}
+	if msg.Level == "ISSUE" {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// GetProblemJSON returns the given fatal error as RFC 7807 problem details
+// JSON (for use with the "application/problem+json" content type).  The Msg
+// is mapped onto the problem "status" (see msgHTTPStatus for how), "title"
+// (the standard status text) and "detail" (the message) members and the
+// context is used as the "instance".  If the Msg has no message then the
+// stored fatal error (or the unknown fatal error) is used.  The boolean
+// returned is the fatal flag, as for GetJSONOutput, which is always true.
+func GetProblemJSON(apiVer string, context string, err Msg) (string, bool) {
+	if err.Message == "" {
+		mu.RLock()
+		err = storedFatalError
+		mu.RUnlock()
+		if err.Message == "" {
+			err = UnknownFatalMsg()
+		}
+	}
+	err = truncateMsg(err)
+	rendered := err
+	rendered.Code = renderedCode(err.Code)
+	status := msgHTTPStatus(rendered)
+	problem := problemData{
+		Type:       "about:blank",
+		Title:      http.StatusText(status),
+		Status:     status,
+		Detail:     err.Message,
+		Instance:   context,
+		APIVersion: apiVer,
+		Code:       rendered.Code,
+		Level:      err.Level,
+	}
+	j, jsonErr := marshalJSON(problem)
+	if jsonErr != nil {
+		return FatalJSONMsg(apiVer, err), true
+	}
+	output, jsonErr := prettyMarshaledJSON(j)
+	if jsonErr != nil {
+		output = string(j)
+	}
+	return output, true
+}
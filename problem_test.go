@@ -0,0 +1,63 @@
+// Copyright © 2016 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// TestGetProblemJSON to see if fatal errors map onto RFC 7807 problem JSON
+func TestGetProblemJSON(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	output, fatal := GetProblemJSON("0.1", "dvlnTest", NewMsg("Item not found", 404, "ISSUE"))
+	if !fatal {
+		t.Errorf("GetProblemJSON should always indicate fatal")
+	}
+	checkResultContains(t, output, `  "type": "about:blank",`)
+	checkResultContains(t, output, `  "title": "Not Found",`)
+	checkResultContains(t, output, `  "status": 404,`)
+	checkResultContains(t, output, `  "detail": "Item not found",`)
+	checkResultContains(t, output, `  "instance": "dvlnTest",`)
+	var result interface{}
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		t.Fatalf("Unable to unmarshal JSON generated by GetProblemJSON(), error: %s\n", err)
+	}
+
+	output, _ = GetProblemJSON("0.1", "dvlnTest", NewMsg("Bad subcommand", 2001, "ISSUE"))
+	checkResultContains(t, output, `  "status": 400,`)
+	checkResultContains(t, output, `  "code": 2001,`)
+	SetStoredFatalError(NewMsg("Stored fatal", 2121, "FATAL"))
+	output, _ = GetProblemJSON("0.1", "dvlnTest", Msg{})
+	checkResultContains(t, output, `  "status": 500,`)
+	checkResultContains(t, output, `  "detail": "Stored fatal",`)
+}
+
+// TestGetProblemJSONCodeOffset to see if the code offset is applied to the
+// problem code and to the code used for the HTTP status
+func TestGetProblemJSONCodeOffset(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetCodeOffset(400)
+	defer SetCodeOffset(0)
+	output, _ := GetProblemJSON("0.1", "dvlnTest", NewMsg("Item not found", 4, "ISSUE"))
+	checkResultContains(t, output, `  "title": "Not Found",`)
+	checkResultContains(t, output, `  "status": 404,`)
+	checkResultContains(t, output, `  "code": 404,`)
+	SetCodeOffset(2000)
+	output, _ = GetProblemJSON("0.1", "dvlnTest", NewMsg("Item not found", 404, "ISSUE"))
+	checkResultContains(t, output, `  "status": 400,`)
+	checkResultContains(t, output, `  "code": 2404,`)
+}
@@ -0,0 +1,315 @@
+// Copyright © 2016 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The dvln/api/schema.go module checks that a JSON API response has the
+// shape this package produces (beyond merely being parseable JSON) so that
+// clients and tests can assert responses are well formed.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// ValidateAgainstSchema checks that the given JSON is a well formed API
+// response: an object with an "apiVersion" string (unless missing versions
+// are allowed, see AllowMissingAPIVersion) and an integer "id", any "note",
+// "warning" and "error" must have the Msg shape (a "message" string, an
+// integer "code" as a number or string, a "codeString" string, a "level"
+// string or structured level object, a "details" object, "causes" Msgs and
+// an integer "count"), "diagnostics" must be Diagnostic objects and the
+// "data" section must have the items data shape.  Keys are expected in the
+// current key style (see SetKeyStyle).  The first problem found is returned
+// as an error, nil means the response is well formed.
+func ValidateAgainstSchema(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var root interface{}
+	if err := dec.Decode(&root); err != nil {
+		return fmt.Errorf("invalid API response: %s", err)
+	}
+	if dec.More() {
+		return fmt.Errorf("invalid API response: unexpected data after the response")
+	}
+	resp, ok := root.(map[string]interface{})
+	if !ok {
+		return schemaError("", "an object")
+	}
+	if _, found := resp[schemaKey("apiVersion")]; found || !MissingAPIVersionAllowed() {
+		if err := checkSchemaString(resp, "apiVersion", true); err != nil {
+			return err
+		}
+	}
+	for _, key := range []string{"context", "dataChecksum"} {
+		if err := checkSchemaString(resp, key, false); err != nil {
+			return err
+		}
+	}
+	if err := checkSchemaInt(resp, "", "id", true); err != nil {
+		return err
+	}
+	for _, flavor := range []string{"note", "warning", "error"} {
+		if msg, found := resp[schemaKey(flavor)]; found {
+			if err := checkSchemaMsg(flavor, msg); err != nil {
+				return err
+			}
+		}
+	}
+	if diags, found := resp[schemaKey("diagnostics")]; found {
+		if err := checkSchemaDiagnostics(diags); err != nil {
+			return err
+		}
+	}
+	if counts, found := resp[schemaKey("counts")]; found {
+		m, ok := counts.(map[string]interface{})
+		if !ok {
+			return schemaError("counts", "an object")
+		}
+		for kind := range m {
+			if err := checkSchemaInt(m, "counts", kind, true); err != nil {
+				return err
+			}
+		}
+	}
+	if data, found := resp[schemaKey("data")]; found {
+		if err := checkSchemaData("data", data); err != nil {
+			return err
+		}
+	}
+	if links, found := resp[schemaKey("links")]; found {
+		m, ok := links.(map[string]interface{})
+		if !ok {
+			return schemaError("links", "an object")
+		}
+		for rel, link := range m {
+			if _, ok := link.(string); !ok {
+				return schemaError("links."+rel, "a string")
+			}
+		}
+	}
+	return nil
+}
+
+// schemaKey returns the given (camelCase) key in the current key style
+func schemaKey(key string) string {
+	if KeyStyle() == KeyStyleSnake {
+		return snakeCase(key)
+	}
+	return key
+}
+
+// schemaError returns the error for a response member at the given path
+// that isn't what it should be
+func schemaError(path string, expected string) error {
+	if path == "" {
+		return fmt.Errorf("invalid API response: the response must be %s", expected)
+	}
+	return fmt.Errorf("invalid API response: %s must be %s", path, expected)
+}
+
+// schemaPath joins the given path and key into a path for error messages
+func schemaPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// checkSchemaString checks that the key in the given object is a string,
+// if required it must be present
+func checkSchemaString(m map[string]interface{}, key string, required bool) error {
+	key = schemaKey(key)
+	val, found := m[key]
+	if !found {
+		if required {
+			return fmt.Errorf("invalid API response: %s is required", key)
+		}
+		return nil
+	}
+	if _, ok := val.(string); !ok {
+		return schemaError(key, "a string")
+	}
+	return nil
+}
+
+// checkSchemaInt checks that the key in the given object (at the given path)
+// is an integer, if required it must be present
+func checkSchemaInt(m map[string]interface{}, path string, key string, required bool) error {
+	val, found := m[key]
+	if !found {
+		if required {
+			return fmt.Errorf("invalid API response: %s is required", schemaPath(path, key))
+		}
+		return nil
+	}
+	num, ok := val.(json.Number)
+	if !ok {
+		return schemaError(schemaPath(path, key), "an integer")
+	}
+	if _, err := strconv.Atoi(string(num)); err != nil {
+		return schemaError(schemaPath(path, key), "an integer")
+	}
+	return nil
+}
+
+// checkSchemaMsg checks that the value at the given path has the Msg shape
+func checkSchemaMsg(path string, val interface{}) error {
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return schemaError(path, "a message object")
+	}
+	if _, ok := m["message"].(string); !ok {
+		return schemaError(schemaPath(path, "message"), "a string")
+	}
+	if code, found := m["code"]; found {
+		if str, ok := code.(string); ok {
+			if _, err := strconv.Atoi(str); err != nil {
+				return schemaError(schemaPath(path, "code"), "an integer")
+			}
+		} else if err := checkSchemaInt(m, path, "code", false); err != nil {
+			return err
+		}
+	}
+	if codeString, found := m["codeString"]; found {
+		if _, ok := codeString.(string); !ok {
+			return schemaError(schemaPath(path, "codeString"), "a string")
+		}
+	}
+	if level, found := m["level"]; found {
+		if err := checkSchemaLevel(schemaPath(path, "level"), level); err != nil {
+			return err
+		}
+	}
+	if details, found := m["details"]; found {
+		if _, ok := details.(map[string]interface{}); !ok {
+			return schemaError(schemaPath(path, "details"), "an object")
+		}
+	}
+	if err := checkSchemaInt(m, path, "count", false); err != nil {
+		return err
+	}
+	if causes, found := m["causes"]; found {
+		list, ok := causes.([]interface{})
+		if !ok {
+			return schemaError(schemaPath(path, "causes"), "an array")
+		}
+		for i, cause := range list {
+			if err := checkSchemaMsg(fmt.Sprintf("%s.causes[%d]", path, i), cause); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkSchemaLevel checks that a Msg level is a string or a structured
+// level object (see SetStructuredLevels)
+func checkSchemaLevel(path string, level interface{}) error {
+	if _, ok := level.(string); ok {
+		return nil
+	}
+	m, ok := level.(map[string]interface{})
+	if !ok {
+		return schemaError(path, "a string or a level object")
+	}
+	if _, ok := m["name"].(string); !ok {
+		return schemaError(schemaPath(path, "name"), "a string")
+	}
+	return checkSchemaInt(m, path, "value", true)
+}
+
+// checkSchemaDiagnostics checks that the diagnostics are Diagnostic objects
+func checkSchemaDiagnostics(diags interface{}) error {
+	list, ok := diags.([]interface{})
+	if !ok {
+		return schemaError("diagnostics", "an array")
+	}
+	for i, diag := range list {
+		path := fmt.Sprintf("diagnostics[%d]", i)
+		m, ok := diag.(map[string]interface{})
+		if !ok {
+			return schemaError(path, "an object")
+		}
+		for _, key := range []string{"level", "message"} {
+			if _, ok := m[key].(string); !ok {
+				return schemaError(schemaPath(path, key), "a string")
+			}
+		}
+		if loc, found := m["location"]; found {
+			if _, ok := loc.(string); !ok {
+				return schemaError(schemaPath(path, "location"), "a string")
+			}
+		}
+	}
+	return nil
+}
+
+// checkSchemaData checks that the data section at the given path has the
+// items data shape (or holds groups of them, see AddAPIItemsGroup)
+func checkSchemaData(path string, data interface{}) error {
+	m, ok := data.(map[string]interface{})
+	if !ok {
+		return schemaError(path, "an object")
+	}
+	if fields, found := m["fields"]; found {
+		list, ok := fields.([]interface{})
+		if !ok {
+			return schemaError(schemaPath(path, "fields"), "an array of strings")
+		}
+		for _, field := range list {
+			if _, ok := field.(string); !ok {
+				return schemaError(schemaPath(path, "fields"), "an array of strings")
+			}
+		}
+	}
+	if groups, found := m["groups"]; found {
+		list, ok := groups.([]interface{})
+		if !ok {
+			return schemaError(schemaPath(path, "groups"), "an array")
+		}
+		for i, group := range list {
+			if err := checkSchemaData(fmt.Sprintf("%s.groups[%d]", path, i), group); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, key := range []string{"kind", "verbosity"} {
+		if val, found := m[key]; found {
+			if _, ok := val.(string); !ok {
+				return schemaError(schemaPath(path, key), "a string")
+			}
+		}
+	}
+	if sort, found := m["sort"]; found {
+		info, ok := sort.(map[string]interface{})
+		if !ok {
+			return schemaError(schemaPath(path, "sort"), "an object")
+		}
+		if _, ok := info["field"].(string); !ok {
+			return schemaError(schemaPath(path, "sort.field"), "a string")
+		}
+		if order := info["order"]; order != SortAscending && order != SortDescending {
+			return schemaError(schemaPath(path, "sort.order"), `"asc" or "desc"`)
+		}
+	}
+	for _, key := range []string{"totalItems", "startIndex", "currentItemCount"} {
+		if err := checkSchemaInt(m, path, schemaKey(key), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright © 2016 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestValidateAgainstSchema to see if our own output validates and that
+// malformed responses are caught
+func TestValidateAgainstSchema(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetStoredNote(NewMsg("This is a note\n", 0, "INFO"))
+	AddDiagnostic(LevelIssue, "This is a diagnostic", "file.go:10")
+	items := []interface{}{map[string]interface{}{"name": "one"}}
+	output, _ := GetJSONOutput("0.1", "dvlnTest", "test", "", []string{"name"}, items)
+	if err := ValidateAgainstSchema([]byte(output)); err != nil {
+		t.Errorf("GetJSONOutput output should validate, error: %s\nOutput:\n%s", err, output)
+	}
+	SetStoredFatalError(WrapMsg(NewMsg("Outer fatal\n", 2121, "FATAL"), NewMsg("Inner\n", 2122, "FATAL")))
+	output = FatalJSONMsg("0.1", Msg{})
+	if err := ValidateAgainstSchema([]byte(output)); err != nil {
+		t.Errorf("FatalJSONMsg output should validate, error: %s\nOutput:\n%s", err, output)
+	}
+
+	tests := []struct {
+		json     string
+		errMatch string
+	}{
+		{`[]`, "the response must be an object"},
+		{`{"id": 0}`, "apiVersion is required"},
+		{`{"apiVersion": 1, "id": 0}`, "apiVersion must be a string"},
+		{`{"apiVersion": "0.1"}`, "id is required"},
+		{`{"apiVersion": "0.1", "id": 1.5}`, "id must be an integer"},
+		{`{"apiVersion": "0.1", "id": 0} {}`, "unexpected data after the response"},
+		{`{"apiVersion": "0.1", "id": 0, "note": "hi"}`, "note must be a message object"},
+		{`{"apiVersion": "0.1", "id": -1, "error": {"code": 1}}`, "error.message must be a string"},
+		{`{"apiVersion": "0.1", "id": -1, "error": {"message": "x", "code": "abc"}}`, "error.code must be an integer"},
+		{`{"apiVersion": "0.1", "id": -1, "error": {"message": "x", "level": 4}}`, "error.level must be a string or a level object"},
+		{`{"apiVersion": "0.1", "id": -1, "error": {"message": "x", "causes": [{}]}}`, "error.causes[0].message must be a string"},
+		{`{"apiVersion": "0.1", "id": 0, "diagnostics": [{"level": "ISSUE"}]}`, "diagnostics[0].message must be a string"},
+		{`{"apiVersion": "0.1", "id": 0, "data": {"fields": [1]}}`, "data.fields must be an array of strings"},
+		{`{"apiVersion": "0.1", "id": 0, "data": {"totalItems": "1"}}`, "data.totalItems must be an integer"},
+		{`{"apiVersion": "0.1", "id": 0, "data": {"groups": [{"kind": 1}]}}`, "data.groups[0].kind must be a string"},
+		{`{"apiVersion": "0.1", "id": 0, "data": {"sort": {"field": "name", "order": "up"}}}`, `data.sort.order must be "asc" or "desc"`},
+		{`{"apiVersion": "0.1", "id": 0, "links": {"self": 1}}`, "links.self must be a string"},
+		{`{"apiVersion": "0.1", "id": 0, "error": {"message": "x", "code": "2121", "level": {"name": "FATAL", "value": 4}}}`, ""},
+	}
+	for _, test := range tests {
+		err := ValidateAgainstSchema([]byte(test.json))
+		if test.errMatch == "" {
+			if err != nil {
+				t.Errorf("ValidateAgainstSchema(%s) should pass, error: %s\n", test.json, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.errMatch) {
+			t.Errorf("ValidateAgainstSchema(%s) should fail with %q, error: %v\n", test.json, test.errMatch, err)
+		}
+	}
+
+	AllowMissingAPIVersion(true)
+	defer AllowMissingAPIVersion(false)
+	if err := ValidateAgainstSchema([]byte(`{"id": 0}`)); err != nil {
+		t.Errorf("ValidateAgainstSchema should allow a missing version when allowed, error: %s\n", err)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright © 2016 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.21
+// +build go1.21
+
+// The dvln/api/slog.go module maps Msg's onto log/slog attributes so stored
+// messages can be emitted as structured log records, it needs Go 1.21+ (for
+// log/slog) so it is only built with such toolchains.
+
+package api
+
+import (
+	"log/slog"
+	"strconv"
+)
+
+// LogAttrs returns the Msg as log/slog attributes (message, code, level and
+// any code string, details, causes and repeat count, the causes as a group
+// keyed by index) so it can be logged as a structured record, eg:
+//
+//	logger.LogAttrs(ctx, msg.SlogLevel(), "api message", msg.LogAttrs()...)
+func (m Msg) LogAttrs() []slog.Attr {
+	attrs := []slog.Attr{
+		slog.String("message", m.Message),
+		slog.Int("code", renderedCode(m.Code)),
+		slog.String("level", m.Level),
+	}
+	if m.CodeString != "" {
+		attrs = append(attrs, slog.String("codeString", m.CodeString))
+	}
+	if len(m.Details) != 0 {
+		attrs = append(attrs, slog.Any("details", m.Details))
+	}
+	if m.Count != 0 {
+		attrs = append(attrs, slog.Int("count", m.Count))
+	}
+	if len(m.Causes) != 0 {
+		causes := make([]slog.Attr, len(m.Causes))
+		for i, cause := range m.Causes {
+			causes[i] = slog.Attr{Key: strconv.Itoa(i), Value: cause.LogValue()}
+		}
+		attrs = append(attrs, slog.Attr{Key: "causes", Value: slog.GroupValue(causes...)})
+	}
+	return attrs
+}
+
+// LogValue implements slog.LogValuer so a Msg logged as a single attribute
+// (eg: slog.Any("msg", msg)) is rendered as a group of its LogAttrs
+func (m Msg) LogValue() slog.Value {
+	return slog.GroupValue(m.LogAttrs()...)
+}
+
+// SlogLevel maps the Msg level onto a log/slog level: FATAL is an error,
+// WARNING and ISSUE are warnings and anything else (eg: NOTE) is info
+func (m Msg) SlogLevel() slog.Level {
+	switch LevelSeverity(m.Level) {
+	case LevelSeverity(string(LevelFatal)):
+		return slog.LevelError
+	case LevelSeverity(string(LevelWarning)), LevelSeverity(string(LevelIssue)):
+		return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
@@ -0,0 +1,48 @@
+// Copyright © 2016 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.21
+// +build go1.21
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"testing"
+)
+
+// TestMsgLogAttrs to see if a Msg is logged as a structured slog record
+func TestMsgLogAttrs(t *testing.T) {
+	var out bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	msg := WrapMsg(NewMessage("Unable to save\n", WithCode(3003), WithLevel(LevelFatal)), NewMsg("Disk full\n", 3001, "FATAL"))
+	msg.Details = map[string]interface{}{"path": "/tmp"}
+	logger.LogAttrs(context.Background(), msg.SlogLevel(), "api message", msg.LogAttrs()...)
+	result := out.String()
+	checkResultContains(t, result, `"level":"ERROR"`)
+	checkResultContains(t, result, `"message":"Unable to save\n","code":3003,"level":"FATAL","details":{"path":"/tmp"}`)
+	checkResultContains(t, result, `"causes":{"0":{"message":"Disk full\n","code":3001,"level":"FATAL"}}`)
+
+	out.Reset()
+	logger.Info("api message", "msg", NewMsg("This is a note\n", 0, "NOTE"))
+	checkResultContains(t, out.String(), `"msg":{"message":"This is a note\n","code":0,"level":"NOTE"}`)
+
+	levels := map[string]slog.Level{"FATAL": slog.LevelError, "WARNING": slog.LevelWarn, "issue": slog.LevelWarn, "NOTE": slog.LevelInfo, "": slog.LevelInfo}
+	for level, expected := range levels {
+		if found := NewMsg("", 0, level).SlogLevel(); found != expected {
+			t.Errorf("Msg level %q should map to slog level %s, found %s\n", level, expected, found)
+		}
+	}
+}
@@ -0,0 +1,543 @@
+// Copyright © 2016 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The dvln/api/stream.go module is for writing (and reading back) streams
+// of independent API responses, one compact JSON response per line (ie:
+// newline delimited JSON, NDJSON), for batch or log style output.  Items
+// may also be pulled on demand from an ItemSource as a response is written
+// so large result sets need not be held in memory, or pushed to a browser
+// as Server-Sent Events (SSE) or as an HTTP body with the rest of the
+// response in HTTP trailers.  Progress updates for long operations can be
+// streamed ahead of the final response (see ProgressWriter).
+
+package api
+
+import (
+	"bytes"
+	stdcontext "context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// useNumber indicates if decoded numbers are kept as json.Number values
+	// (see SetUseNumber), accessed under mutex from api.go
+	useNumber = false
+)
+
+// UseNumber returns true if response decoding keeps numbers as json.Number
+func UseNumber() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	use := useNumber
+	return use
+}
+
+// SetUseNumber can be used to have responses decoded by a ResponseReader
+// keep numbers (eg: in items) as json.Number values rather than float64 so
+// they can be re-emitted exactly as received (no precision loss for large
+// integers).  Note that json.Number items given to SetAPIItems are always
+// emitted as is.  Defaults to false (as with the Go json package).
+func SetUseNumber(b bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	useNumber = b
+}
+
+// ItemSource supplies items on demand, Next returns the next item and true
+// or false once there are no more items
+type ItemSource interface {
+	Next() (interface{}, bool)
+}
+
+// SetAPIItemsSource is like SetAPIItems but the items are pulled from the
+// given source as the response is written to a ResponseStream (rather than
+// being held in memory up front).  Each item is run through any item
+// transformer (see SetItemTransformer) and durations are rendered as desired
+// (see SetDurationFormat) as it is pulled.  As the item count is not known
+// ahead of time the totalItems and currentItemCount fields are not emitted,
+// nor are max depth or field validation checks done (any warnings would come
+// too late to be included).  If the response is marshaled by other means
+// (eg: json.Marshal) the source is drained into memory first.
+func (r *Response) SetAPIItemsSource(kind string, verbosity string, fields []string, src ItemSource) *Response {
+	var data itemsData
+	data.Kind = kind
+	data.Verbosity = verbosity
+	data.Fields = dedupeFields(fieldsForKind(kind, fields))
+	data.StartIndex = 1
+	data.source = src
+	r.Data = &data
+	return r
+}
+
+// sourceItem returns the next item from the source, with any item transform
+// and duration rendering applied, and false once the source is exhausted
+func sourceItem(src ItemSource) (interface{}, bool) {
+	item, ok := src.Next()
+	if !ok {
+		return nil, false
+	}
+	return convertItemDurations(transformItems([]interface{}{item}))[0], true
+}
+
+// drainItemSource pulls all remaining items from the source into a slice
+func drainItemSource(src ItemSource) []interface{} {
+	items := []interface{}{}
+	for {
+		item, ok := sourceItem(src)
+		if !ok {
+			return items
+		}
+		items = append(items, item)
+	}
+}
+
+// sliceItemSource is an ItemSource handing out the items of a slice
+type sliceItemSource struct {
+	items []interface{}
+	next  int
+}
+
+// Next returns the next item of the slice
+func (s *sliceItemSource) Next() (interface{}, bool) {
+	if s.next >= len(s.items) {
+		return nil, false
+	}
+	s.next++
+	return s.items[s.next-1], true
+}
+
+// WriteSSE writes the given items as Server-Sent Events to the given writer
+// (typically an http.ResponseWriter), each item is sent as its own "data:"
+// event (compact JSON) as it is pulled (see SetAPIItemsSource for how items
+// are handled) and then a final "complete" event is sent carrying the JSON
+// response without the items, ie: the item counts along with any stored
+// note, warning or error and so on as GetJSONOutput would have them (for the
+// given API version, context and kind).  If a fatal error is known before the
+// first event (eg: no valid API version or a stored fatal error) then no
+// data events are sent, unless partial data is included on fatal errors (see
+// SetIncludePartialDataOnFatal), just the "complete" event with the error.
+// If a flusher is given (it may be nil) it is flushed after each event so
+// they are pushed to the client right away.  Each event's data goes through
+// any output filters and observer (see SetOutputFilter and
+// SetOutputObserver) as a separate output, no BOM is added.  The boolean
+// returned is true if a fatal error occurred, any write error is also
+// returned.
+func WriteSSE(w io.Writer, flusher http.Flusher, apiVer string, context string, kind string, items []interface{}) (bool, error) {
+	return WriteSSEContext(stdcontext.Background(), w, flusher, apiVer, context, kind, items)
+}
+
+// WriteSSEContext is like WriteSSE but the given ctx is checked before each
+// event is sent, if it is done (eg: the client went away) then no more
+// events are sent and the ctx error is returned
+func WriteSSEContext(ctx stdcontext.Context, w io.Writer, flusher http.Flusher, apiVer string, context string, kind string, items []interface{}) (bool, error) {
+	src := &sliceItemSource{items: items}
+	if _, fatal := pendingFatal(apiVer); fatal && !IncludePartialDataOnFatal() {
+		src.items = nil
+	}
+	count := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		item, ok := sourceItem(src)
+		if !ok {
+			break
+		}
+		j, err := marshalJSON(item)
+		if err != nil {
+			return false, err
+		}
+		event := postProcessOutput(context, string(j), false, nil)
+		if err = writeSSEEvent(w, flusher, "", []byte(event)); err != nil {
+			return false, err
+		}
+		count++
+	}
+	setItems := func(r *Response) {
+		r.Data = &itemsData{Kind: kind, TotalItems: count, StartIndex: 1, CurrentItemCount: count}
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	output, fatalErr := renderJSONOutput(apiVer, context, setItems, true)
+	output = postProcessOutput(context, output, fatalErr, nil)
+	return fatalErr, writeSSEEvent(w, flusher, "complete", []byte(output))
+}
+
+// HTTP trailers set by WriteHTTPStreamed
+const (
+	TrailerEnvelope = "X-Dvln-Api-Envelope" // the JSON response sans items
+	TrailerFatal    = "X-Dvln-Api-Fatal"    // "true" if a fatal error occurred
+)
+
+// WriteHTTPStreamed writes the given items as the HTTP response body, a JSON
+// array written (and flushed if the writer supports it) one item at a time
+// as it is pulled (see SetAPIItemsSource for how items are handled), so data
+// can be sent before the counts are known.  The JSON response without the
+// items (the item counts along with any stored note, warning or error and so
+// on as GetJSONOutput would have them) is then sent as compact JSON in the
+// TrailerEnvelope HTTP trailer and whether it has a fatal error in the
+// TrailerFatal trailer.  Each item and the envelope go through any output
+// filters and observer (see SetOutputFilter and SetOutputObserver) as
+// separate outputs.  If a fatal error is known before the body is written
+// (eg: no valid API version or a stored fatal error) then the HTTP status is
+// set from it (see msgHTTPStatus) and the items are only sent if partial
+// data is included on fatal errors (see SetIncludePartialDataOnFatal), the
+// body is otherwise an empty array.  The headers must not have been written
+// yet.  The boolean returned is true if a fatal error occurred, any write
+// error is also returned.
+func WriteHTTPStreamed(w http.ResponseWriter, apiVer string, context string, kind string, items []interface{}) (bool, error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Trailer", TrailerEnvelope+", "+TrailerFatal)
+	src := &sliceItemSource{items: items}
+	if errMsg, fatal := pendingFatal(apiVer); fatal {
+		if !IncludePartialDataOnFatal() {
+			src.items = nil
+		}
+		errMsg.Code = renderedCode(errMsg.Code)
+		w.WriteHeader(msgHTTPStatus(errMsg))
+	}
+	flusher, _ := w.(http.Flusher)
+	count := 0
+	delim := []byte{'['}
+	for {
+		item, ok := sourceItem(src)
+		if !ok {
+			break
+		}
+		j, err := marshalJSON(item)
+		if err != nil {
+			return false, err
+		}
+		j = []byte(postProcessOutput(context, string(j), false, nil))
+		if _, err = w.Write(append(delim, j...)); err != nil {
+			return false, err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		delim = []byte{','}
+		count++
+	}
+	if count == 0 {
+		delim = []byte("[]")
+	} else {
+		delim = []byte{']'}
+	}
+	if _, err := w.Write(append(delim, '\n')); err != nil {
+		return false, err
+	}
+	setItems := func(r *Response) {
+		r.Data = &itemsData{Kind: kind, TotalItems: count, StartIndex: 1, CurrentItemCount: count}
+	}
+	output, fatalErr := renderJSONOutput(apiVer, context, setItems, true)
+	output = postProcessOutput(context, output, fatalErr, nil)
+	w.Header().Set(TrailerEnvelope, output)
+	w.Header().Set(TrailerFatal, strconv.FormatBool(fatalErr))
+	return fatalErr, nil
+}
+
+// writeSSEEvent writes a single Server-Sent Event with the given data (each
+// line of data gets its own "data:" line), the event line is skipped if no
+// event name is given
+func writeSSEEvent(w io.Writer, flusher http.Flusher, event string, data []byte) error {
+	var buf bytes.Buffer
+	if event != "" {
+		buf.WriteString("event: " + event + "\n")
+	}
+	for _, line := range bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// ResponseStream writes API responses to an underlying writer as NDJSON,
+// one compact JSON response per line, it is safe for concurrent use
+type ResponseStream struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewResponseStream creates a ResponseStream writing to the given writer
+func NewResponseStream(w io.Writer) *ResponseStream {
+	return &ResponseStream{w: w}
+}
+
+// Write marshals the given response as compact JSON and writes it to the
+// stream followed by a newline, if the response items come from an
+// ItemSource (see SetAPIItemsSource) they are pulled and written one at a
+// time as the response is written
+func (s *ResponseStream) Write(resp *Response) error {
+	return s.WriteContext(stdcontext.Background(), resp)
+}
+
+// WriteContext is like Write but the given context is checked before the
+// response is written and between items pulled from an ItemSource, if it is
+// done (eg: the client went away) then nothing more is pulled or written and
+// the context error is returned (a partly written response is not closed)
+func (s *ResponseStream) WriteContext(ctx stdcontext.Context, resp *Response) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if data, ok := resp.Data.(*itemsData); ok && data.source != nil {
+		return s.writeSourced(ctx, resp, data)
+	}
+	j, err := marshalJSON(resp)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(j, '\n'))
+	return err
+}
+
+// writeSourced writes the response with the items pulled from the data
+// source as they are written, the envelope and data fields are marshaled
+// as usual (apart from the msg messages, see writeHead) and the items array
+// (if there are any items) is appended to the data section last
+func (s *ResponseStream) writeSourced(ctx stdcontext.Context, resp *Response, data *itemsData) error {
+	envelope := *resp
+	envelope.Data = nil
+	messages := envelopeMessages(&envelope)
+	head, err := marshalJSON(&envelope)
+	if err != nil {
+		return err
+	}
+	dataFields := *data
+	dataFields.source = nil
+	dataHead, err := marshalJSON(&dataFields)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var buf bytes.Buffer
+	pulled := false
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		item, ok := sourceItem(data.source)
+		if !ok {
+			break
+		}
+		j, err := marshalJSON(item)
+		if err != nil {
+			return err
+		}
+		if pulled {
+			buf.WriteByte(',')
+		} else {
+			if err = s.writeHead(head, messages); err != nil {
+				return err
+			}
+			buf.Write(openJSONObject(dataHead))
+			buf.WriteString(`"items":[`)
+			pulled = true
+		}
+		buf.Write(j)
+		if _, err = s.w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		buf.Reset()
+	}
+	if pulled {
+		buf.WriteString("]}}\n")
+	} else {
+		if err = s.writeHead(head, messages); err != nil {
+			return err
+		}
+		// no items, as with SetAPIItems the "items" key is left out
+		buf.Write(dataHead)
+		buf.WriteString("}\n")
+	}
+	_, err = s.w.Write(buf.Bytes())
+	return err
+}
+
+// msgSentinel stands in for the message of each envelope msg when the
+// envelope is marshaled by writeSourced (see envelopeMessages)
+const msgSentinel = "\x00dvlnMsg\x00"
+
+// envelopeMessages replaces the message of each msg in the given envelope
+// (the note, warning and error) with msgSentinel and returns the messages
+// replaced in order so they can be streamed in its place (see writeHead)
+// rather than copied into the marshaled envelope
+func envelopeMessages(envelope *Response) []string {
+	var messages []string
+	for _, field := range []*interface{}{&envelope.Note, &envelope.Warning, &envelope.Error} {
+		msg, ok := (*field).(Msg)
+		if ptr, isPtr := (*field).(*Msg); isPtr && ptr != nil {
+			msg, ok = *ptr, true
+		}
+		if !ok {
+			continue
+		}
+		if MsgSchemaVersion() == MsgSchemaLegacy {
+			// the count is folded into the message (see legacyMsg)
+			msg = foldMsgCount(msg)
+		}
+		messages = append(messages, msg.Message)
+		msg.Message = msgSentinel
+		*field = msg
+	}
+	return messages
+}
+
+// writeHead writes the given marshaled envelope (see writeSourced) without
+// its closing brace and followed by the "data" key, the given messages are
+// streamed in place of the sentinels (see WriteEscapedJSONString)
+func (s *ResponseStream) writeHead(head []byte, messages []string) error {
+	sentinel, err := marshalJSON(msgSentinel)
+	if err != nil {
+		return err
+	}
+	chunks := bytes.Split(openJSONObject(head), sentinel)
+	if len(chunks) != len(messages)+1 {
+		return fmt.Errorf("unable to stream the envelope msgs, found %d of %d", len(chunks)-1, len(messages))
+	}
+	for i, chunk := range chunks {
+		if _, err = s.w.Write(chunk); err != nil {
+			return err
+		}
+		if i == len(messages) {
+			break
+		}
+		if _, err = io.WriteString(s.w, `"`); err != nil {
+			return err
+		}
+		if _, err = WriteEscapedJSONString(s.w, []byte(messages[i])); err != nil {
+			return err
+		}
+		if _, err = io.WriteString(s.w, `"`); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(s.w, `"data":`)
+	return err
+}
+
+// openJSONObject returns the given compact JSON object without its closing
+// brace (and with a trailing comma if it has any fields) so that more fields
+// can be appended to it
+func openJSONObject(j []byte) []byte {
+	open := j[:len(j)-1]
+	if len(open) > 1 {
+		open = append(open, ',')
+	}
+	return open
+}
+
+// ProgressWriter writes progress updates for a long running operation as
+// NDJSON, one {"progress":{"done":N,"total":M}} object per line, followed by
+// the final JSON response (see Finish), it is safe for concurrent use
+type ProgressWriter struct {
+	mu       sync.Mutex
+	w        io.Writer
+	finished bool
+}
+
+// progressUpdate is the JSON line written for a progress update
+type progressUpdate struct {
+	Progress struct {
+		Done  int `json:"done"`
+		Total int `json:"total"`
+	} `json:"progress"`
+}
+
+// NewProgressWriter creates a ProgressWriter writing to the given writer
+func NewProgressWriter(w io.Writer) *ProgressWriter {
+	return &ProgressWriter{w: w}
+}
+
+// Progress writes a progress update saying done of total steps are done (eg:
+// "fetched 10/100"), any write error is returned as is an error if the final
+// response was already written
+func (p *ProgressWriter) Progress(done int, total int) error {
+	var update progressUpdate
+	update.Progress.Done = done
+	update.Progress.Total = total
+	j, err := marshalJSON(&update)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.finished {
+		return fmt.Errorf("progress update after the final response was written")
+	}
+	_, err = p.w.Write(append(j, '\n'))
+	return err
+}
+
+// Finish writes the final response as a compact JSON line, it is built as
+// GetJSONOutput would (so any stored note, warning or error are included)
+// and ends the progress stream (no more updates can be written).  The
+// boolean returned is true if a fatal error was encoded in the response, any
+// write error is also returned.
+func (p *ProgressWriter) Finish(apiVer string, context string, kind string, verbosity string, fields []string, items []interface{}) (bool, error) {
+	setItems := func(r *Response) {
+		r.SetAPIItems(kind, verbosity, fields, items)
+	}
+	output, fatalErr := getJSONOutput(apiVer, context, setItems, true)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.finished {
+		return fatalErr, fmt.Errorf("the final response was already written")
+	}
+	p.finished = true
+	_, err := io.WriteString(p.w, strings.TrimPrefix(output, utf8BOM)+"\n")
+	return fatalErr, err
+}
+
+// ResponseReader reads API responses from an NDJSON stream (eg: one that
+// was written via a ResponseStream)
+type ResponseReader struct {
+	dec *json.Decoder
+}
+
+// NewResponseReader creates a ResponseReader reading from the given reader,
+// numbers are decoded as json.Number values if UseNumber() is true
+func NewResponseReader(r io.Reader) *ResponseReader {
+	dec := json.NewDecoder(r)
+	if UseNumber() {
+		dec.UseNumber()
+	}
+	return &ResponseReader{dec: dec}
+}
+
+// Read returns the next response from the stream, io.EOF is returned once
+// there are no more responses
+func (r *ResponseReader) Read() (*Response, error) {
+	var resp Response
+	if err := r.dec.Decode(&resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
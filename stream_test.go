@@ -0,0 +1,419 @@
+// Copyright © 2016 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestResponseStream to see if responses are written one per line and read back
+func TestResponseStream(t *testing.T) {
+	var out bytes.Buffer
+	stream := NewResponseStream(&out)
+	first := NewResponse("0.1", "dvlnFirst").SetAPIItems("test", "", nil, []interface{}{"one"})
+	second := NewResponse("0.1", "dvlnSecond")
+	second.ID = -1
+	second.Error = NewMsg("This is a fatal\nerror", 2121, "FATAL")
+	for _, resp := range []*Response{first, second} {
+		if err := stream.Write(resp); err != nil {
+			t.Fatalf("ResponseStream write failed, error: %s\n", err)
+		}
+	}
+	lines := strings.Split(strings.TrimRight(out.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("ResponseStream should have written 2 lines, found %d:\n%s", len(lines), out.String())
+	}
+	checkResultContains(t, lines[0], `"context":"dvlnFirst"`)
+	checkResultContains(t, lines[1], `"message":"This is a fatal\nerror"`)
+
+	reader := NewResponseReader(&out)
+	contexts := []string{"dvlnFirst", "dvlnSecond"}
+	for _, context := range contexts {
+		resp, err := reader.Read()
+		if err != nil {
+			t.Fatalf("ResponseReader read failed, error: %s\n", err)
+		}
+		if resp.Context != context {
+			t.Errorf("ResponseReader expected context %s, found: %s\n", context, resp.Context)
+		}
+	}
+	if _, err := reader.Read(); err != io.EOF {
+		t.Errorf("ResponseReader expected io.EOF at end of stream, found: %v\n", err)
+	}
+}
+
+// TestSetUseNumber to see that large integers round trip through a response
+// without any precision loss (json.Number items are emitted as is)
+func TestSetUseNumber(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	bigNumber := "12345678901234567890123"
+	items := []interface{}{json.Number(bigNumber), map[string]interface{}{"size": json.Number("1.50")}}
+	output, _ := GetJSONOutputRaw("0.1", "dvlnTest", "test", "", nil, items)
+	checkResultContains(t, output, `"items":[12345678901234567890123,{"size":1.50}]`)
+
+	SetUseNumber(true)
+	defer SetUseNumber(false)
+	resp, err := NewResponseReader(strings.NewReader(output)).Read()
+	if err != nil {
+		t.Fatalf("ResponseReader read failed, error: %s\n", err)
+	}
+	data := resp.Data.(map[string]interface{})
+	readItems := data["items"].([]interface{})
+	if num, ok := readItems[0].(json.Number); !ok || num.String() != bigNumber {
+		t.Errorf("Large integer did not round trip as a json.Number, found: %v (%T)\n", readItems[0], readItems[0])
+	}
+	resp.Data = NewResponse("0.1", "dvlnTest").SetAPIItems("test", "", nil, readItems).Data
+	var out bytes.Buffer
+	if err := NewResponseStream(&out).Write(resp); err != nil {
+		t.Fatalf("ResponseStream write failed, error: %s\n", err)
+	}
+	checkResultContains(t, out.String(), `"items":[12345678901234567890123,{"size":1.50}]`)
+}
+
+// sliceSource is a simple ItemSource handing out the items of a slice
+type sliceSource struct {
+	items  []interface{}
+	pulled int
+}
+
+func (s *sliceSource) Next() (interface{}, bool) {
+	if s.pulled >= len(s.items) {
+		return nil, false
+	}
+	s.pulled++
+	return s.items[s.pulled-1], true
+}
+
+// TestSetAPIItemsSource to see if items are pulled from a source as the
+// response is streamed and that the result reads back as a normal response
+func TestSetAPIItemsSource(t *testing.T) {
+	var out bytes.Buffer
+	stream := NewResponseStream(&out)
+	src := &sliceSource{items: []interface{}{"one", map[string]interface{}{"two": 2}}}
+	resp := NewResponse("0.1", "dvlnSource").SetAPIItemsSource("test", "", []string{"two"}, src)
+	if src.pulled != 0 {
+		t.Fatalf("SetAPIItemsSource should not pull items up front, pulled %d\n", src.pulled)
+	}
+	if err := stream.Write(resp); err != nil {
+		t.Fatalf("ResponseStream write failed, error: %s\n", err)
+	}
+	result := out.String()
+	checkResultContains(t, result, `"data":{"kind":"test","fields":["two"],"startIndex":1,"items":["one",{"two":2}]}}`+"\n")
+	checkResultOmits(t, result, "totalItems")
+	readBack, err := NewResponseReader(&out).Read()
+	if err != nil {
+		t.Fatalf("Streamed sourced response should read back, error: %s\n", err)
+	}
+	if readBack.Context != "dvlnSource" {
+		t.Fatalf("Streamed sourced response context mismatch, found %q\n", readBack.Context)
+	}
+
+	// an empty source and a plain json.Marshal (which drains the source)
+	out.Reset()
+	resp = NewResponse("0.1", "").SetAPIItemsSource("", "", nil, &sliceSource{})
+	if err = stream.Write(resp); err != nil {
+		t.Fatalf("ResponseStream write failed, error: %s\n", err)
+	}
+	checkResultContains(t, out.String(), `"data":{"startIndex":1}}`+"\n")
+	resp = NewResponse("0.1", "").SetAPIItemsSource("", "", nil, &sliceSource{items: []interface{}{"a"}})
+	j, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatalf("Marshal of sourced response failed, error: %s\n", err)
+	}
+	checkResultContains(t, string(j), `"items":["a"]`)
+}
+
+// TestResponseStreamSourcedMsgs to see if the envelope msgs of a sourced
+// response are streamed (escaped) in place and read back as they were given
+func TestResponseStreamSourcedMsgs(t *testing.T) {
+	var out bytes.Buffer
+	stream := NewResponseStream(&out)
+	resp := NewResponse("0.1", "dvlnSource").SetAPIItemsSource("test", "", nil, &sliceSource{items: []interface{}{"one"}})
+	note := NewMsg("Using the \"cached\" index\n", 0, "NOTE")
+	note.Count = 2
+	resp.Note = note
+	resp.Warning = &Msg{Message: "Disk <nearly> full\n", Code: 2122, Level: "ISSUE"}
+	if err := stream.Write(resp); err != nil {
+		t.Fatalf("ResponseStream write failed, error: %s\n", err)
+	}
+	checkResultOmits(t, out.String(), "dvlnMsg")
+	checkResultContains(t, out.String(), `"note":{"message":"Using the \u0022cached\u0022 index\u000a","level":"NOTE","count":2},`)
+	var readBack struct {
+		Note    Msg `json:"note"`
+		Warning Msg `json:"warning"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &readBack); err != nil {
+		t.Fatalf("Streamed sourced response with msgs is not valid JSON, error: %s\n%s", err, out.String())
+	}
+	if readBack.Note.Message != note.Message || readBack.Warning.Message != resp.Warning.(*Msg).Message {
+		t.Errorf("Streamed msgs mismatch, found note %q and warning %q\n", readBack.Note.Message, readBack.Warning.Message)
+	}
+
+	// in the legacy schema the count is folded into the streamed message
+	SetMsgSchemaVersion(MsgSchemaLegacy)
+	defer SetMsgSchemaVersion(MsgSchemaCurrent)
+	out.Reset()
+	resp = NewResponse("0.1", "").SetAPIItemsSource("", "", nil, &sliceSource{})
+	resp.Note = note
+	if err := stream.Write(resp); err != nil {
+		t.Fatalf("ResponseStream write failed, error: %s\n", err)
+	}
+	checkResultContains(t, out.String(), `index (repeated 2 times)\u000a","level":"NOTE"},"data":{"startIndex":1}}`)
+}
+
+// countingFlusher counts how many times it was flushed
+type countingFlusher struct {
+	flushes int
+}
+
+func (f *countingFlusher) Flush() {
+	f.flushes++
+}
+
+// TestWriteSSE to see if items are sent as SSE data events followed by a
+// complete event with the response (sans items)
+func TestWriteSSE(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetStoredNonFatalWarning(NewMsg("This is a warning\n", 2122, "ISSUE"))
+	var out bytes.Buffer
+	flusher := &countingFlusher{}
+	if fatal, err := WriteSSE(&out, flusher, "0.1", "dvlnTest", "pkg", []interface{}{"one", map[string]interface{}{"two": 2}}); fatal || err != nil {
+		t.Fatalf("WriteSSE failed, fatal: %t, error: %v\n", fatal, err)
+	}
+	expected := "data: \"one\"\n\ndata: {\"two\":2}\n\nevent: complete\ndata: {\"apiVersion\":\"0.1\",\"context\":\"dvlnTest\",\"id\":0,\"warning\":{\"message\":\"This is a warning\\n\",\"code\":2122,\"level\":\"ISSUE\"},\"data\":{\"kind\":\"pkg\",\"totalItems\":2,\"startIndex\":1,\"currentItemCount\":2}}\n\n"
+	if out.String() != expected {
+		t.Errorf("WriteSSE output mismatch, expected:\n%q\nfound:\n%q\n", expected, out.String())
+	}
+	if flusher.flushes != 3 {
+		t.Errorf("WriteSSE should flush after each of 3 events, flushed %d times\n", flusher.flushes)
+	}
+	out.Reset()
+	if _, err := WriteSSE(&out, nil, "0.1", "", "", nil); err != nil {
+		t.Fatalf("WriteSSE with no items or flusher failed, error: %s\n", err)
+	}
+	checkResultContains(t, out.String(), "event: complete\ndata: {")
+	var multi bytes.Buffer
+	writeSSEEvent(&multi, nil, "", []byte("{\n  \"a\": 1\n}\n"))
+	if multi.String() != "data: {\ndata:   \"a\": 1\ndata: }\n\n" {
+		t.Errorf("Multi-line SSE data should use one data line per line, found: %q\n", multi.String())
+	}
+
+	var observed []string
+	SetOutputObserver(func(context string, output string, fatal bool) { observed = append(observed, output) })
+	defer SetOutputObserver(nil)
+	SetOutputFilter(func(s string) string { return strings.Replace(s, `"one"`, `"uno"`, -1) })
+	defer SetOutputFilter()
+	out.Reset()
+	if _, err := WriteSSE(&out, nil, "0.1", "", "", []interface{}{"one"}); err != nil {
+		t.Fatalf("WriteSSE with an output filter failed, error: %s\n", err)
+	}
+	checkResultContains(t, out.String(), "data: \"uno\"\n\nevent: complete\n")
+	if len(observed) != 2 || observed[0] != `"uno"` {
+		t.Errorf("Output observer should see each (filtered) SSE event, found: %q\n", observed)
+	}
+}
+
+// TestWriteSSEFatal to see if no data events are sent when a fatal error is
+// known up front (unless partial data is included on fatal errors)
+func TestWriteSSEFatal(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	getenv = func(key string) string { return "" }
+	defer func() { getenv = os.Getenv }()
+	var out bytes.Buffer
+	fatal, err := WriteSSE(&out, nil, "", "dvlnTest", "pkg", []interface{}{"one"})
+	if !fatal || err != nil {
+		t.Fatalf("WriteSSE with no API version should be fatal, fatal: %t, error: %v\n", fatal, err)
+	}
+	if !strings.HasPrefix(out.String(), "event: complete\n") {
+		t.Errorf("WriteSSE with no API version should only send the complete event, found:\n%s", out.String())
+	}
+	checkResultContains(t, out.String(), `"code":1001`)
+
+	SetStoredFatalError(NewMsg("This is a fatal error\n", 2121, "FATAL"))
+	out.Reset()
+	if fatal, _ = WriteSSE(&out, nil, "0.1", "dvlnTest", "pkg", []interface{}{"one"}); !fatal {
+		t.Errorf("WriteSSE with a stored fatal error should be fatal\n")
+	}
+	checkResultOmits(t, out.String(), `data: "one"`)
+	checkResultContains(t, out.String(), `"id":-1,"error":{"message":"This is a fatal error\n"`)
+
+	SetIncludePartialDataOnFatal(true)
+	defer SetIncludePartialDataOnFatal(false)
+	out.Reset()
+	WriteSSE(&out, nil, "0.1", "dvlnTest", "pkg", []interface{}{"one"})
+	checkResultContains(t, out.String(), "data: \"one\"\n\nevent: complete\n")
+	checkResultContains(t, out.String(), `"data":{"kind":"pkg","totalItems":1,`)
+}
+
+// cancelingSource is an ItemSource that cancels a context once it has handed
+// out the given number of items
+type cancelingSource struct {
+	sliceSource
+	after  int
+	cancel context.CancelFunc
+}
+
+func (s *cancelingSource) Next() (interface{}, bool) {
+	if s.pulled == s.after {
+		s.cancel()
+	}
+	return s.sliceSource.Next()
+}
+
+// TestStreamContext to see if streaming stops once the context is done
+func TestStreamContext(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	src := &cancelingSource{sliceSource: sliceSource{items: []interface{}{"one", "two", "three"}}, after: 1, cancel: cancel}
+	var out bytes.Buffer
+	resp := NewResponse("0.1", "").SetAPIItemsSource("test", "", nil, src)
+	if err := NewResponseStream(&out).WriteContext(ctx, resp); err != context.Canceled {
+		t.Errorf("Canceled stream write should return the context error, found: %v\n", err)
+	}
+	if src.pulled != 2 {
+		t.Errorf("Canceled stream write should stop pulling items, pulled %d\n", src.pulled)
+	}
+	checkResultOmits(t, out.String(), "three")
+
+	out.Reset()
+	if _, err := WriteSSEContext(ctx, &out, nil, "0.1", "", "", []interface{}{"one"}); err != context.Canceled {
+		t.Errorf("Canceled WriteSSEContext should return the context error, found: %v\n", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Canceled WriteSSEContext should not write, found: %q\n", out.String())
+	}
+	fatal, err := WriteJSONOutputContext(ctx, &out, "0.1", "", "test", "", nil, []interface{}{"one"})
+	if fatal || err != context.Canceled || out.Len() != 0 {
+		t.Errorf("Canceled WriteJSONOutputContext should not write, error: %v, found: %q\n", err, out.String())
+	}
+	if _, err = WriteJSONOutputContext(context.Background(), &out, "0.1", "", "test", "", nil, []interface{}{"one"}); err != nil {
+		t.Errorf("WriteJSONOutputContext failed, error: %s\n", err)
+	}
+	checkResultContains(t, out.String(), `"one"`)
+}
+
+// TestProgressWriter to see if progress lines are followed by the response
+func TestProgressWriter(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	var out bytes.Buffer
+	progress := NewProgressWriter(&out)
+	for _, done := range []int{10, 100} {
+		if err := progress.Progress(done, 100); err != nil {
+			t.Fatalf("Progress update failed, error: %s\n", err)
+		}
+	}
+	SetStoredNote(NewMsg("Fetched from the mirror\n", 0, "INFO"))
+	fatal, err := progress.Finish("0.1", "dvlnFetch", "pkg", "", nil, []interface{}{"one"})
+	if fatal || err != nil {
+		t.Fatalf("Progress finish failed, fatal: %t, error: %v\n", fatal, err)
+	}
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) != 4 || lines[3] != "" {
+		t.Fatalf("Progress output should be 3 lines, found:\n%s", out.String())
+	}
+	if lines[0] != `{"progress":{"done":10,"total":100}}` || lines[1] != `{"progress":{"done":100,"total":100}}` {
+		t.Errorf("Progress lines not as expected, found:\n%s", out.String())
+	}
+	checkResultContains(t, lines[2], `{"apiVersion":"0.1","context":"dvlnFetch","id":0,"note":{"message":"Fetched from the mirror\n"`)
+	if err = progress.Progress(1, 1); err == nil {
+		t.Errorf("Progress update after finish should fail\n")
+	}
+	if _, err = progress.Finish("0.1", "", "", "", nil, nil); err == nil {
+		t.Errorf("Second progress finish should fail\n")
+	}
+}
+
+// TestWriteHTTPStreamed to see if the items are the body and the rest of the
+// response is in the trailers
+func TestWriteHTTPStreamed(t *testing.T) {
+	resetStoredMsgs()
+	defer resetStoredMsgs()
+	SetStoredNote(NewMsg("Using cached index\n", 0, "INFO"))
+	rec := httptest.NewRecorder()
+	fatal, err := WriteHTTPStreamed(rec, "0.1", "dvlnTest", "pkg", []interface{}{"one", map[string]int{"two": 2}})
+	if fatal || err != nil {
+		t.Fatalf("WriteHTTPStreamed failed, fatal: %t, error: %v\n", fatal, err)
+	}
+	result := rec.Result()
+	body, _ := io.ReadAll(result.Body)
+	if string(body) != "[\"one\",{\"two\":2}]\n" {
+		t.Errorf("WriteHTTPStreamed body should be the items, found: %q\n", body)
+	}
+	if !rec.Flushed {
+		t.Errorf("WriteHTTPStreamed should flush as items are written\n")
+	}
+	expected := `{"apiVersion":"0.1","context":"dvlnTest","id":0,"note":{"message":"Using cached index\n","level":"INFO"},"data":{"kind":"pkg","totalItems":2,"startIndex":1,"currentItemCount":2}}`
+	if envelope := result.Trailer.Get(TrailerEnvelope); envelope != expected {
+		t.Errorf("Envelope trailer mismatch, expected:\n%s\nfound:\n%s", expected, envelope)
+	}
+	if result.Trailer.Get(TrailerFatal) != "false" {
+		t.Errorf("Fatal trailer should be false, found: %q\n", result.Trailer.Get(TrailerFatal))
+	}
+
+	SetStoredFatalError(NewMsg("This is a fatal error\n", 2121, "FATAL"))
+	rec = httptest.NewRecorder()
+	fatal, _ = WriteHTTPStreamed(rec, "0.1", "dvlnTest", "pkg", []interface{}{"one"})
+	result = rec.Result()
+	body, _ = io.ReadAll(result.Body)
+	if !fatal || string(body) != "[]\n" || result.Trailer.Get(TrailerFatal) != "true" {
+		t.Errorf("WriteHTTPStreamed with a fatal error not as expected, body: %q, trailers: %v\n", body, result.Trailer)
+	}
+	if result.StatusCode != http.StatusInternalServerError {
+		t.Errorf("WriteHTTPStreamed with a fatal error should set status 500, found: %d\n", result.StatusCode)
+	}
+	checkResultContains(t, result.Trailer.Get(TrailerEnvelope), `"id":-1,"error":{"message":"This is a fatal error\n"`)
+	SetIncludePartialDataOnFatal(true)
+	rec = httptest.NewRecorder()
+	WriteHTTPStreamed(rec, "0.1", "dvlnTest", "pkg", []interface{}{"one"})
+	SetIncludePartialDataOnFatal(false)
+	result = rec.Result()
+	body, _ = io.ReadAll(result.Body)
+	if string(body) != "[\"one\"]\n" || result.StatusCode != http.StatusInternalServerError {
+		t.Errorf("WriteHTTPStreamed with partial data on fatal not as expected, status: %d, body: %q\n", result.StatusCode, body)
+	}
+	checkResultContains(t, result.Trailer.Get(TrailerEnvelope), `"data":{"kind":"pkg","totalItems":1,`)
+
+	resetStoredMsgs()
+	var observed []string
+	SetOutputObserver(func(context string, output string, fatal bool) { observed = append(observed, output) })
+	defer SetOutputObserver(nil)
+	SetOutputFilter(func(s string) string { return strings.Replace(s, "pkg", "package", -1) })
+	defer SetOutputFilter()
+	rec = httptest.NewRecorder()
+	WriteHTTPStreamed(rec, "0.1", "dvlnTest", "pkg", []interface{}{"pkg"})
+	result = rec.Result()
+	body, _ = io.ReadAll(result.Body)
+	if string(body) != "[\"package\"]\n" {
+		t.Errorf("WriteHTTPStreamed body items should be filtered, found: %q\n", body)
+	}
+	envelope := result.Trailer.Get(TrailerEnvelope)
+	checkResultContains(t, envelope, `"kind":"package"`)
+	if len(observed) != 2 || observed[0] != `"package"` || observed[1] != envelope {
+		t.Errorf("Output observer should see each item and the envelope, found: %q\n", observed)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright © 2016 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+// The dvln/api/syslog.go module sends the messages of a response (not the
+// bulk data) to the local syslog for deployments that route diagnostics
+// there, log/syslog isn't available on Windows or Plan 9 so neither is this.
+
+package api
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+)
+
+// syslogWriter is the part of a syslog.Writer used to send messages
+type syslogWriter interface {
+	Err(m string) error
+	Warning(m string) error
+	Notice(m string) error
+	Info(m string) error
+	Close() error
+}
+
+// syslogDial connects to the local syslog, tests can stub it out
+var syslogDial = func(priority syslog.Priority, tag string) (syslogWriter, error) {
+	return syslog.New(priority, tag)
+}
+
+// syslogFacilityMask is the part of a syslog.Priority that is the facility
+const syslogFacilityMask = 0xf8
+
+// WriteToSyslog sends the error, warning and note of the given response (and
+// any diagnostics) to the local syslog, one log entry each, the bulk data is
+// not sent.  The facility of the given priority is used (eg: syslog.LOG_USER)
+// while the severity comes from each message level: FATAL is LOG_ERR,
+// WARNING is LOG_WARNING, ISSUE is LOG_NOTICE and anything else is LOG_INFO.
+// The response context (if any) is used as the syslog tag.  Any error
+// connecting to or writing to syslog is returned.
+func WriteToSyslog(priority syslog.Priority, resp *Response) error {
+	w, err := syslogDial(priority&syslogFacilityMask|syslog.LOG_INFO, resp.Context)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	for _, m := range []interface{}{resp.Error, resp.Warning, resp.Note} {
+		msg, ok := m.(Msg)
+		if !ok || msg.Message == "" {
+			continue
+		}
+		if err = writeSyslogEntry(w, msg.Level, syslogMsgText(msg)); err != nil {
+			return err
+		}
+	}
+	for _, diag := range resp.Diagnostics {
+		text := fmt.Sprintf("%s: %s", diag.Level, strings.TrimSpace(diag.Message))
+		if diag.Location != "" {
+			text = fmt.Sprintf("%s (%s)", text, diag.Location)
+		}
+		if err = writeSyslogEntry(w, string(diag.Level), text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syslogMsgText returns the Msg as a single line of syslog text, eg:
+// "FATAL 2121: Unable to save: caused by: Disk full"
+func syslogMsgText(msg Msg) string {
+	text := strings.Join(strings.Fields(msg.Message), " ")
+	if msg.Code != 0 {
+		text = fmt.Sprintf("%d: %s", renderedCode(msg.Code), text)
+	}
+	if msg.Level != "" {
+		text = msg.Level + " " + text
+	}
+	for _, cause := range msg.Causes {
+		text = fmt.Sprintf("%s: caused by: %s", text, syslogMsgText(cause))
+	}
+	return text
+}
+
+// writeSyslogEntry writes the text to syslog with the severity that maps to
+// the given level
+func writeSyslogEntry(w syslogWriter, level string, text string) error {
+	switch LevelSeverity(level) {
+	case LevelSeverity(string(LevelFatal)):
+		return w.Err(text)
+	case LevelSeverity(string(LevelWarning)):
+		return w.Warning(text)
+	case LevelSeverity(string(LevelIssue)):
+		return w.Notice(text)
+	}
+	return w.Info(text)
+}
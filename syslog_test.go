@@ -0,0 +1,83 @@
+// Copyright © 2016 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package api
+
+import (
+	"errors"
+	"log/syslog"
+	"testing"
+)
+
+// testSyslog records the entries written to it
+type testSyslog struct {
+	entries []string
+	closed  bool
+}
+
+func (s *testSyslog) Err(m string) error     { s.entries = append(s.entries, "err "+m); return nil }
+func (s *testSyslog) Warning(m string) error { s.entries = append(s.entries, "warning "+m); return nil }
+func (s *testSyslog) Notice(m string) error  { s.entries = append(s.entries, "notice "+m); return nil }
+func (s *testSyslog) Info(m string) error    { s.entries = append(s.entries, "info "+m); return nil }
+func (s *testSyslog) Close() error           { s.closed = true; return nil }
+
+// TestWriteToSyslog to see if response messages go to syslog with the right
+// severities and the facility from the given priority
+func TestWriteToSyslog(t *testing.T) {
+	logger := &testSyslog{}
+	var dialPriority syslog.Priority
+	var dialTag string
+	origDial := syslogDial
+	defer func() { syslogDial = origDial }()
+	syslogDial = func(priority syslog.Priority, tag string) (syslogWriter, error) {
+		dialPriority, dialTag = priority, tag
+		return logger, nil
+	}
+	resp := NewResponse("0.1", "dvlnTest").SetAPIItems("test", "", nil, []interface{}{"one"})
+	resp.Error = WrapMsg(NewMsg("Unable to save\n", 2121, "FATAL"), NewMsg("Disk\nfull\n", 3001, "FATAL"))
+	resp.Warning = NewMsg("This is a warning\n", 2122, "ISSUE")
+	resp.Note = NewMsg("This is a note\n", 0, "NOTE")
+	resp.Diagnostics = []Diagnostic{{Level: LevelWarning, Message: "Unused var", Location: "main.go:3"}}
+	if err := WriteToSyslog(syslog.LOG_LOCAL0|syslog.LOG_DEBUG, resp); err != nil {
+		t.Fatalf("WriteToSyslog failed, error: %s\n", err)
+	}
+	if dialPriority != syslog.LOG_LOCAL0|syslog.LOG_INFO || dialTag != "dvlnTest" {
+		t.Errorf("WriteToSyslog dialed with priority %d and tag %q\n", dialPriority, dialTag)
+	}
+	expected := []string{
+		"err FATAL 2121: Unable to save: caused by: FATAL 3001: Disk full",
+		"notice ISSUE 2122: This is a warning",
+		"info NOTE This is a note",
+		"warning WARNING: Unused var (main.go:3)",
+	}
+	if len(logger.entries) != len(expected) {
+		t.Fatalf("WriteToSyslog wrote %d entries, expected %d: %q\n", len(logger.entries), len(expected), logger.entries)
+	}
+	for i, entry := range expected {
+		if logger.entries[i] != entry {
+			t.Errorf("Syslog entry %d should be %q, found %q\n", i, entry, logger.entries[i])
+		}
+	}
+	if !logger.closed {
+		t.Errorf("WriteToSyslog should close the syslog connection\n")
+	}
+	syslogDial = func(syslog.Priority, string) (syslogWriter, error) {
+		return nil, errors.New("no syslog")
+	}
+	if err := WriteToSyslog(syslog.LOG_USER, resp); err == nil {
+		t.Errorf("WriteToSyslog should return the syslog connection error\n")
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright © 2016 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The dvln/api/tabular.go module exports items in tabular (non JSON) form,
+// eg: CSV for spreadsheet users or an aligned text table for terminals,
+// using the fields as the columns so the same kind/fields/items model used
+// for the JSON output applies.
+
+package api
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultTableMaxWidth is the default max column width for GetTableOutput
+const DefaultTableMaxWidth = 40
+
+var (
+	// tableMaxWidth is the max width (in chars) of a GetTableOutput column,
+	// longer values are truncated, 0 means unlimited (accessed under mutex
+	// from api.go)
+	tableMaxWidth = DefaultTableMaxWidth
+)
+
+// TableMaxWidth returns the max column width used by GetTableOutput
+func TableMaxWidth() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	width := tableMaxWidth
+	return width
+}
+
+// SetTableMaxWidth can be used to change the max width (in chars) of each
+// GetTableOutput column, longer values (or headers) are truncated and end
+// in "..." so one long value doesn't push the rest of the table off the
+// screen.  Use 0 for unlimited, defaults to DefaultTableMaxWidth (40).
+func SetTableMaxWidth(width int) {
+	mu.Lock()
+	defer mu.Unlock()
+	tableMaxWidth = width
+}
+
+// GetCSVOutput returns the given items as CSV, a header row with the fields
+// and then a row per item with the value of each field in that column (in
+// fields order), fields an item doesn't have are empty cells.  Map and
+// struct items are supported (structs by their JSON field names), nested
+// values are put in their cell as compact JSON.  Items are transformed and
+// durations rendered as with SetAPIItems, no stored msgs are used or stored,
+// any failure is simply returned.
+func GetCSVOutput(fields []string, items []interface{}) (string, error) {
+	rows, err := tableRows(fields, items)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	w := csv.NewWriter(&out)
+	if err = w.Write(fields); err != nil {
+		return "", err
+	}
+	if err = w.WriteAll(rows); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// GetTableOutput returns the given items as a column aligned text table for
+// terminal display, a header line with the fields, a line of dashes under
+// each header and then a line per item with the value of each field in that
+// column (see GetCSVOutput for how items and values are handled).  Values are
+// put on one line (newlines and tabs become spaces) and truncated to the max
+// column width (see SetTableMaxWidth).
+func GetTableOutput(fields []string, items []interface{}) (string, error) {
+	rows, err := tableRows(fields, items)
+	if err != nil {
+		return "", err
+	}
+	maxWidth := TableMaxWidth()
+	lines := make([][]string, 0, len(rows)+2)
+	lines = append(lines, copyFields(fields), nil)
+	lines = append(lines, rows...)
+	widths := make([]int, len(fields))
+	for _, line := range lines {
+		for col, cell := range line {
+			cell = tableCell(cell, maxWidth)
+			line[col] = cell
+			if n := utf8.RuneCountInString(cell); n > widths[col] {
+				widths[col] = n
+			}
+		}
+	}
+	dashes := make([]string, len(fields))
+	for col, width := range widths {
+		dashes[col] = strings.Repeat("-", width)
+	}
+	lines[1] = dashes
+	var out strings.Builder
+	for _, line := range lines {
+		var text strings.Builder
+		for col, cell := range line {
+			if col > 0 {
+				text.WriteString("  ")
+			}
+			text.WriteString(cell)
+			text.WriteString(strings.Repeat(" ", widths[col]-utf8.RuneCountInString(cell)))
+		}
+		out.WriteString(strings.TrimRight(text.String(), " "))
+		out.WriteByte('\n')
+	}
+	return out.String(), nil
+}
+
+// tableCell returns the given cell text on one line and truncated to the
+// given max width (0 is unlimited), truncated text ends in "..."
+func tableCell(cell string, maxWidth int) string {
+	cell = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ", "\t", " ").Replace(cell)
+	if maxWidth <= 0 || utf8.RuneCountInString(cell) <= maxWidth {
+		return cell
+	}
+	runes := []rune(cell)
+	if maxWidth <= 3 {
+		return string(runes[:maxWidth])
+	}
+	return string(runes[:maxWidth-3]) + "..."
+}
+
+// tableRows returns the cell text of each of the given fields for each item
+func tableRows(fields []string, items []interface{}) ([][]string, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no fields given for the table columns")
+	}
+	items = convertItemDurations(transformItems(items))
+	rows := make([][]string, 0, len(items))
+	for i, item := range items {
+		m, err := itemMap(item)
+		if err != nil {
+			return nil, fmt.Errorf("item %d: %s", i+1, err)
+		}
+		row := make([]string, len(fields))
+		for col, field := range fields {
+			if row[col], err = cellText(m[field]); err != nil {
+				return nil, fmt.Errorf("item %d field %q: %s", i+1, field, err)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// itemMap returns the given (map or struct) item as a map of its fields,
+// numbers within structs are kept exactly as json.Number values
+func itemMap(item interface{}) (map[string]interface{}, error) {
+	if m, ok := item.(map[string]interface{}); ok {
+		return m, nil
+	}
+	if item == nil {
+		return nil, nil
+	}
+	j, err := marshalJSON(item)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.UseNumber()
+	var m map[string]interface{}
+	if err = dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("not a map or struct item")
+	}
+	return m, nil
+}
+
+// cellText returns the text for a table cell holding the given value,
+// strings and numbers are used as is and nested values as compact JSON
+func cellText(val interface{}) (string, error) {
+	switch v := val.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	j, err := marshalJSON(val)
+	if err != nil {
+		return "", err
+	}
+	return bytesToString(j), nil
+}
@@ -0,0 +1,86 @@
+// Copyright © 2016 Erik Brady <brady@dvln.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"testing"
+)
+
+// tablePkg is a struct item used by the tabular tests
+type tablePkg struct {
+	Name    string            `json:"name"`
+	Size    int64             `json:"size"`
+	Tags    []string          `json:"tags,omitempty"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+	Enabled bool              `json:"enabled"`
+}
+
+// TestGetCSVOutput to see if items come out as CSV rows in fields order
+func TestGetCSVOutput(t *testing.T) {
+	items := []interface{}{
+		map[string]interface{}{"name": "one", "size": 12, "note": "has, comma"},
+		tablePkg{Name: "two \"quoted\"", Size: 12345678901234567, Tags: []string{"a", "b"}, Enabled: true},
+		map[string]interface{}{"size": 3.5},
+	}
+	output, err := GetCSVOutput([]string{"name", "size", "tags", "enabled", "note"}, items)
+	if err != nil {
+		t.Fatalf("GetCSVOutput failed, error: %s\n", err)
+	}
+	expected := "name,size,tags,enabled,note\n" +
+		"one,12,,,\"has, comma\"\n" +
+		"\"two \"\"quoted\"\"\",12345678901234567,\"[\"\"a\"\",\"\"b\"\"]\",true,\n" +
+		",3.5,,,\n"
+	if output != expected {
+		t.Errorf("GetCSVOutput mismatch, expected:\n%s\nfound:\n%s", expected, output)
+	}
+	if _, err = GetCSVOutput(nil, items); err == nil {
+		t.Errorf("GetCSVOutput with no fields should fail\n")
+	}
+	if _, err = GetCSVOutput([]string{"name"}, []interface{}{"not an object"}); err == nil {
+		t.Errorf("GetCSVOutput with a string item should fail\n")
+	}
+}
+
+// TestGetTableOutput to see if items come out as an aligned text table
+func TestGetTableOutput(t *testing.T) {
+	items := []interface{}{
+		map[string]interface{}{"name": "one", "size": 12, "desc": "first\nline"},
+		tablePkg{Name: "twenty-two", Size: 3, Enabled: true},
+		map[string]interface{}{"name": "ünïcode", "desc": "a very long description that goes on"},
+	}
+	fields := []string{"name", "size", "enabled", "desc"}
+	SetTableMaxWidth(20)
+	defer SetTableMaxWidth(DefaultTableMaxWidth)
+	output, err := GetTableOutput(fields, items)
+	if err != nil {
+		t.Fatalf("GetTableOutput failed, error: %s\n", err)
+	}
+	expected := "name        size  enabled  desc\n" +
+		"----------  ----  -------  --------------------\n" +
+		"one         12             first line\n" +
+		"twenty-two  3     true\n" +
+		"ünïcode                    a very long descr...\n"
+	if output != expected {
+		t.Errorf("GetTableOutput mismatch, expected:\n%s\nfound:\n%s", expected, output)
+	}
+	if fields[0] != "name" {
+		t.Errorf("GetTableOutput should not modify the callers fields, found: %v\n", fields)
+	}
+	SetTableMaxWidth(0)
+	output, _ = GetTableOutput(fields, items)
+	checkResultContains(t, output, "a very long description that goes on\n")
+	if _, err = GetTableOutput(nil, items); err == nil {
+		t.Errorf("GetTableOutput with no fields should fail\n")
+	}
+}